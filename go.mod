@@ -5,7 +5,7 @@ go 1.19
 require (
 	github.com/aws/aws-cdk-go/awscdk/v2 v2.38.1
 	github.com/aws/aws-lambda-go v1.34.1
-	github.com/aws/aws-sdk-go v1.44.81
+	github.com/aws/aws-sdk-go v1.55.5
 	github.com/aws/constructs-go/constructs/v10 v10.1.81
 	github.com/aws/jsii-runtime-go v1.65.0
 	github.com/google/go-github v17.0.0+incompatible
@@ -15,6 +15,7 @@ require (
 	github.com/sirupsen/logrus v1.9.0
 	github.com/slack-go/slack v0.11.2
 	golang.org/x/oauth2 v0.0.0-20220808172628-8227340efae7
+	gopkg.in/yaml.v2 v2.4.0
 )
 
 require (
@@ -35,5 +36,4 @@ require (
 	golang.org/x/text v0.14.0 // indirect
 	google.golang.org/appengine v1.6.7 // indirect
 	google.golang.org/protobuf v1.28.0 // indirect
-	gopkg.in/yaml.v2 v2.4.0 // indirect
 )
@@ -5,36 +5,360 @@ import {
   PhysicalName,
   RemovalPolicy,
 } from 'aws-cdk-lib'
-import { Pipeline } from 'aws-cdk-lib/aws-codepipeline'
-import { Effect, PolicyStatement } from 'aws-cdk-lib/aws-iam'
+import { IPipeline, Pipeline } from 'aws-cdk-lib/aws-codepipeline'
+import {
+  AttributeType,
+  BillingMode,
+  Table,
+} from 'aws-cdk-lib/aws-dynamodb'
+import { LambdaFunction } from 'aws-cdk-lib/aws-events-targets'
+import { Effect, IGrantable, PolicyStatement } from 'aws-cdk-lib/aws-iam'
 import {
   Architecture,
   Code,
   Function,
+  FunctionUrl,
   FunctionUrlAuthType,
   Runtime,
   SingletonFunction,
 } from 'aws-cdk-lib/aws-lambda'
+import { SqsEventSource } from 'aws-cdk-lib/aws-lambda-event-sources'
 import { RetentionDays } from 'aws-cdk-lib/aws-logs'
+import {
+  BlockPublicAccess,
+  Bucket,
+  BucketEncryption,
+} from 'aws-cdk-lib/aws-s3'
+import { ISecret, Secret } from 'aws-cdk-lib/aws-secretsmanager'
+import { Asset } from 'aws-cdk-lib/aws-s3-assets'
+import { Queue } from 'aws-cdk-lib/aws-sqs'
 import { Provider } from 'aws-cdk-lib/custom-resources'
 import { Construct } from 'constructs'
 
+export interface GithubSourceRoute {
+  readonly name?: string
+  // `push` (default), `pull_request` or `deploy`
+  readonly event?: string
+  // Pull request actions, defaults to opened, synchronize and reopened
+  readonly actions?: string[]
+  // Environment of the `/deploy <environment>` pull request comments
+  // started by a `deploy` route
+  readonly environment?: string
+  // Repository glob, e.g. `khine.net/website` or `khine.net/*`. Every
+  // repository matches when it is empty, set it with an org webhook
+  readonly repository?: string
+  // Branch glob, e.g. `main` or `release/*`. The base branch for pull requests
+  readonly branch: string
+  // Same syntax as GithubSourceProps.filters, every push matches when empty
+  readonly filters?: string[]
+  // Lambda directories, with the syntax of the filters, whose code is
+  // affected by the push, e.g. `src/lambda/api/`.
+  // Needs GithubSourceProps.dependencyManifest
+  readonly lambdas?: string[]
+  readonly codepipeline: IPipeline
+  // Pass the commit metadata as pipeline variables, needs a V2 pipeline
+  readonly variables?: boolean
+  // Source action whose revision is overridden with the pushed commit
+  readonly sourceAction?: string
+  readonly concurrency?: ConcurrencyPolicy
+  readonly authors?: AuthorPolicy
+  // Only start the pipeline when github verified the head commit signature
+  readonly requireVerifiedCommits?: boolean
+}
+
+// Who can start a pipeline. allow lists the only pushers allowed, deny the
+// pushers and commit authors never allowed, and ignoreBots skips the pushes
+// of dependabot, renovate and the other bots
+export interface AuthorPolicy {
+  readonly allow?: string[]
+  readonly deny?: string[]
+  readonly ignoreBots?: boolean
+}
+
+// What happens to the executions in progress when a push starts the pipeline again.
+// `queue` lets codepipeline queue them, `supersede` stops the older executions and
+// `coalesce` does not start the pipeline if it is already building the commit or a newer one,
+// the statuses are then only posted to the commit being built
+export type ConcurrencyPolicy = 'queue' | 'supersede' | 'coalesce'
+
+// Github app managing the webhook instead of the githubTokenArn token.
+// The app needs the repository "Webhooks: read & write" permission, or the
+// organization "Webhooks: read & write" permission when webhookScope is org
+export interface GithubAppAuth {
+  readonly appId: number
+  // Secret holding the PEM private key generated for the app
+  readonly privateKeyArn: string
+  // Looked up from the repository when it is not set
+  readonly installationId?: number
+}
+
 export interface GithubSourceProps {
   readonly repo: string
   readonly owner: string
   readonly branch: string
   readonly githubTokenArn: string
+  // Manage the webhook with a github app, so it is not tied to the person
+  // owning githubTokenArn
+  readonly githubApp?: GithubAppAuth
 
-  // Filters is just a list of prefixes.
+  // Filters is a list of prefixes or globs, e.g. `src/**/*.go`, `*.html`.
+  // Entries starting with `!` exclude files matched by an earlier entry.
   // It'll check all modified/removed/added files and start codepipeline
-  // if any of them have files with the matching prefixes
+  // if any of them are matched by the filters
   readonly filters: string[]
+  // Start codepipeline when the push affects these lambdas,
+  // see GithubSourceRoute
+  readonly lambdas?: string[]
+  // Manifest generated by src/tools/lambda-deps, e.g. `dist/lambda-deps.json`.
+  // The affected lambdas are passed to the pipeline as AFFECTED_LAMBDAS
+  readonly dependencyManifest?: string
   readonly codepipeline: Pipeline
+  // Pass COMMIT_ID, REF, BRANCH, PUSHER, COMMIT_MESSAGE and CHANGED_PATHS
+  // as pipeline variables. The pipeline must be a V2 pipeline declaring them
+  readonly pipelineVariables?: boolean
+  // Source action whose revision is overridden with the pushed commit
+  readonly sourceActionName?: string
+  readonly concurrencyPolicy?: ConcurrencyPolicy
+  // Pipelines started for pull requests to the branch. The preview runs when a
+  // pull request is opened or updated, the teardown when it is closed.
+  // Both get PR_NUMBER, COMMIT_ID and the other variables
+  readonly previewPipeline?: IPipeline
+  readonly teardownPipeline?: IPipeline
+  // Start them for the pull requests from forks too. The head commit of a
+  // fork is not trusted and runs with the role of the pipeline
+  readonly allowForkPullRequests?: boolean
+  // Pipelines started with the pull request head commit when a collaborator
+  // comments `/deploy <environment>`, keyed by environment
+  readonly deployPipelines?: { [environment: string]: IPipeline }
+  // Repository permission needed to deploy, `write` (default) or `admin`
+  readonly deployPermission?: string
+
+  // Secret shared with github to sign the webhook deliveries.
+  // A random one is generated when it is not provided
+  readonly webhookSecret?: ISecret
+
+  // Events the webhook is registered for, defaults to push, pull_request and
+  // issue_comment. trigger-fn acknowledges the other events without acting
+  readonly webhookEvents?: string[]
+  // An inactive webhook is kept in the repository but not delivered
+  readonly webhookActive?: boolean
+  // Skip the certificate verification of the webhook url, e.g. behind a
+  // self signed proxy
+  readonly webhookInsecureSsl?: boolean
+  // `repo` (default) registers the webhook on the repository, `org` on the
+  // owner organization, which delivers the events of all its repositories.
+  // The default route is then restricted to the repository, the routes
+  // need their repository
+  readonly webhookScope?: 'repo' | 'org'
+
+  // Reject the requests not sent from the hook ranges published by github.
+  // sourceCidrs are allowed as well, e.g. for a self hosted gitea
+  readonly restrictSourceIps?: boolean
+  readonly sourceCidrs?: string[]
+
+  // Queue the deliveries and start the pipelines from a separate consumer,
+  // so that github gets a response before its 10 seconds timeout
+  readonly asyncProcessing?: boolean
+
+  // Archive every authenticated delivery, with its secrets redacted, to replay
+  // it with the replay-delivery tool. Deliveries are kept for 90 days
+  readonly archiveDeliveries?: boolean
+
+  // Policies of the default route, see GithubSourceRoute
+  readonly authors?: AuthorPolicy
+  readonly requireVerifiedCommits?: boolean
+
+  // Routing table, a single push can start every pipeline with a matching route.
+  // When it is set branch, filters and codepipeline are ignored
+  readonly routes?: GithubSourceRoute[]
+
+  // Read the routes of a push from this file of the pushed commit, e.g.
+  // `.deploy.yml`, instead of redeploying the stack to change them.
+  // It can only narrow the push routes above, or codepipeline, and the routes
+  // above are used when the file is missing or invalid. Pull request and
+  // deploy routes are not read from the file
+  readonly repoRoutesFile?: string
+
+  // Accept manual dispatches on `/dispatch`, to start a pipeline for a commit
+  // without pushing. They are signed with a generated dispatch secret, or sent
+  // with IAM credentials to dispatchUrl, see GithubSource.grantDispatch.
+  // The commit has to be on the branch, checked with githubTokenArn
+  readonly manualDispatch?: boolean
 }
 export class GithubSource extends Construct {
+  // Function url authenticating the manual dispatches with IAM
+  public readonly dispatchUrl?: FunctionUrl
+  // Secret signing the manual dispatches sent to the public function url
+  public readonly dispatchSecret?: ISecret
+
   constructor(scope: Construct, id: string, props: GithubSourceProps) {
     super(scope, id)
 
+    const webhookSecret =
+      props.webhookSecret ??
+      new Secret(this, 'WebhookSecret', {
+        description: 'Secret used by github to sign the webhook deliveries',
+        generateSecretString: {
+          passwordLength: 32,
+          excludePunctuation: true,
+        },
+      })
+
+    // Every pipeline trigger-fn can start, once even when it is routed several
+    // times, so that statusFn reports each state change once
+    const pipelines: IPipeline[] = (
+      props.routes
+        ? props.routes.map((route) => route.codepipeline)
+        : [
+            props.codepipeline,
+            props.previewPipeline,
+            props.teardownPipeline,
+            ...Object.values(props.deployPipelines ?? {}),
+          ]
+    )
+      .filter((p): p is IPipeline => p !== undefined)
+      .filter(
+        (p, i, all) =>
+          all.findIndex((other) => other.pipelineArn === p.pipelineArn) === i,
+      )
+
+    // Github redelivers webhooks on timeouts, the delivery ids are recorded
+    // here so that a redelivery does not start the pipelines again
+    const deliveriesTable = new Table(this, 'DeliveriesTable', {
+      partitionKey: { name: 'delivery_id', type: AttributeType.STRING },
+      billingMode: BillingMode.PAY_PER_REQUEST,
+      timeToLiveAttribute: 'expires_at',
+      removalPolicy: RemovalPolicy.DESTROY,
+    })
+
+    // trigger-fn records the commit of every execution it starts,
+    // statusFn reports the progress of those executions to github
+    const executionsTable = new Table(this, 'ExecutionsTable', {
+      partitionKey: {
+        name: 'pipeline_execution_id',
+        type: AttributeType.STRING,
+      },
+      billingMode: BillingMode.PAY_PER_REQUEST,
+      timeToLiveAttribute: 'expires_at',
+      removalPolicy: RemovalPolicy.DESTROY,
+    })
+
+    const archiveBucket = props.archiveDeliveries
+      ? new Bucket(this, 'DeliveriesArchive', {
+          encryption: BucketEncryption.S3_MANAGED,
+          blockPublicAccess: BlockPublicAccess.BLOCK_ALL,
+          enforceSSL: true,
+          lifecycleRules: [{ expiration: Duration.days(90) }],
+          removalPolicy: RemovalPolicy.RETAIN,
+        })
+      : undefined
+
+    const dependencyManifest = props.dependencyManifest
+      ? new Asset(this, 'DependencyManifest', {
+          path: props.dependencyManifest,
+        })
+      : undefined
+
+    this.dispatchSecret = props.manualDispatch
+      ? new Secret(this, 'DispatchSecret', {
+          description: 'Secret used to sign the manual pipeline dispatches',
+          generateSecretString: {
+            passwordLength: 32,
+            excludePunctuation: true,
+          },
+        })
+      : undefined
+
+    // A delivery claimed by an invocation that timed out is processed again
+    // by the next delivery once the lease, twice the timeout, is over
+    const triggerTimeout = Duration.seconds(60)
+
+    const triggerEnvironment: { [key: string]: string } = {
+      CODEPIPELINE_NAME: props.codepipeline.pipelineName,
+      GITHUB_BRANCH: props.branch,
+      FILTERS: props.filters.join(','),
+      WEBHOOK_SECRET_ARN: webhookSecret.secretArn,
+      DEDUP_TABLE_NAME: deliveriesTable.tableName,
+      DEDUP_LEASE: `${triggerTimeout.toSeconds() * 2}s`,
+      EXECUTIONS_TABLE_NAME: executionsTable.tableName,
+      GITHUB_TOKEN_ARN: props.githubTokenArn,
+      GITHUB_REPOSITORY: `${props.owner}/${props.repo}`,
+      ...(props.webhookScope === 'org' && {
+        REPOSITORY: `${props.owner}/${props.repo}`,
+      }),
+      PIPELINE_VARIABLES: String(props.pipelineVariables ?? false),
+      CONCURRENCY_POLICY: props.concurrencyPolicy ?? 'queue',
+      SOURCE_IP_GUARD: String(props.restrictSourceIps ?? false),
+      IGNORE_BOTS: String(props.authors?.ignoreBots ?? false),
+      REQUIRE_VERIFIED_COMMITS: String(props.requireVerifiedCommits ?? false),
+      ALLOW_FORK_PULL_REQUESTS: String(props.allowForkPullRequests ?? false),
+      ...(props.authors?.allow && {
+        ALLOWED_AUTHORS: props.authors.allow.join(','),
+      }),
+      ...(props.authors?.deny && {
+        DENIED_AUTHORS: props.authors.deny.join(','),
+      }),
+      ...(dependencyManifest && {
+        DEPENDENCY_MANIFEST_S3_URI: dependencyManifest.s3ObjectUrl,
+      }),
+      ...(this.dispatchSecret && {
+        DISPATCH_SECRET_ARN: this.dispatchSecret.secretArn,
+      }),
+      ...(props.repoRoutesFile && {
+        REPO_ROUTES_FILE: props.repoRoutesFile,
+      }),
+      ...(props.lambdas && {
+        LAMBDAS: props.lambdas.join(','),
+      }),
+      ...(archiveBucket && {
+        ARCHIVE_BUCKET: archiveBucket.bucketName,
+      }),
+      ...(props.sourceCidrs && {
+        SOURCE_CIDRS: props.sourceCidrs.join(','),
+      }),
+      ...(props.sourceActionName && {
+        SOURCE_ACTION_NAME: props.sourceActionName,
+      }),
+      ...(props.previewPipeline && {
+        PREVIEW_PIPELINE_NAME: props.previewPipeline.pipelineName,
+      }),
+      ...(props.teardownPipeline && {
+        TEARDOWN_PIPELINE_NAME: props.teardownPipeline.pipelineName,
+      }),
+      ...(props.deployPipelines && {
+        DEPLOY_PIPELINES: Object.entries(props.deployPipelines)
+          .map(([env, p]) => `${env}=${p.pipelineName}`)
+          .join(','),
+      }),
+      ...(props.deployPermission && {
+        DEPLOY_PERMISSION: props.deployPermission,
+      }),
+      ...(props.routes && {
+        ROUTES: JSON.stringify({
+          rules: props.routes.map((route) => ({
+            name: route.name,
+            event: route.event,
+            actions: route.actions,
+            environment: route.environment,
+            repository: route.repository,
+            branch: route.branch,
+            filters: route.filters ?? [],
+            lambdas: route.lambdas ?? [],
+            pipeline: route.codepipeline.pipelineName,
+            variables: route.variables ?? false,
+            source_action: route.sourceAction,
+            concurrency: route.concurrency,
+            authors: route.authors && {
+              allow: route.authors.allow,
+              deny: route.authors.deny,
+              ignore_bots: route.authors.ignoreBots ?? false,
+            },
+            require_verified: route.requireVerifiedCommits ?? false,
+          })),
+        }),
+      }),
+    }
+
     const triggerFn = new Function(this, 'TriggerFn', {
       runtime: Runtime.PROVIDED_AL2,
       architecture: Architecture.ARM_64,
@@ -43,24 +367,139 @@ export class GithubSource extends Construct {
       ),
       handler: 'bootstrap',
       memorySize: 128,
-      timeout: Duration.seconds(60),
+      timeout: triggerTimeout,
       description:
         'This lambda runs when there is a new event in the repo and starts codepipeline for matching events',
       functionName: PhysicalName.GENERATE_IF_NEEDED,
+      environment: triggerEnvironment,
+      logRetention: RetentionDays.ONE_DAY,
+    })
+
+    archiveBucket?.grantPut(triggerFn)
+
+    if (this.dispatchSecret) {
+      this.dispatchSecret.grantRead(triggerFn)
+      // A second url on an alias, the webhook url can not require IAM
+      this.dispatchUrl = triggerFn
+        .addAlias('dispatch')
+        .addFunctionUrl({ authType: FunctionUrlAuthType.AWS_IAM })
+    }
+
+    // The consumer runs the same binary on the deliveries queued by triggerFn
+    const workers = [triggerFn]
+    if (props.asyncProcessing) {
+      const deadLetterQueue = new Queue(this, 'DeliveriesDeadLetterQueue', {
+        retentionPeriod: Duration.days(14),
+      })
+      const queue = new Queue(this, 'DeliveriesQueue', {
+        // Six times the timeout of the consumer, as recommended for lambda
+        visibilityTimeout: Duration.minutes(6),
+        deadLetterQueue: { queue: deadLetterQueue, maxReceiveCount: 5 },
+      })
+
+      const consumerFn = new Function(this, 'TriggerConsumerFn', {
+        runtime: Runtime.PROVIDED_AL2,
+        architecture: Architecture.ARM_64,
+        code: Code.fromAsset(
+          path.join(__dirname, '..', '..', 'dist', 'trigger-fn.zip'),
+        ),
+        handler: 'bootstrap',
+        memorySize: 128,
+        timeout: triggerTimeout,
+        description:
+          'This lambda starts codepipeline for the deliveries queued by the trigger lambda',
+        functionName: PhysicalName.GENERATE_IF_NEEDED,
+        environment: {
+          ...triggerEnvironment,
+          TRIGGER_MODE: 'consumer',
+        },
+        logRetention: RetentionDays.ONE_DAY,
+      })
+      consumerFn.addEventSource(
+        new SqsEventSource(queue, {
+          batchSize: 10,
+          reportBatchItemFailures: true,
+        }),
+      )
+
+      triggerFn.addEnvironment('QUEUE_URL', queue.queueUrl)
+      queue.grantSendMessages(triggerFn)
+      workers.push(consumerFn)
+    }
+
+    workers.forEach((fn) => {
+      webhookSecret.grantRead(fn)
+      fn.addToRolePolicy(
+        new PolicyStatement({
+          effect: Effect.ALLOW,
+          actions: ['secretsmanager:GetSecretValue'],
+          // Allow both the complete and the partial arn of the secret
+          resources: [`${props.githubTokenArn}*`],
+          sid: 'AllowTriggerFnToReadGithubToken',
+        }),
+      )
+      deliveriesTable.grantReadWriteData(fn)
+      dependencyManifest?.grantRead(fn)
+      executionsTable.grantWriteData(fn)
+
+      fn.addToRolePolicy(
+        new PolicyStatement({
+          effect: Effect.ALLOW,
+          actions: [
+            'codepipeline:StartPipelineExecution',
+            // Needed by the supersede and coalesce concurrency policies
+            'codepipeline:ListPipelineExecutions',
+            'codepipeline:StopPipelineExecution',
+          ],
+          resources: pipelines.map((p) => p.pipelineArn),
+          sid: 'AllowTriggerFnToStartCodepipeline',
+        }),
+      )
+    })
+
+    const statusFn = new Function(this, 'StatusFn', {
+      runtime: Runtime.PROVIDED_AL2,
+      architecture: Architecture.ARM_64,
+      code: Code.fromAsset(
+        path.join(__dirname, '..', '..', 'dist', 'status-fn.zip'),
+      ),
+      handler: 'bootstrap',
+      memorySize: 128,
+      timeout: Duration.seconds(30),
+      description:
+        'This lambda reports the executions started by the trigger lambda as github commit statuses',
+      functionName: PhysicalName.GENERATE_IF_NEEDED,
       environment: {
-        CODEPIPELINE_NAME: props.codepipeline.pipelineName,
-        GITHUB_BRANCH: props.branch,
-        FILTERS: props.filters.join(','),
+        EXECUTIONS_TABLE_NAME: executionsTable.tableName,
+        GITHUB_TOKEN_ARN: props.githubTokenArn,
+        // Only the executions started by these roles wait for their record
+        TRIGGER_ROLE_NAMES: workers
+          .map((fn) => fn.role?.roleName)
+          .filter((name): name is string => name !== undefined)
+          .join(','),
       },
       logRetention: RetentionDays.ONE_DAY,
     })
-
-    triggerFn.addToRolePolicy(
+    executionsTable.grantReadData(statusFn)
+    statusFn.addToRolePolicy(
       new PolicyStatement({
         effect: Effect.ALLOW,
-        actions: ['codepipeline:StartPipelineExecution'],
-        resources: [props.codepipeline.pipelineArn],
-        sid: 'AllowTriggerFnToStartCodepipeline',
+        actions: ['secretsmanager:GetSecretValue'],
+        resources: [`${props.githubTokenArn}*`],
+        sid: 'AllowStatusFnToReadGithubToken',
+      }),
+    )
+    statusFn.addToRolePolicy(
+      new PolicyStatement({
+        effect: Effect.ALLOW,
+        actions: ['codepipeline:GetPipelineExecution'],
+        resources: pipelines.map((p) => p.pipelineArn),
+        sid: 'AllowStatusFnToGetExecutions',
+      }),
+    )
+    pipelines.forEach((p, i) =>
+      p.onStateChange(`PipelineStateChange${i}`, {
+        target: new LambdaFunction(statusFn),
       }),
     )
 
@@ -106,15 +545,34 @@ export class GithubSource extends Construct {
     const cr = new CustomResource(this, 'WebhookManager', {
       serviceToken: provider.serviceToken,
       properties: {
-        GithubTokenArn: props.githubTokenArn,
+        ...(props.githubApp
+          ? {
+              GithubAppId: props.githubApp.appId,
+              GithubAppPrivateKeyArn: props.githubApp.privateKeyArn,
+              GithubAppInstallationId: props.githubApp.installationId,
+            }
+          : { GithubTokenArn: props.githubTokenArn }),
         GithubOwner: props.owner,
         GithubRepo: props.repo,
         GithubBranch: props.branch,
         WebhookURL: triggerFnUrl.url,
+        SecretArn: webhookSecret.secretArn,
+        Events: props.webhookEvents,
+        Active: props.webhookActive,
+        InsecureSsl: props.webhookInsecureSsl,
+        Scope: props.webhookScope,
       },
       removalPolicy: RemovalPolicy.DESTROY,
     })
     cr.node.addDependency(triggerFn)
     cr.node.addDependency(triggerFnUrl)
   }
+
+  // Allow the grantee to send manual dispatches to dispatchUrl
+  grantDispatch(grantee: IGrantable) {
+    if (!this.dispatchUrl) {
+      throw new Error('manualDispatch is not enabled')
+    }
+    return this.dispatchUrl.grantInvokeUrl(grantee)
+  }
 }
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/sethvargo/go-envconfig"
+	log "github.com/sirupsen/logrus"
+)
+
+type Config struct {
+	// Table where trigger-fn records the commit of every execution it starts
+	ExecutionsTableName string `env:"EXECUTIONS_TABLE_NAME,required"`
+
+	GithubTokenArn string `env:"GITHUB_TOKEN_ARN,required"`
+	GithubToken    string
+	// Base url of the github api, for github enterprise
+	GithubAPIURL string `env:"GITHUB_API_URL"`
+
+	// Prefix of the status context, the pipeline name is appended to it
+	StatusContext string `env:"STATUS_CONTEXT,default=codepipeline"`
+
+	// Roles of the trigger-fn functions, comma separated. Only the executions they started
+	// are retried while their record is missing
+	TriggerRoleNames_ string `env:"TRIGGER_ROLE_NAMES"`
+	TriggerRoleNames  []string
+}
+
+func readConfigFromEnv() Config {
+	var config Config
+	ctx := context.Background()
+
+	err := envconfig.Process(ctx, &config)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	for _, name := range strings.Split(config.TriggerRoleNames_, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			config.TriggerRoleNames = append(config.TriggerRoleNames, name)
+		}
+	}
+
+	token, err := readSecret(config.GithubTokenArn)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	config.GithubToken = *token
+
+	return config
+}
+
+func readSecret(secretArn string) (*string, error) {
+	sess := session.Must(session.NewSession())
+	secretssvc := secretsmanager.New(sess)
+
+	resp, err := secretssvc.GetSecretValue(&secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(secretArn),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error in reading secret %s: %v", secretArn, err.Error())
+	}
+
+	return resp.SecretString, nil
+}
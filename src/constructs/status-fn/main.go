@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/codepipeline"
+	"github.com/aws/aws-sdk-go/service/codepipeline/codepipelineiface"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/google/go-github/github"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+)
+
+// PipelineExecutionDetail is the detail of a `CodePipeline Pipeline Execution State Change` event
+// https://docs.aws.amazon.com/codepipeline/latest/userguide/detect-state-changes-cloudwatch-events.html
+type PipelineExecutionDetail struct {
+	Pipeline    string `json:"pipeline"`
+	ExecutionID string `json:"execution-id"`
+	State       string `json:"state"`
+	Version     int    `json:"version"`
+}
+
+// ExecutionRecord is written by trigger-fn when it starts an execution
+type ExecutionRecord struct {
+	ExecutionID string `dynamodbav:"pipeline_execution_id"`
+	Pipeline    string `dynamodbav:"pipeline_name"`
+	Provider    string `dynamodbav:"provider"`
+	Repository  string `dynamodbav:"repository"`
+	SHA         string `dynamodbav:"sha"`
+	Ref         string `dynamodbav:"ref"`
+	Rule        string `dynamodbav:"rule"`
+}
+
+// ExecutionLookup finds the commit an execution was started for
+type ExecutionLookup interface {
+	// Get returns nil when the execution was not started by trigger-fn
+	Get(ctx context.Context, executionID string) (*ExecutionRecord, error)
+}
+
+type DynamoExecutionLookup struct {
+	Client    dynamodbiface.DynamoDBAPI
+	TableName string
+}
+
+func (l *DynamoExecutionLookup) Get(ctx context.Context, executionID string) (*ExecutionRecord, error) {
+	resp, err := l.Client.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(l.TableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"pipeline_execution_id": {S: aws.String(executionID)},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error in reading execution %s: %v", executionID, err.Error())
+	}
+	if resp.Item == nil {
+		return nil, nil
+	}
+
+	record := &ExecutionRecord{}
+	err = dynamodbattribute.UnmarshalMap(resp.Item, record)
+	if err != nil {
+		return nil, err
+	}
+
+	return record, nil
+}
+
+// Services are the clients used by the handler
+type Services struct {
+	Codepipeline codepipelineiface.CodePipelineAPI
+	Executions   ExecutionLookup
+	Github       *github.Client
+}
+
+func main() {
+	config := readConfigFromEnv()
+	sess := session.Must(session.NewSession())
+
+	ghClient, err := newGithubClient(context.Background(), config)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	svc := Services{
+		Codepipeline: codepipeline.New(sess),
+		Executions: &DynamoExecutionLookup{
+			Client:    dynamodb.New(sess),
+			TableName: config.ExecutionsTableName,
+		},
+		Github: ghClient,
+	}
+
+	lambda.Start(func(ctx context.Context, evt events.CloudWatchEvent) error {
+		return handler(ctx, config, svc, evt)
+	})
+}
+
+// RecordWindow is how long after a state change a missing execution record may still be written.
+// trigger-fn records the execution after starting it, so the first events can arrive before it.
+// Only the executions started by the roles of trigger-fn are retried, see startedByTrigger.
+const RecordWindow = 10 * time.Minute
+
+// handler posts a commit status for every state change of the executions started by trigger-fn
+func handler(ctx context.Context, config Config, svc Services, evt events.CloudWatchEvent) error {
+	detail := PipelineExecutionDetail{}
+	err := json.Unmarshal(evt.Detail, &detail)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"detail": string(evt.Detail),
+		}).Errorf("error in unmarshalling event detail: %v", err.Error())
+
+		// Retrying won't help
+		return nil
+	}
+
+	fields := log.Fields{
+		"codepipeline_name":     detail.Pipeline,
+		"pipeline_execution_id": detail.ExecutionID,
+		"state":                 detail.State,
+	}
+
+	state, description, ok := commitState(detail.State)
+	if !ok {
+		log.WithFields(fields).Infoln("ignoring state change")
+		return nil
+	}
+
+	record, err := svc.Executions.Get(ctx, detail.ExecutionID)
+	if err != nil {
+		log.WithFields(fields).Errorf("error in looking up execution: %v", err.Error())
+		return err
+	}
+	if record == nil && time.Since(evt.Time) < RecordWindow {
+		started, err := startedByTrigger(ctx, config, svc, detail.Pipeline, detail.ExecutionID)
+		if err != nil {
+			log.WithFields(fields).Errorf("error in looking up execution trigger: %v", err.Error())
+			return err
+		}
+		if started {
+			// Lambda retries the event, by then trigger-fn has recorded the execution
+			log.WithFields(fields).Warnln("execution is not recorded yet, retrying")
+			return fmt.Errorf("execution %s is not recorded yet", detail.ExecutionID)
+		}
+	}
+	if record == nil {
+		log.WithFields(fields).Infoln("ignoring execution, it was not started by trigger-fn")
+		return nil
+	}
+
+	fields["repository"] = record.Repository
+	fields["sha"] = record.SHA
+
+	// Older records do not have a provider, they are all from github
+	if record.Provider != "" && record.Provider != "github" {
+		log.WithFields(fields).WithField("provider", record.Provider).Infoln("ignoring execution, the repository is not on github")
+		return nil
+	}
+
+	owner, repo, found := strings.Cut(record.Repository, "/")
+	if !found || record.SHA == "" {
+		log.WithFields(fields).Warnln("execution record does not have a repository or commit")
+		return nil
+	}
+
+	_, _, err = svc.Github.Repositories.CreateStatus(ctx, owner, repo, record.SHA, &github.RepoStatus{
+		State:       aws.String(state),
+		TargetURL:   aws.String(executionURL(evt.Region, detail.Pipeline, detail.ExecutionID)),
+		Description: aws.String(description),
+		Context:     aws.String(fmt.Sprintf("%s/%s", config.StatusContext, detail.Pipeline)),
+	})
+	if err != nil {
+		log.WithFields(fields).Errorf("error in creating commit status: %v", err.Error())
+		return err
+	}
+
+	log.WithFields(fields).WithField("status", state).Infoln("created commit status")
+
+	return nil
+}
+
+// startedByTrigger reports whether one of the roles of trigger-fn started the execution, e.g. not
+// the console, a retry or a source action. Its trigger detail is the arn of the assumed role.
+// https://docs.aws.amazon.com/codepipeline/latest/APIReference/API_ExecutionTrigger.html
+func startedByTrigger(ctx context.Context, config Config, svc Services, pipeline, executionID string) (bool, error) {
+	if len(config.TriggerRoleNames) == 0 {
+		return false, nil
+	}
+
+	resp, err := svc.Codepipeline.GetPipelineExecutionWithContext(ctx, &codepipeline.GetPipelineExecutionInput{
+		PipelineName:        aws.String(pipeline),
+		PipelineExecutionId: aws.String(executionID),
+	})
+	if err != nil {
+		return false, fmt.Errorf("error in getting execution %s: %v", executionID, err.Error())
+	}
+
+	if resp.PipelineExecution == nil {
+		return false, nil
+	}
+	trigger := resp.PipelineExecution.Trigger
+	if trigger == nil || aws.StringValue(trigger.TriggerType) != codepipeline.TriggerTypeStartPipelineExecution {
+		return false, nil
+	}
+	for _, name := range config.TriggerRoleNames {
+		if strings.Contains(aws.StringValue(trigger.TriggerDetail), ":assumed-role/"+name+"/") {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// commitState maps the state of the execution to a github commit status
+// https://docs.github.com/en/rest/commits/statuses#create-a-commit-status
+func commitState(state string) (string, string, bool) {
+	switch state {
+	case "STARTED", "RESUMED":
+		return "pending", "Pipeline is running", true
+	case "SUCCEEDED":
+		return "success", "Pipeline succeeded", true
+	case "FAILED":
+		return "failure", "Pipeline failed", true
+	case "STOPPED", "CANCELED", "SUPERSEDED":
+		return "error", fmt.Sprintf("Pipeline was %s", strings.ToLower(state)), true
+	}
+
+	// STOPPING is followed by STOPPED
+	return "", "", false
+}
+
+func executionURL(region, pipeline, executionID string) string {
+	return fmt.Sprintf("https://%s.console.aws.amazon.com/codesuite/codepipeline/pipelines/%s/executions/%s/timeline?region=%s",
+		region, url.PathEscape(pipeline), url.PathEscape(executionID), region)
+}
+
+type Token struct {
+	PersonalAccessToken string
+}
+
+func (t *Token) Token() (*oauth2.Token, error) {
+	token := &oauth2.Token{
+		AccessToken: t.PersonalAccessToken,
+	}
+	return token, nil
+}
+
+func newGithubClient(ctx context.Context, config Config) (*github.Client, error) {
+	client := github.NewClient(oauth2.NewClient(ctx, &Token{
+		PersonalAccessToken: config.GithubToken,
+	}))
+
+	if config.GithubAPIURL != "" {
+		baseURL, err := url.Parse(strings.TrimSuffix(config.GithubAPIURL, "/") + "/")
+		if err != nil {
+			return nil, fmt.Errorf("invalid github api url %s: %v", config.GithubAPIURL, err.Error())
+		}
+		client.BaseURL = baseURL
+	}
+
+	return client, nil
+}
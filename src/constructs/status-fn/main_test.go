@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/codepipeline"
+	"github.com/aws/aws-sdk-go/service/codepipeline/codepipelineiface"
+	"github.com/google/go-github/github"
+)
+
+type memoryExecutionLookup map[string]ExecutionRecord
+
+func (m memoryExecutionLookup) Get(ctx context.Context, executionID string) (*ExecutionRecord, error) {
+	record, ok := m[executionID]
+	if !ok {
+		return nil, nil
+	}
+	return &record, nil
+}
+
+// fakeCodepipeline returns the trigger of the executions
+type fakeCodepipeline struct {
+	codepipelineiface.CodePipelineAPI
+
+	triggers map[string]*codepipeline.ExecutionTrigger
+}
+
+func (f *fakeCodepipeline) GetPipelineExecutionWithContext(ctx aws.Context, input *codepipeline.GetPipelineExecutionInput, opts ...request.Option) (*codepipeline.GetPipelineExecutionOutput, error) {
+	return &codepipeline.GetPipelineExecutionOutput{
+		PipelineExecution: &codepipeline.PipelineExecution{
+			PipelineExecutionId: input.PipelineExecutionId,
+			Trigger:             f.triggers[*input.PipelineExecutionId],
+		},
+	}, nil
+}
+
+// fakeGithub records the commit statuses posted to it
+type fakeGithub struct {
+	paths    []string
+	statuses []github.RepoStatus
+}
+
+func newFakeGithub(t *testing.T) (*fakeGithub, *github.Client) {
+	t.Helper()
+
+	fake := &fakeGithub{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := github.RepoStatus{}
+		if err := json.NewDecoder(r.Body).Decode(&status); err != nil {
+			t.Errorf("error in decoding status: %v", err)
+		}
+		fake.paths = append(fake.paths, r.URL.Path)
+		fake.statuses = append(fake.statuses, status)
+
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{}`))
+	}))
+	t.Cleanup(server.Close)
+
+	client, err := newGithubClient(context.Background(), Config{GithubToken: "token", GithubAPIURL: server.URL})
+	if err != nil {
+		t.Fatalf("error in creating github client: %v", err)
+	}
+
+	return fake, client
+}
+
+func stateChange(executionID, state string) events.CloudWatchEvent {
+	detail, _ := json.Marshal(PipelineExecutionDetail{
+		Pipeline:    "website-prod",
+		ExecutionID: executionID,
+		State:       state,
+	})
+	return events.CloudWatchEvent{
+		DetailType: "CodePipeline Pipeline Execution State Change",
+		Source:     "aws.codepipeline",
+		Region:     "eu-west-1",
+		Detail:     detail,
+	}
+}
+
+func TestHandler(t *testing.T) {
+	config := Config{StatusContext: "codepipeline", TriggerRoleNames: []string{"TriggerFnRole"}}
+	fake, client := newFakeGithub(t)
+	svc := Services{
+		Codepipeline: &fakeCodepipeline{triggers: map[string]*codepipeline.ExecutionTrigger{
+			"e2": {
+				TriggerType:   aws.String(codepipeline.TriggerTypeStartPipelineExecution),
+				TriggerDetail: aws.String("arn:aws:sts::123456789012:assumed-role/TriggerFnRole/trigger-fn"),
+			},
+			"e4": {
+				TriggerType:   aws.String(codepipeline.TriggerTypeStartPipelineExecution),
+				TriggerDetail: aws.String("arn:aws:sts::123456789012:assumed-role/Admin/nkhine"),
+			},
+		}},
+		Executions: memoryExecutionLookup{
+			"e1": {ExecutionID: "e1", Pipeline: "website-prod", Repository: "nkhine/khine.net", SHA: "b2c3"},
+		},
+		Github: client,
+	}
+
+	for _, state := range []string{"STARTED", "STOPPING", "SUCCEEDED"} {
+		if err := handler(context.Background(), config, svc, stateChange("e1", state)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	// Not started by trigger-fn
+	if err := handler(context.Background(), config, svc, stateChange("e2", "STARTED")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// Not recorded yet, retried
+	evt := stateChange("e2", "STARTED")
+	evt.Time = time.Now()
+	if err := handler(context.Background(), config, svc, evt); err == nil {
+		t.Fatalf("expected a recent execution without record to be retried")
+	}
+	// Started from the console or by a source action, not retried
+	for _, id := range []string{"e4", "e5"} {
+		evt = stateChange(id, "STARTED")
+		evt.Time = time.Now()
+		if err := handler(context.Background(), config, svc, evt); err != nil {
+			t.Fatalf("%s: expected an execution not started by trigger-fn to be ignored, got %v", id, err)
+		}
+	}
+	// Started for a gitlab mirror
+	if err := handler(context.Background(), config, svc, stateChange("e3", "STARTED")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(fake.statuses) != 2 {
+		t.Fatalf("expected 2 statuses, got %d", len(fake.statuses))
+	}
+	if fake.paths[0] != "/repos/nkhine/khine.net/statuses/b2c3" {
+		t.Errorf("unexpected path %s", fake.paths[0])
+	}
+	if fake.statuses[0].GetState() != "pending" || fake.statuses[1].GetState() != "success" {
+		t.Errorf("expected pending then success, got %s then %s", fake.statuses[0].GetState(), fake.statuses[1].GetState())
+	}
+	if fake.statuses[1].GetContext() != "codepipeline/website-prod" {
+		t.Errorf("unexpected context %s", fake.statuses[1].GetContext())
+	}
+	if !strings.Contains(fake.statuses[1].GetTargetURL(), "/pipelines/website-prod/executions/e1/") {
+		t.Errorf("unexpected target url %s", fake.statuses[1].GetTargetURL())
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	log "github.com/sirupsen/logrus"
+)
+
+// Redacted replaces the value of the headers carrying secrets
+const Redacted = "[redacted]"
+
+// secretHeaders are redacted before a delivery is archived.
+// The signatures are useless without the secret, the replay tool signs the body again.
+var secretHeaders = map[string]bool{
+	SignatureHeader:          true,
+	BitbucketSignatureHeader: true,
+	GiteaSignatureHeader:     true,
+	GitlabTokenHeader:        true,
+	"authorization":          true,
+	"cookie":                 true,
+	"x-amz-security-token":   true,
+}
+
+// ArchivedDelivery is a delivery as received by trigger-fn, kept to replay it
+type ArchivedDelivery struct {
+	DeliveryID string            `json:"delivery_id"`
+	Provider   string            `json:"provider"`
+	ReceivedAt time.Time         `json:"received_at"`
+	SourceIP   string            `json:"source_ip"`
+	Headers    map[string]string `json:"headers"`
+	Body       string            `json:"body"`
+}
+
+// DeliveryArchive keeps every authenticated delivery
+type DeliveryArchive interface {
+	Archive(ctx context.Context, delivery ArchivedDelivery) error
+}
+
+// S3DeliveryArchive writes the deliveries to `<prefix>YYYY/MM/DD/<delivery id>.json`
+type S3DeliveryArchive struct {
+	Client s3iface.S3API
+	Bucket string
+	Prefix string
+}
+
+func (a *S3DeliveryArchive) Archive(ctx context.Context, delivery ArchivedDelivery) error {
+	b, err := json.Marshal(delivery)
+	if err != nil {
+		return err
+	}
+
+	key := archiveKey(a.Prefix, delivery)
+	_, err = a.Client.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(a.Bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(b),
+		ContentType: aws.String("application/json"),
+	})
+	if err != nil {
+		return fmt.Errorf("error in archiving delivery to s3://%s/%s: %v", a.Bucket, key, err.Error())
+	}
+
+	return nil
+}
+
+func archiveKey(prefix string, delivery ArchivedDelivery) string {
+	return fmt.Sprintf("%s%s/%s.json", prefix, delivery.ReceivedAt.UTC().Format("2006/01/02"), url.PathEscape(delivery.DeliveryID))
+}
+
+// archiveDelivery archives an authenticated delivery with its secrets redacted.
+// A failure is only logged, the delivery is still processed.
+func archiveDelivery(ctx context.Context, svc Services, provider Provider, evt events.LambdaFunctionURLRequest, payload []byte) {
+	deliveryID := provider.DeliveryID(evt.Headers)
+	if deliveryID == "" {
+		deliveryID = evt.RequestContext.RequestID
+	}
+
+	headers := map[string]string{}
+	for k, v := range evt.Headers {
+		if secretHeaders[strings.ToLower(k)] {
+			v = Redacted
+		}
+		headers[k] = v
+	}
+
+	err := svc.Archive.Archive(ctx, ArchivedDelivery{
+		DeliveryID: deliveryID,
+		Provider:   provider.Name(),
+		ReceivedAt: time.Now(),
+		SourceIP:   evt.RequestContext.HTTP.SourceIP,
+		Headers:    headers,
+		Body:       string(payload),
+	})
+	if err != nil {
+		log.WithFields(log.Fields{
+			"provider":    provider.Name(),
+			"delivery_id": deliveryID,
+		}).Errorf("error in archiving delivery: %v", err.Error())
+	}
+}
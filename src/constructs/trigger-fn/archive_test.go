@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+type memoryArchive struct {
+	deliveries []ArchivedDelivery
+}
+
+func (a *memoryArchive) Archive(ctx context.Context, delivery ArchivedDelivery) error {
+	a.deliveries = append(a.deliveries, delivery)
+	return nil
+}
+
+func TestHandlerArchivesDeliveries(t *testing.T) {
+	config := testConfig(t, testRoutes)
+	svc, _ := testServices()
+	archive := &memoryArchive{}
+	svc.Archive = archive
+
+	push := GithubEvent{
+		Ref:     "refs/heads/main",
+		Commits: []Commit{{Modified: []string{"src/config.ts"}}},
+	}
+	evt := newDelivery(t, "push", "72d3162e", push)
+	evt.RequestContext.HTTP.SourceIP = "140.82.115.10"
+	handler(context.Background(), config, svc, evt)
+
+	// Forged deliveries are not archived
+	forged := newDelivery(t, "push", "9a1b2c3d", push)
+	forged.Headers[SignatureHeader] = sign([]byte("forged"), []byte(forged.Body))
+	handler(context.Background(), config, svc, forged)
+
+	if len(archive.deliveries) != 1 {
+		t.Fatalf("expected 1 archived delivery, got %d", len(archive.deliveries))
+	}
+	got := archive.deliveries[0]
+	if got.DeliveryID != "72d3162e" || got.Provider != ProviderGithub || got.SourceIP != "140.82.115.10" {
+		t.Errorf("unexpected delivery %+v", got)
+	}
+	if got.Body != evt.Body {
+		t.Errorf("expected the raw body, got %s", got.Body)
+	}
+	if got.Headers[SignatureHeader] != Redacted || got.Headers[EventHeader] != "push" {
+		t.Errorf("expected only the signature to be redacted, got %v", got.Headers)
+	}
+}
+
+func TestArchiveKey(t *testing.T) {
+	delivery := ArchivedDelivery{
+		DeliveryID: "72d3162e-cc78-11e3-81ab-4c9367dc0958",
+		ReceivedAt: time.Date(2024, 3, 9, 23, 30, 0, 0, time.FixedZone("", -2*60*60)),
+	}
+
+	want := "deliveries/2024/03/10/72d3162e-cc78-11e3-81ab-4c9367dc0958.json"
+	if got := archiveKey("deliveries/", delivery); got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+}
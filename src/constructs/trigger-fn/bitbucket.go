@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	BitbucketEventHeader     = "x-event-key"
+	BitbucketSignatureHeader = "x-hub-signature"
+	BitbucketDeliveryHeader  = "x-request-uuid"
+)
+
+// BitbucketPushEvent is the payload of a bitbucket cloud `repo:push` event
+// https://support.atlassian.com/bitbucket-cloud/docs/event-payloads/#Push
+type BitbucketPushEvent struct {
+	Actor struct {
+		DisplayName string `json:"display_name"`
+		Nickname    string `json:"nickname"`
+	} `json:"actor"`
+	Repository struct {
+		FullName string `json:"full_name"`
+	} `json:"repository"`
+	Push struct {
+		Changes []struct {
+			New       *bitbucketRef     `json:"new"`
+			Old       *bitbucketRef     `json:"old"`
+			Created   bool              `json:"created"`
+			Closed    bool              `json:"closed"`
+			Forced    bool              `json:"forced"`
+			Truncated bool              `json:"truncated"`
+			Commits   []bitbucketCommit `json:"commits"`
+		} `json:"changes"`
+	} `json:"push"`
+}
+
+type bitbucketRef struct {
+	// Type is `branch` or `tag`
+	Type   string          `json:"type"`
+	Name   string          `json:"name"`
+	Target bitbucketCommit `json:"target"`
+}
+
+type bitbucketCommit struct {
+	Hash    string `json:"hash"`
+	Message string `json:"message"`
+	Author  struct {
+		Raw  string `json:"raw"`
+		User struct {
+			Nickname string `json:"nickname"`
+		} `json:"user"`
+	} `json:"author"`
+}
+
+func (c bitbucketCommit) toCommit() Commit {
+	commit := Commit{ID: c.Hash, Message: c.Message}
+	commit.Author.Name = c.Author.Raw
+	commit.Author.Username = c.Author.User.Nickname
+	return commit
+}
+
+func (r *bitbucketRef) ref() string {
+	if r.Type == "tag" {
+		return "refs/tags/" + r.Name
+	}
+	return "refs/heads/" + r.Name
+}
+
+// BitbucketProvider handles the deliveries of bitbucket cloud, signed like the github ones.
+// Bitbucket does not list the files changed by a push, they are read from its diffstat api.
+type BitbucketProvider struct{}
+
+func (BitbucketProvider) Name() string {
+	return ProviderBitbucket
+}
+
+func (BitbucketProvider) Detect(headers map[string]string) bool {
+	return headers[BitbucketEventHeader] != ""
+}
+
+func (BitbucketProvider) Verify(secret []byte, headers map[string]string, body []byte) error {
+	return validateSignature(secret, headers[BitbucketSignatureHeader], body)
+}
+
+func (BitbucketProvider) Event(headers map[string]string) string {
+	v := headers[BitbucketEventHeader]
+	if v == "repo:push" {
+		return "push"
+	}
+	return v
+}
+
+func (BitbucketProvider) DeliveryID(headers map[string]string) string {
+	return headers[BitbucketDeliveryHeader]
+}
+
+// ParsePush normalises the first change of the push. Bitbucket groups the refs
+// pushed together in one event, a push rarely updates more than one branch.
+func (BitbucketProvider) ParsePush(body []byte) (*PushEvent, error) {
+	bbEvt := BitbucketPushEvent{}
+	err := json.Unmarshal(body, &bbEvt)
+	if err != nil {
+		return nil, err
+	}
+	if len(bbEvt.Push.Changes) == 0 {
+		return nil, fmt.Errorf("push does not have any changes")
+	}
+	change := bbEvt.Push.Changes[0]
+
+	pusher := bbEvt.Actor.Nickname
+	if pusher == "" {
+		pusher = bbEvt.Actor.DisplayName
+	}
+
+	push := &PushEvent{
+		Provider:   ProviderBitbucket,
+		Before:     ZeroSHA,
+		After:      ZeroSHA,
+		Created:    change.Created,
+		Deleted:    change.Closed,
+		Forced:     change.Forced,
+		Repository: bbEvt.Repository.FullName,
+		Pusher:     pusher,
+		Truncated:  true,
+	}
+	if change.Old != nil {
+		push.Ref = change.Old.ref()
+		push.Before = change.Old.Target.Hash
+	}
+	if change.New != nil {
+		push.Ref = change.New.ref()
+		push.After = change.New.Target.Hash
+		push.HeadCommit = change.New.Target.toCommit()
+	}
+
+	// The commits are newest first
+	for i := len(change.Commits) - 1; i >= 0; i-- {
+		push.Commits = append(push.Commits, change.Commits[i].toCommit())
+	}
+
+	return push, nil
+}
+
+// BitbucketClient calls the bitbucket cloud api with a repository or workspace access token
+type BitbucketClient struct {
+	Client  *http.Client
+	BaseURL string
+	Token   string
+}
+
+// diffstat is a page of the diffstat api response
+type diffstat struct {
+	Values []struct {
+		Old *struct {
+			Path string `json:"path"`
+		} `json:"old"`
+		New *struct {
+			Path string `json:"path"`
+		} `json:"new"`
+	} `json:"values"`
+	Next string `json:"next"`
+}
+
+// DiffstatFiles lists the files changed by head since base, going through all the pages
+// https://developer.atlassian.com/cloud/bitbucket/rest/api-group-commits/#api-repositories-workspace-repo-slug-diffstat-spec-get
+func (c *BitbucketClient) DiffstatFiles(ctx context.Context, fullName, head, base string) ([]string, error) {
+	files := []string{}
+	seen := map[string]bool{}
+	add := func(file string) {
+		if file != "" && !seen[file] {
+			seen[file] = true
+			files = append(files, file)
+		}
+	}
+
+	u := fmt.Sprintf("%s/repositories/%s/diffstat/%s..%s?pagelen=500",
+		strings.TrimSuffix(c.BaseURL, "/"), fullName, url.PathEscape(head), url.PathEscape(base))
+	for u != "" {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+		req.Header.Set("Accept", "application/json")
+
+		resp, err := c.Client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		page := diffstat{}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("bitbucket returned %d for %s", resp.StatusCode, u)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		for _, v := range page.Values {
+			// A rename changes both paths, a removed file only has the old one
+			if v.New != nil {
+				add(v.New.Path)
+			}
+			if v.Old != nil {
+				add(v.Old.Path)
+			}
+		}
+
+		u = page.Next
+	}
+
+	return files, nil
+}
+
+// bitbucketPushFiles returns the files changed by a bitbucket push. Without a token, or without a
+// commit to compare with, there are no files and only the rules without filters match.
+func bitbucketPushFiles(ctx context.Context, client *BitbucketClient, push *PushEvent, branch string) []string {
+	fields := log.Fields{
+		"provider": push.Provider,
+		"repo":     push.Repository,
+		"branch":   branch,
+		"before":   push.Before,
+		"after":    push.After,
+	}
+
+	if client == nil {
+		log.WithFields(fields).Warnln("bitbucket does not list the changed files and there is no bitbucket token, only the rules without filters match")
+		return []string{}
+	}
+	if push.Before == ZeroSHA {
+		log.WithFields(fields).Warnln("new branch has nothing to compare with, only the rules without filters match")
+		return []string{}
+	}
+
+	files, err := client.DiffstatFiles(ctx, push.Repository, push.After, push.Before)
+	if err != nil {
+		log.WithFields(fields).Errorf("error in reading the diffstat, only the rules without filters match: %v", err.Error())
+		return []string{}
+	}
+
+	log.WithFields(fields).WithField("diffstat_len", len(files)).Infoln("read changed files from the diffstat api")
+
+	return files
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/codepipeline"
+	"github.com/aws/aws-sdk-go/service/codepipeline/codepipelineiface"
+	"github.com/google/go-github/github"
+	log "github.com/sirupsen/logrus"
+)
+
+// ConcurrencyPolicy decides what happens to the executions already in progress
+// when a new push starts a pipeline
+type ConcurrencyPolicy string
+
+const (
+	// PolicyQueue starts a new execution, codepipeline queues it behind the others
+	PolicyQueue ConcurrencyPolicy = "queue"
+	// PolicySupersede starts a new execution and stops the older ones in progress
+	PolicySupersede ConcurrencyPolicy = "supersede"
+	// PolicyCoalesce does not start anything if an execution in progress is already
+	// building the same or a newer commit. The statuses of that execution are posted
+	// to the commit it builds, the coalesced commit does not get a status of its own.
+	PolicyCoalesce ConcurrencyPolicy = "coalesce"
+)
+
+// RunningWindow is how far back the executions in progress are looked for, an execution
+// can wait up to 7 days on a manual approval
+const RunningWindow = 7 * 24 * time.Hour
+
+func (p ConcurrencyPolicy) valid() bool {
+	switch p {
+	case PolicyQueue, PolicySupersede, PolicyCoalesce:
+		return true
+	}
+	return false
+}
+
+// RunningExecution is an execution in progress and the commit it is building
+type RunningExecution struct {
+	ID     string
+	Commit string
+}
+
+// runningExecutions lists the executions of the pipeline which are in progress.
+// The executions are listed newest first, the pages are read until the executions
+// were started before RunningWindow.
+func runningExecutions(cpsvc codepipelineiface.CodePipelineAPI, pipeline string) ([]RunningExecution, error) {
+	since := time.Now().Add(-RunningWindow)
+	input := &codepipeline.ListPipelineExecutionsInput{
+		PipelineName: aws.String(pipeline),
+		MaxResults:   aws.Int64(100),
+	}
+
+	running := []RunningExecution{}
+	for {
+		resp, err := cpsvc.ListPipelineExecutions(input)
+		if err != nil {
+			return nil, fmt.Errorf("error in listing executions of %s: %v", pipeline, err.Error())
+		}
+
+		for _, summary := range resp.PipelineExecutionSummaries {
+			if summary.StartTime != nil && summary.StartTime.Before(since) {
+				return running, nil
+			}
+			if aws.StringValue(summary.Status) != codepipeline.PipelineExecutionStatusInProgress {
+				continue
+			}
+
+			execution := RunningExecution{
+				ID: aws.StringValue(summary.PipelineExecutionId),
+			}
+			for _, revision := range summary.SourceRevisions {
+				if revision.RevisionId != nil {
+					execution.Commit = *revision.RevisionId
+					break
+				}
+			}
+			running = append(running, execution)
+		}
+
+		if resp.NextToken == nil {
+			return running, nil
+		}
+		input.NextToken = resp.NextToken
+	}
+}
+
+// coalesceInto returns the execution in progress building the same or a newer commit than sha.
+// Without a github client only the executions building the same commit are found.
+func coalesceInto(ctx context.Context, client *github.Client, repository string, running []RunningExecution, sha string) *RunningExecution {
+	for i := range running {
+		execution := running[i]
+		if execution.Commit == "" || sha == "" {
+			continue
+		}
+		if execution.Commit == sha {
+			return &execution
+		}
+
+		owner, repo, ok := splitFullName(repository)
+		if client == nil || !ok {
+			continue
+		}
+
+		// `ahead` means the running commit descends from sha
+		cmp, _, err := client.Repositories.CompareCommits(ctx, owner, repo, sha, execution.Commit)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"pipeline_execution_id": execution.ID,
+				"commit":                execution.Commit,
+				"head_commit":           sha,
+			}).Warnf("error in comparing commits: %v", err.Error())
+			continue
+		}
+		if cmp.GetStatus() == "ahead" || cmp.GetStatus() == "identical" {
+			return &execution
+		}
+	}
+
+	return nil
+}
+
+// supersede stops the executions in progress which were started before the new one
+func supersede(cpsvc codepipelineiface.CodePipelineAPI, pipeline string, running []RunningExecution, executionID, sha string) []string {
+	stopped := []string{}
+	for _, execution := range running {
+		if execution.ID == executionID {
+			continue
+		}
+
+		_, err := cpsvc.StopPipelineExecution(&codepipeline.StopPipelineExecutionInput{
+			PipelineName:        aws.String(pipeline),
+			PipelineExecutionId: aws.String(execution.ID),
+			// Let the running actions finish instead of abandoning them
+			Abandon: aws.Bool(false),
+			Reason:  aws.String(fmt.Sprintf("Superseded by execution %s for commit %s", executionID, sha)),
+		})
+		if err != nil {
+			log.WithFields(log.Fields{
+				"codepipeline_name":     pipeline,
+				"pipeline_execution_id": execution.ID,
+			}).Warnf("error in stopping superseded execution: %v", err.Error())
+			continue
+		}
+
+		stopped = append(stopped, execution.ID)
+	}
+
+	return stopped
+}
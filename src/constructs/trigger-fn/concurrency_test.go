@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/codepipeline"
+)
+
+func summary(id, status, commit string) *codepipeline.PipelineExecutionSummary {
+	return &codepipeline.PipelineExecutionSummary{
+		PipelineExecutionId: aws.String(id),
+		Status:              aws.String(status),
+		SourceRevisions: []*codepipeline.SourceRevision{
+			{ActionName: aws.String("Source"), RevisionId: aws.String(commit)},
+		},
+	}
+}
+
+func TestStartPipelineConcurrency(t *testing.T) {
+	executions := []*codepipeline.PipelineExecutionSummary{
+		summary("running-1", codepipeline.PipelineExecutionStatusInProgress, "a1b2"),
+		summary("running-2", codepipeline.PipelineExecutionStatusInProgress, "b2c3"),
+		summary("done", codepipeline.PipelineExecutionStatusSucceeded, "9f8e"),
+	}
+
+	tests := []struct {
+		name        string
+		policy      ConcurrencyPolicy
+		sha         string
+		wantStarted int
+		wantStopped []string
+		wantInto    string
+	}{
+		{"queue", PolicyQueue, "c3d4", 1, nil, ""},
+		{"supersede", PolicySupersede, "c3d4", 1, []string{"running-1", "running-2"}, ""},
+		{"coalesce new commit", PolicyCoalesce, "c3d4", 1, nil, ""},
+		{"coalesce same commit", PolicyCoalesce, "b2c3", 0, nil, "running-2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc, cp := testServices()
+			cp.executions = executions
+
+			rule := Rule{Name: "prod", Pipeline: "website-prod", Concurrency: tt.policy}
+			execution := startPipeline(context.Background(), svc, rule, Trigger{SHA: tt.sha})
+
+			if len(cp.started) != tt.wantStarted {
+				t.Errorf("expected %d executions started, got %d", tt.wantStarted, len(cp.started))
+			}
+			if !reflect.DeepEqual(cp.stopped, tt.wantStopped) {
+				t.Errorf("expected %v to be stopped, got %v", tt.wantStopped, cp.stopped)
+			}
+			if execution.CoalescedInto != tt.wantInto {
+				t.Errorf("expected to coalesce into %q, got %q", tt.wantInto, execution.CoalescedInto)
+			}
+		})
+	}
+}
+
+func TestRunningExecutionsPages(t *testing.T) {
+	started := func(s *codepipeline.PipelineExecutionSummary, ago time.Duration) *codepipeline.PipelineExecutionSummary {
+		s.StartTime = aws.Time(time.Now().Add(-ago))
+		return s
+	}
+
+	svc, cp := testServices()
+	cp.pageSize = 2
+	cp.executions = []*codepipeline.PipelineExecutionSummary{
+		started(summary("done-1", codepipeline.PipelineExecutionStatusSucceeded, "f1"), time.Minute),
+		started(summary("done-2", codepipeline.PipelineExecutionStatusSucceeded, "f2"), time.Hour),
+		started(summary("waiting", codepipeline.PipelineExecutionStatusInProgress, "e3"), 2*24*time.Hour),
+		started(summary("done-3", codepipeline.PipelineExecutionStatusFailed, "d4"), 3*24*time.Hour),
+		started(summary("old", codepipeline.PipelineExecutionStatusInProgress, "c5"), 8*24*time.Hour),
+		started(summary("older", codepipeline.PipelineExecutionStatusSucceeded, "b6"), 9*24*time.Hour),
+		started(summary("oldest", codepipeline.PipelineExecutionStatusSucceeded, "a7"), 10*24*time.Hour),
+	}
+
+	running, err := runningExecutions(svc.Codepipeline, "website-prod")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []RunningExecution{{ID: "waiting", Commit: "e3"}}
+	if !reflect.DeepEqual(running, want) {
+		t.Errorf("expected %v, got %v", want, running)
+	}
+	// The last page is older than the window and is not read
+	if cp.listed != 3 {
+		t.Errorf("expected 3 pages to be listed, got %d", cp.listed)
+	}
+}
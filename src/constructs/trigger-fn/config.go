@@ -2,17 +2,104 @@ package main
 
 import (
 	"context"
-	"strings"
+	"fmt"
+	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
 	"github.com/sethvargo/go-envconfig"
 	log "github.com/sirupsen/logrus"
 )
 
 type Config struct {
-	CodepipelineName string `env:"CODEPIPELINE_NAME,required"`
-	GithubBranch     string `env:"GITHUB_BRANCH,required"`
-	Filters_         string `env:"FILTERS,required"`
-	Filters          []string
+	// Routing table as JSON/YAML, either inline or in S3. See Routes
+	Routes_     string `env:"ROUTES"`
+	RoutesS3URI string `env:"ROUTES_S3_URI"`
+	Routes      *Routes
+	// Path of the routes file read from the pushed commit, e.g. `.deploy.yml`. See RepoRoutes
+	RepoRoutesFile string `env:"REPO_ROUTES_FILE"`
+	// Generated dependency manifest as JSON, either inline or in S3. See DependencyManifest
+	DependencyManifest_     string `env:"DEPENDENCY_MANIFEST"`
+	DependencyManifestS3URI string `env:"DEPENDENCY_MANIFEST_S3_URI"`
+	Manifest                *DependencyManifest
+
+	// Single pipeline setup, used when there are no routes
+	CodepipelineName string `env:"CODEPIPELINE_NAME"`
+	GithubBranch     string `env:"GITHUB_BRANCH"`
+	// Repository restricts the rules to one repository, needed with an organization webhook
+	Repository string `env:"REPOSITORY"`
+	Filters_   string `env:"FILTERS"`
+	// Pass commit metadata as pipeline variables, needs a V2 pipeline
+	PipelineVariables bool   `env:"PIPELINE_VARIABLES,default=false"`
+	SourceActionName  string `env:"SOURCE_ACTION_NAME"`
+	// queue, supersede or coalesce, see ConcurrencyPolicy
+	ConcurrencyPolicy string `env:"CONCURRENCY_POLICY,default=queue"`
+	// Author policy and signed commits, see AuthorPolicy
+	AllowedAuthors_ string `env:"ALLOWED_AUTHORS"`
+	DeniedAuthors_  string `env:"DENIED_AUTHORS"`
+	IgnoreBots      bool   `env:"IGNORE_BOTS,default=false"`
+	RequireVerified bool   `env:"REQUIRE_VERIFIED_COMMITS,default=false"`
+	// Pipelines started for the pull requests to GITHUB_BRANCH
+	PreviewPipelineName  string `env:"PREVIEW_PIPELINE_NAME"`
+	TeardownPipelineName string `env:"TEARDOWN_PIPELINE_NAME"`
+	// Start the pipelines for the pull requests from forks. Their head commit is not trusted,
+	// it runs with the role of the pipeline, so they are ignored by default
+	AllowForkPullRequests bool `env:"ALLOW_FORK_PULL_REQUESTS,default=false"`
+	// Lambdas of the default rule, see Rule.Lambdas
+	Lambdas_ string `env:"LAMBDAS"`
+	// Pipelines started by the deploy commands, e.g. `staging=website-staging,prod=website-prod`
+	DeployPipelines_ string `env:"DEPLOY_PIPELINES"`
+
+	// Repository permission needed to comment a deploy command, `write` or `admin`
+	DeployPermission string `env:"DEPLOY_PERMISSION,default=write"`
+
+	// WebhookSecretArn points to the secret shared with github. It is used to
+	// validate the `X-Hub-Signature-256` header of every delivery
+	WebhookSecretArn string `env:"WEBHOOK_SECRET_ARN,required"`
+	WebhookSecret    []byte
+	// DispatchSecretArn points to the secret signing the manual dispatches, see DispatchRequest.
+	// Without it only the IAM authenticated dispatches are accepted
+	DispatchSecretArn string `env:"DISPATCH_SECRET_ARN"`
+	DispatchSecret    []byte
+
+	// Token used to call the github api, e.g. to list the changes of truncated pushes
+	GithubTokenArn string `env:"GITHUB_TOKEN_ARN"`
+	GithubToken    string
+	// Repository full name, e.g. `nkhine/khine.net`, to report the status of the manual dispatches
+	GithubRepository string `env:"GITHUB_REPOSITORY"`
+	// Base url of the github api, for github enterprise
+	GithubAPIURL string `env:"GITHUB_API_URL"`
+	// Repository or workspace access token used to read the files changed by the bitbucket pushes
+	BitbucketTokenArn string `env:"BITBUCKET_TOKEN_ARN"`
+	BitbucketToken    string
+	BitbucketAPIURL   string `env:"BITBUCKET_API_URL,default=https://api.bitbucket.org/2.0"`
+
+	// Only accept requests from the `hooks` ranges of the github meta api,
+	// plus SOURCE_CIDRS, e.g. for a self hosted gitea. The ranges are cached for META_TTL
+	SourceIPGuard bool          `env:"SOURCE_IP_GUARD,default=false"`
+	SourceCIDRs_  string        `env:"SOURCE_CIDRS"`
+	MetaTTL       time.Duration `env:"META_TTL,default=1h"`
+
+	// webhook serves the function url, consumer processes the deliveries queued in QUEUE_URL
+	Mode string `env:"TRIGGER_MODE,default=webhook"`
+	// When set, the function url only authenticates the deliveries and queues them
+	QueueURL string `env:"QUEUE_URL"`
+
+	// Every authenticated delivery is archived to this bucket, with its secrets redacted
+	ArchiveBucket string `env:"ARCHIVE_BUCKET"`
+	ArchivePrefix string `env:"ARCHIVE_PREFIX,default=deliveries/"`
+
+	// Deliveries are deduplicated in this table, or in memory when it is empty
+	DedupTableName string        `env:"DEDUP_TABLE_NAME"`
+	DedupTTL       time.Duration `env:"DEDUP_TTL,default=72h"`
+	// A delivery claimed by an attempt that did not complete it within the lease is processed
+	// again by the next attempt. It must be longer than the function timeout.
+	DedupLease time.Duration `env:"DEDUP_LEASE,default=2m"`
+
+	// The commit of every execution started is recorded in this table for status-fn
+	ExecutionsTableName string        `env:"EXECUTIONS_TABLE_NAME"`
+	ExecutionsTTL       time.Duration `env:"EXECUTIONS_TTL,default=720h"`
 }
 
 func readConfigFromEnv() Config {
@@ -24,8 +111,71 @@ func readConfigFromEnv() Config {
 		log.Fatalln(err)
 	}
 
-	filters := strings.Split(config.Filters_, ",")
-	config.Filters = filters
+	if config.Mode != ModeWebhook && config.Mode != ModeConsumer {
+		log.Fatalf("invalid TRIGGER_MODE %s, expected %s or %s", config.Mode, ModeWebhook, ModeConsumer)
+	}
+	if permissionLevels[config.DeployPermission] < permissionLevels["write"] {
+		log.Fatalf("invalid DEPLOY_PERMISSION %s, expected write or admin", config.DeployPermission)
+	}
+
+	routes, err := loadRoutes(config)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	config.Routes = routes
+
+	manifest, err := loadManifest(config)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if manifest == nil && routes.NeedsManifest() {
+		log.Fatalln("rules with lambdas need DEPENDENCY_MANIFEST or DEPENDENCY_MANIFEST_S3_URI")
+	}
+	config.Manifest = manifest
+
+	secret, err := readSecret(config.WebhookSecretArn)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	config.WebhookSecret = []byte(*secret)
+
+	if config.DispatchSecretArn != "" {
+		secret, err := readSecret(config.DispatchSecretArn)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		config.DispatchSecret = []byte(*secret)
+	}
+
+	if config.GithubTokenArn != "" {
+		token, err := readSecret(config.GithubTokenArn)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		config.GithubToken = *token
+	}
+
+	if config.BitbucketTokenArn != "" {
+		token, err := readSecret(config.BitbucketTokenArn)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		config.BitbucketToken = *token
+	}
 
 	return config
 }
+
+func readSecret(secretArn string) (*string, error) {
+	sess := session.Must(session.NewSession())
+	secretssvc := secretsmanager.New(sess)
+
+	resp, err := secretssvc.GetSecretValue(&secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(secretArn),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error in reading secret %s: %v", secretArn, err.Error())
+	}
+
+	return resp.SecretString, nil
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+const DeliveryHeader = "x-github-delivery"
+
+// Delivery is a webhook delivery trigger-fn has seen, keyed by its `X-GitHub-Delivery` GUID
+type Delivery struct {
+	ID         string      `dynamodbav:"delivery_id"`
+	Executions []Execution `dynamodbav:"executions"`
+	// Completed is false while the pipelines are being started
+	Completed bool `dynamodbav:"completed"`
+	// ClaimedAt is when the delivery was last claimed, in unix seconds
+	ClaimedAt int64 `dynamodbav:"claimed_at"`
+	ExpiresAt int64 `dynamodbav:"expires_at"`
+}
+
+// stale reports whether the attempt holding the delivery has most likely died, the claim is not
+// completed within the lease. A zero lease never expires.
+func (d *Delivery) stale(lease time.Duration, now time.Time) bool {
+	return !d.Completed && lease > 0 && d.ClaimedAt < now.Add(-lease).Unix()
+}
+
+// DeliveryStore deduplicates webhook deliveries.
+// Github redelivers a webhook when it times out, those should not start the pipelines again.
+type DeliveryStore interface {
+	// Claim records a new delivery, or takes over a stale claim. If the delivery
+	// was already claimed it returns the stored delivery and false.
+	Claim(ctx context.Context, id string) (*Delivery, bool, error)
+	// Complete stores the executions started for a claimed delivery
+	Complete(ctx context.Context, id string, executions []Execution) error
+	// Release forgets a claimed delivery so that a redelivery is processed again
+	Release(ctx context.Context, id string) error
+}
+
+// DynamoDeliveryStore keeps the deliveries in a dynamodb table with `delivery_id`
+// as the partition key and `expires_at` as the TTL attribute
+type DynamoDeliveryStore struct {
+	Client    dynamodbiface.DynamoDBAPI
+	TableName string
+	TTL       time.Duration
+	// Lease after which a claim that is not completed can be taken over,
+	// it must be longer than the function timeout
+	Lease time.Duration
+}
+
+func (s *DynamoDeliveryStore) Claim(ctx context.Context, id string) (*Delivery, bool, error) {
+	now := time.Now()
+	item, err := dynamodbattribute.MarshalMap(Delivery{
+		ID:         id,
+		Executions: []Execution{},
+		ClaimedAt:  now.Unix(),
+		ExpiresAt:  now.Add(s.TTL).Unix(),
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	_, err = s.Client.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(s.TableName),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(delivery_id)"),
+	})
+	if err == nil {
+		return nil, true, nil
+	}
+
+	if !conditionFailed(err) {
+		return nil, false, fmt.Errorf("error in claiming delivery %s: %v", id, err.Error())
+	}
+
+	if s.Lease > 0 {
+		// Take over the claim of an attempt that timed out or crashed before completing it.
+		// The condition lets a single attempt take it over.
+		_, err = s.Client.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+			TableName: aws.String(s.TableName),
+			Key: map[string]*dynamodb.AttributeValue{
+				"delivery_id": {S: aws.String(id)},
+			},
+			UpdateExpression:    aws.String("SET claimed_at = :now, expires_at = :expires"),
+			ConditionExpression: aws.String("completed = :false AND (attribute_not_exists(claimed_at) OR claimed_at < :stale)"),
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":now":     {N: aws.String(strconv.FormatInt(now.Unix(), 10))},
+				":expires": {N: aws.String(strconv.FormatInt(now.Add(s.TTL).Unix(), 10))},
+				":stale":   {N: aws.String(strconv.FormatInt(now.Add(-s.Lease).Unix(), 10))},
+				":false":   {BOOL: aws.Bool(false)},
+			},
+		})
+		if err == nil {
+			return nil, true, nil
+		}
+		if !conditionFailed(err) {
+			return nil, false, fmt.Errorf("error in taking over delivery %s: %v", id, err.Error())
+		}
+	}
+
+	// Already claimed, return what was recorded
+	resp, err := s.Client.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(s.TableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"delivery_id": {S: aws.String(id)},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, false, fmt.Errorf("error in reading delivery %s: %v", id, err.Error())
+	}
+
+	delivery := &Delivery{}
+	err = dynamodbattribute.UnmarshalMap(resp.Item, delivery)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return delivery, false, nil
+}
+
+// conditionFailed reports whether the condition of a dynamodb write did not hold
+func conditionFailed(err error) bool {
+	var aerr awserr.Error
+	return errors.As(err, &aerr) && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException
+}
+
+func (s *DynamoDeliveryStore) Complete(ctx context.Context, id string, executions []Execution) error {
+	av, err := dynamodbattribute.Marshal(executions)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.Client.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(s.TableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"delivery_id": {S: aws.String(id)},
+		},
+		UpdateExpression: aws.String("SET executions = :executions, completed = :completed"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":executions": av,
+			":completed":  {BOOL: aws.Bool(true)},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("error in completing delivery %s: %v", id, err.Error())
+	}
+
+	return nil
+}
+
+func (s *DynamoDeliveryStore) Release(ctx context.Context, id string) error {
+	_, err := s.Client.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(s.TableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"delivery_id": {S: aws.String(id)},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("error in releasing delivery %s: %v", id, err.Error())
+	}
+
+	return nil
+}
+
+// MemoryDeliveryStore keeps the deliveries in memory. It is meant for tests and
+// local runs, in lambda it only deduplicates deliveries reaching the same container.
+type MemoryDeliveryStore struct {
+	TTL time.Duration
+	// Lease after which a claim that is not completed can be taken over
+	Lease time.Duration
+
+	mu         sync.Mutex
+	deliveries map[string]Delivery
+}
+
+func NewMemoryDeliveryStore(ttl, lease time.Duration) *MemoryDeliveryStore {
+	return &MemoryDeliveryStore{
+		TTL:        ttl,
+		Lease:      lease,
+		deliveries: map[string]Delivery{},
+	}
+}
+
+func (s *MemoryDeliveryStore) Claim(ctx context.Context, id string) (*Delivery, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if d, ok := s.deliveries[id]; ok && now.Unix() < d.ExpiresAt && !d.stale(s.Lease, now) {
+		return &d, false, nil
+	}
+
+	s.deliveries[id] = Delivery{
+		ID:         id,
+		Executions: []Execution{},
+		ClaimedAt:  now.Unix(),
+		ExpiresAt:  now.Add(s.TTL).Unix(),
+	}
+	return nil, true, nil
+}
+
+func (s *MemoryDeliveryStore) Complete(ctx context.Context, id string, executions []Execution) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d, ok := s.deliveries[id]
+	if !ok {
+		return fmt.Errorf("delivery %s is not claimed", id)
+	}
+	d.Executions = executions
+	d.Completed = true
+	s.deliveries[id] = d
+
+	return nil
+}
+
+func (s *MemoryDeliveryStore) Release(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.deliveries, id)
+	return nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// DependencyManifest maps the go packages of the repository to the lambdas importing them.
+// It is generated by src/tools/lambda-deps, e.g.
+//
+//	{
+//	  "module": "cloudfront",
+//	  "packages": {
+//	    "src/lambda/api/account": ["src/lambda/api/account"],
+//	    "src/pkg/session": ["src/lambda/api/account", "src/lambda/api/auth"]
+//	  },
+//	  "global": ["go.mod", "go.sum"]
+//	}
+type DependencyManifest struct {
+	Module string `json:"module"`
+	// Packages maps the directory of every package to the directories of the lambdas depending on it
+	Packages map[string][]string `json:"packages"`
+	// Global files affect every lambda
+	Global []string `json:"global"`
+}
+
+func parseManifest(b []byte) (*DependencyManifest, error) {
+	manifest := &DependencyManifest{}
+	err := json.Unmarshal(b, manifest)
+	if err != nil {
+		return nil, fmt.Errorf("error in parsing dependency manifest: %v", err.Error())
+	}
+	if len(manifest.Packages) == 0 {
+		return nil, fmt.Errorf("dependency manifest does not have any packages")
+	}
+
+	return manifest, nil
+}
+
+// loadManifest reads the manifest from `DEPENDENCY_MANIFEST`, then `DEPENDENCY_MANIFEST_S3_URI`.
+// It returns nil when neither is set.
+func loadManifest(config Config) (*DependencyManifest, error) {
+	if config.DependencyManifest_ != "" {
+		return parseManifest([]byte(config.DependencyManifest_))
+	}
+
+	if config.DependencyManifestS3URI != "" {
+		b, err := readS3Object(config.DependencyManifestS3URI)
+		if err != nil {
+			return nil, err
+		}
+		return parseManifest(b)
+	}
+
+	return nil, nil
+}
+
+// Affected returns the sorted directories of the lambdas affected by the changed files.
+// A file belongs to the package of its closest parent directory, test files are ignored.
+func (manifest *DependencyManifest) Affected(files []string) []string {
+	if manifest == nil {
+		return nil
+	}
+
+	affected := map[string]bool{}
+	for _, file := range files {
+		if contains(manifest.Global, file) {
+			for _, lambdas := range manifest.Packages {
+				for _, lambda := range lambdas {
+					affected[lambda] = true
+				}
+			}
+			continue
+		}
+		if strings.HasSuffix(file, "_test.go") {
+			continue
+		}
+
+		for dir := path.Dir(file); dir != "." && dir != "/"; dir = path.Dir(dir) {
+			if lambdas, ok := manifest.Packages[dir]; ok {
+				for _, lambda := range lambdas {
+					affected[lambda] = true
+				}
+				break
+			}
+		}
+	}
+
+	lambdas := make([]string, 0, len(affected))
+	for lambda := range affected {
+		lambdas = append(lambdas, lambda)
+	}
+	sort.Strings(lambdas)
+
+	return lambdas
+}
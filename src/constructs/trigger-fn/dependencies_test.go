@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+const testManifest = `{
+  "module": "cloudfront",
+  "packages": {
+    "src/lambda/api/account": ["src/lambda/api/account"],
+    "src/lambda/api/auth": ["src/lambda/api/auth"],
+    "src/lambda/workflow/email": ["src/lambda/workflow/email"],
+    "src/pkg/session": ["src/lambda/api/account", "src/lambda/api/auth"]
+  },
+  "global": ["go.mod", "go.sum"]
+}`
+
+const testLambdaRoutes = `
+rules:
+  - name: api
+    branch: main
+    lambdas: ["src/lambda/api/"]
+    pipeline: api-prod
+    variables: true
+  - name: workflow
+    branch: main
+    lambdas: ["src/lambda/workflow/"]
+    pipeline: workflow-prod
+  - name: docs
+    branch: main
+    filters: ["docs/**"]
+    pipeline: website-docs
+`
+
+func TestManifestAffected(t *testing.T) {
+	manifest, err := parseManifest([]byte(testManifest))
+	if err != nil {
+		t.Fatalf("error in parsing manifest: %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		files []string
+		want  []string
+	}{
+		{"lambda", []string{"src/lambda/api/auth/main.go"}, []string{"src/lambda/api/auth"}},
+		{"shared package", []string{"src/pkg/session/session.go"}, []string{"src/lambda/api/account", "src/lambda/api/auth"}},
+		{"embedded file", []string{"src/lambda/workflow/email/templates/email.html"}, []string{"src/lambda/workflow/email"}},
+		{"test file", []string{"src/pkg/session/session_test.go"}, []string{}},
+		{"unrelated", []string{"README.md", "src/cicd.ts"}, []string{}},
+		{"global", []string{"go.sum"}, []string{"src/lambda/api/account", "src/lambda/api/auth", "src/lambda/workflow/email"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := manifest.Affected(tt.files); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+
+	var none *DependencyManifest
+	if got := none.Affected([]string{"go.sum"}); got != nil {
+		t.Errorf("expected no lambdas without a manifest, got %v", got)
+	}
+}
+
+func TestHandlerAffectedLambdas(t *testing.T) {
+	config := testConfig(t, testLambdaRoutes)
+	manifest, err := parseManifest([]byte(testManifest))
+	if err != nil {
+		t.Fatalf("error in parsing manifest: %v", err)
+	}
+	config.Manifest = manifest
+	svc, cp := testServices()
+
+	push := GithubEvent{
+		Ref:     "refs/heads/main",
+		Commits: []Commit{{Modified: []string{"src/pkg/session/session.go"}}},
+	}
+	resp, _ := handler(context.Background(), config, svc, newDelivery(t, "push", "", push))
+	if len(cp.started) != 1 || *cp.started[0].Name != "api-prod" {
+		t.Fatalf("expected api-prod to be started, got %s", resp.Body)
+	}
+	variables := map[string]string{}
+	for _, v := range cp.started[0].Variables {
+		variables[*v.Name] = *v.Value
+	}
+	if got := variables[VariableAffectedLambdas]; got != "src/lambda/api/account,src/lambda/api/auth" {
+		t.Errorf("unexpected affected lambdas %q", got)
+	}
+
+	// The workflow lambdas are not affected
+	decision := config.Routes.Rules[1].Explain(Change{
+		Event:   "push",
+		Branch:  "main",
+		Files:   []string{"src/pkg/session/session.go"},
+		Lambdas: []string{"src/lambda/api/account", "src/lambda/api/auth"},
+	})
+	if decision.Matched || decision.Reason != "no changed file affects the lambdas" {
+		t.Errorf("unexpected decision %+v", decision)
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/google/go-github/github"
+	log "github.com/sirupsen/logrus"
+)
+
+// IssueCommentEvent is the payload of the `issue_comment` event.
+// Pull requests are issues, their comments are sent as issue comments.
+// https://docs.github.com/en/webhooks/webhook-events-and-payloads#issue_comment
+type IssueCommentEvent struct {
+	Action string `json:"action"`
+	Issue  struct {
+		Number int `json:"number"`
+		// PullRequest is only set on the issues that are pull requests
+		PullRequest *struct {
+			URL string `json:"url"`
+		} `json:"pull_request"`
+	} `json:"issue"`
+	Comment struct {
+		ID   int64  `json:"id"`
+		Body string `json:"body"`
+		User struct {
+			Login string `json:"login"`
+			Type  string `json:"type"`
+		} `json:"user"`
+	} `json:"comment"`
+	Repository struct {
+		Name     string `json:"name"`
+		FullName string `json:"full_name"`
+	} `json:"repository"`
+	Sender struct {
+		Login string `json:"login"`
+		Type  string `json:"type"`
+	} `json:"sender"`
+}
+
+// deployCommand is a pull request comment starting with `/deploy <environment>`
+var deployCommand = regexp.MustCompile(`^/deploy\s+([\w.-]+)\s*$`)
+
+// DefaultDeployPermission is the repository permission needed to deploy, see Config.DeployPermission
+const DefaultDeployPermission = "write"
+
+// permissionLevels orders the repository permissions returned by github
+var permissionLevels = map[string]int{
+	"none":  0,
+	"read":  1,
+	"write": 2,
+	"admin": 3,
+}
+
+// parseDeployCommand returns the environment of a deploy command, read from the first line of the comment
+func parseDeployCommand(body string) (string, bool) {
+	line, _, _ := strings.Cut(strings.TrimSpace(body), "\n")
+	m := deployCommand.FindStringSubmatch(strings.TrimSpace(line))
+	if m == nil {
+		return "", false
+	}
+	return m[1], true
+}
+
+// handleIssueComment starts the pipeline of an environment when a collaborator
+// comments `/deploy <environment>` on a pull request, and replies with the executions
+func handleIssueComment(ctx context.Context, config Config, svc Services, deliveryID string, payload []byte, dryRun bool) (events.LambdaFunctionURLResponse, error) {
+	commentEvt := IssueCommentEvent{}
+	err := json.Unmarshal(payload, &commentEvt)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"request_body": string(payload),
+		}).Errorf("error in umarshalling request body: %v", err.Error())
+
+		return buildBadRequestResponse()
+	}
+
+	number := commentEvt.Issue.Number
+	ref := fmt.Sprintf("refs/pull/%d/head", number)
+	ignore := func(reason string) (events.LambdaFunctionURLResponse, error) {
+		return buildJSONResponse(http.StatusOK, Result{
+			Executions:  []Execution{},
+			DryRun:      dryRun,
+			Explanation: skipped(dryRun, "issue_comment", ref, reason),
+		})
+	}
+
+	if commentEvt.Action != "created" || commentEvt.Issue.PullRequest == nil {
+		return ignore("comment is not a new pull request comment")
+	}
+	env, ok := parseDeployCommand(commentEvt.Comment.Body)
+	if !ok {
+		return ignore("comment is not a deploy command")
+	}
+
+	user := commentEvt.Comment.User.Login
+	fields := log.Fields{
+		"pr_number":   number,
+		"environment": env,
+		"commenter":   user,
+		"comment_id":  commentEvt.Comment.ID,
+	}
+	if svc.Github == nil {
+		log.WithFields(fields).Warnln("ignoring deploy command, there is no github token to check the permission of the commenter")
+		return ignore("there is no github token to check the permission of the commenter")
+	}
+
+	permission := config.DeployPermission
+	if permission == "" {
+		permission = DefaultDeployPermission
+	}
+	fullName := commentEvt.Repository.FullName
+	allowed, err := hasPermission(ctx, svc.Github, fullName, user, permission)
+	if err != nil {
+		log.WithFields(fields).Errorf("error in checking permission: %v", err.Error())
+		return buildResponse(http.StatusInternalServerError)
+	}
+	if !allowed {
+		// Not answered, anyone can comment and the bot would reply to every comment
+		log.WithFields(fields).Infoln("ignoring deploy command, commenter does not have the permission to deploy")
+		return ignore(fmt.Sprintf("%s does not have the %s permission", user, permission))
+	}
+
+	pr, err := getPullRequest(ctx, svc.Github, fullName, number)
+	if err != nil {
+		log.WithFields(fields).Errorf("error in getting pull request: %v", err.Error())
+		return buildResponse(http.StatusInternalServerError)
+	}
+
+	change := Change{
+		Event:       "deploy",
+		Environment: env,
+		Repository:  fullName,
+		Branch:      pr.GetBase().GetRef(),
+		Authors:     authors(user),
+		Bot:         commentEvt.Comment.User.Type == "Bot",
+	}
+	if config.Routes.NeedsVerification("deploy", change.Branch) {
+		change.Verified = verifyCommit(ctx, svc, ProviderGithub, fullName, pr.GetHead().GetSHA())
+	}
+	if dryRun {
+		return explain(config, change, ref, nil)
+	}
+
+	rules := config.Routes.Match(change)
+	if len(rules) == 0 {
+		log.WithFields(fields).Infoln("skipping deploy command, did not find any matching rules")
+		reply(ctx, svc, fullName, number, fmt.Sprintf("There is no pipeline deploying `%s` pull requests to %s.", change.Branch, env))
+		return buildJSONResponse(http.StatusOK, Result{Executions: []Execution{}})
+	}
+
+	statusCode, result := startOnce(ctx, svc, deliveryID, rules, deployTrigger(commentEvt, pr, env))
+	if result == nil {
+		return buildResponse(statusCode)
+	}
+	// A redelivery was already answered
+	if !result.Duplicate {
+		reply(ctx, svc, fullName, number, deployReply(env, pr.GetHead().GetSHA(), result.Executions))
+	}
+
+	return buildJSONResponse(statusCode, *result)
+}
+
+func deployTrigger(commentEvt IssueCommentEvent, pr *github.PullRequest, env string) Trigger {
+	sha := pr.GetHead().GetSHA()
+
+	return Trigger{
+		SHA:        sha,
+		Provider:   ProviderGithub,
+		Repository: commentEvt.Repository.FullName,
+		Variables: map[string]string{
+			VariableCommitID:    sha,
+			VariableRef:         fmt.Sprintf("refs/pull/%d/head", pr.GetNumber()),
+			VariableBranch:      pr.GetHead().GetRef(),
+			VariableBaseBranch:  pr.GetBase().GetRef(),
+			VariablePusher:      commentEvt.Comment.User.Login,
+			VariablePRNumber:    strconv.Itoa(pr.GetNumber()),
+			VariableEnvironment: env,
+		},
+		Fields: log.Fields{
+			"pr_number":   pr.GetNumber(),
+			"environment": env,
+			"base_branch": pr.GetBase().GetRef(),
+			"head_commit": sha,
+			"commenter":   commentEvt.Comment.User.Login,
+		},
+	}
+}
+
+// deployReply lists the executions started by a deploy command
+func deployReply(env, sha string, executions []Execution) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Deploying `%s` to %s:\n", shortSHA(sha), env)
+	for _, execution := range executions {
+		if execution.Error != "" {
+			fmt.Fprintf(&sb, "\n- `%s` failed to start: %s", execution.PipelineName, execution.Error)
+			continue
+		}
+		if execution.CoalescedInto != "" {
+			fmt.Fprintf(&sb, "\n- `%s` is already building it in execution `%s`", execution.PipelineName, execution.CoalescedInto)
+			continue
+		}
+		fmt.Fprintf(&sb, "\n- `%s` execution `%s`", execution.PipelineName, execution.PipelineExecutionID)
+	}
+
+	return sb.String()
+}
+
+func shortSHA(sha string) string {
+	if len(sha) > 7 {
+		return sha[:7]
+	}
+	return sha
+}
+
+// reply comments on the pull request, errors are only logged
+func reply(ctx context.Context, svc Services, fullName string, number int, body string) {
+	owner, repo, ok := splitFullName(fullName)
+	if !ok {
+		log.Errorf("error in replying to pull request: invalid repository %s", fullName)
+		return
+	}
+
+	_, _, err := svc.Github.Issues.CreateComment(ctx, owner, repo, number, &github.IssueComment{
+		Body: github.String(body),
+	})
+	if err != nil {
+		log.WithFields(log.Fields{
+			"pr_number": number,
+		}).Errorf("error in replying to pull request: %v", err.Error())
+	}
+}
+
+// hasPermission reports whether the user has at least the permission on the repository
+// https://docs.github.com/en/rest/collaborators/collaborators#get-repository-permissions-for-a-user
+func hasPermission(ctx context.Context, client *github.Client, fullName, user, permission string) (bool, error) {
+	owner, repo, ok := splitFullName(fullName)
+	if !ok {
+		return false, fmt.Errorf("invalid repository %s", fullName)
+	}
+
+	level, _, err := client.Repositories.GetPermissionLevel(ctx, owner, repo, user)
+	if err != nil {
+		return false, err
+	}
+
+	return permissionLevels[level.GetPermission()] >= permissionLevels[permission], nil
+}
+
+func getPullRequest(ctx context.Context, client *github.Client, fullName string, number int) (*github.PullRequest, error) {
+	owner, repo, ok := splitFullName(fullName)
+	if !ok {
+		return nil, fmt.Errorf("invalid repository %s", fullName)
+	}
+
+	pr, _, err := client.PullRequests.Get(ctx, owner, repo, number)
+	return pr, err
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+const testDeployRoutes = `
+rules:
+  - name: prod
+    branch: main
+    pipeline: website-prod
+  - name: deploy-staging
+    event: deploy
+    environment: staging
+    branch: main
+    filters: ["src/"]
+    pipeline: website-staging
+    variables: true
+    source_action: Source
+`
+
+func TestParseDeployCommand(t *testing.T) {
+	tests := []struct {
+		body string
+		env  string
+		ok   bool
+	}{
+		{"/deploy staging", "staging", true},
+		{"  /deploy prod \r\nplease", "prod", true},
+		{"/deploy", "", false},
+		{"/deploy staging now", "", false},
+		{"please /deploy staging", "", false},
+		{"LGTM", "", false},
+	}
+
+	for _, tt := range tests {
+		env, ok := parseDeployCommand(tt.body)
+		if env != tt.env || ok != tt.ok {
+			t.Errorf("%q: expected %q %v, got %q %v", tt.body, tt.env, tt.ok, env, ok)
+		}
+	}
+}
+
+func TestHandleIssueComment(t *testing.T) {
+	permissions := map[string]string{"nkhine": "admin", "someone": "read"}
+	replies := []string{}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/repos/nkhine/khine.net/collaborators/", func(w http.ResponseWriter, r *http.Request) {
+		user := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/repos/nkhine/khine.net/collaborators/"), "/permission")
+		fmt.Fprintf(w, `{"permission":%q}`, permissions[user])
+	})
+	mux.HandleFunc("/repos/nkhine/khine.net/pulls/7", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"number":7,"head":{"ref":"feature","sha":"b2c3d4e5f6"},"base":{"ref":"main"}}`)
+	})
+	mux.HandleFunc("/repos/nkhine/khine.net/issues/7/comments", func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		comment := struct{ Body string }{}
+		json.Unmarshal(b, &comment)
+		replies = append(replies, comment.Body)
+		fmt.Fprint(w, `{"id":1}`)
+	})
+
+	config := testConfig(t, testDeployRoutes)
+	svc, cp := testServices()
+	svc.Github = newFakeGithub(t, mux)
+
+	comment := func(user, body string) IssueCommentEvent {
+		evt := IssueCommentEvent{Action: "created"}
+		evt.Issue.Number = 7
+		evt.Issue.PullRequest = &struct {
+			URL string `json:"url"`
+		}{}
+		evt.Comment.Body = body
+		evt.Comment.User.Login = user
+		evt.Repository.FullName = "nkhine/khine.net"
+		return evt
+	}
+
+	// Not a deploy command
+	resp, _ := handler(context.Background(), config, svc, newDelivery(t, "issue_comment", "", comment("nkhine", "LGTM")))
+	if resp.StatusCode != http.StatusOK || len(cp.started) != 0 || len(replies) != 0 {
+		t.Fatalf("expected the comment to be ignored, got %d %s", resp.StatusCode, resp.Body)
+	}
+
+	// Without the permission, refused without a reply
+	resp, _ = handler(context.Background(), config, svc, newDelivery(t, "issue_comment", "", comment("someone", "/deploy staging")))
+	if len(cp.started) != 0 || len(replies) != 0 || resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the deploy to be refused silently, got %v %s", replies, resp.Body)
+	}
+
+	resp, _ = handler(context.Background(), config, svc, newDelivery(t, "issue_comment", "d1", comment("nkhine", "/deploy staging")))
+	result := readResult(t, resp)
+	if len(cp.started) != 1 || *cp.started[0].Name != "website-staging" {
+		t.Fatalf("expected website-staging to be started, got %s", resp.Body)
+	}
+	input := cp.started[0]
+	if v := *input.SourceRevisions[0].RevisionValue; v != "b2c3d4e5f6" {
+		t.Errorf("expected the head commit to be deployed, got %s", v)
+	}
+	variables := map[string]string{}
+	for _, v := range input.Variables {
+		variables[*v.Name] = *v.Value
+	}
+	if variables[VariableEnvironment] != "staging" || variables[VariablePRNumber] != "7" {
+		t.Errorf("unexpected variables %v", variables)
+	}
+	want := "Deploying `b2c3d4e` to staging:\n\n- `website-staging` execution `execution-1`"
+	if len(replies) != 1 || replies[0] != want {
+		t.Errorf("expected reply %q, got %q", want, replies)
+	}
+	if len(result.Executions) != 1 || result.Executions[0].PipelineExecutionID != "execution-1" {
+		t.Errorf("unexpected result %s", resp.Body)
+	}
+
+	// A redelivery is not answered again
+	handler(context.Background(), config, svc, newDelivery(t, "issue_comment", "d1", comment("nkhine", "/deploy staging")))
+	if len(cp.started) != 1 || len(replies) != 1 {
+		t.Errorf("expected the redelivery to be ignored, got %v", replies)
+	}
+
+	// Unknown environment
+	handler(context.Background(), config, svc, newDelivery(t, "issue_comment", "", comment("nkhine", "/deploy prod")))
+	if len(cp.started) != 1 || len(replies) != 2 || !strings.Contains(replies[1], "no pipeline") {
+		t.Errorf("expected the unknown environment to be reported, got %v", replies)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"regexp"
+)
+
+type Decision string
+
+const (
+	// DecisionSkip does not start any pipeline
+	DecisionSkip Decision = "skip"
+	// DecisionForce starts the pipelines of the branch even if no file matches their filters
+	DecisionForce Decision = "force"
+)
+
+// Directive is a decision requested in a commit message, e.g. `[skip ci]`
+type Directive struct {
+	Decision Decision `json:"decision"`
+	// Match is the directive as written in the commit message
+	Match  string `json:"match"`
+	Commit string `json:"commit"`
+}
+
+var (
+	// [skip ci], [ci skip], [no ci], [skip deploy], [deploy skip], [no deploy]
+	skipDirective = regexp.MustCompile(`(?i)\[\s*(?:(?:skip|no)[\s-]+(?:ci|deploy)|(?:ci|deploy)[\s-]+skip)\s*\]`)
+	// [force deploy], [deploy force]
+	forceDirective = regexp.MustCompile(`(?i)\[\s*(?:force[\s-]+deploy|deploy[\s-]+force)\s*\]`)
+)
+
+// parseDirective looks for directives in the commit messages of the push.
+//
+// A force directive in any commit wins. Otherwise the push is skipped when the
+// head commit has a skip directive, or when every commit in the push has one.
+func parseDirective(push *PushEvent) *Directive {
+	commits := append([]Commit{push.HeadCommit}, push.Commits...)
+
+	for _, commit := range commits {
+		if m := forceDirective.FindString(commit.Message); m != "" {
+			return &Directive{Decision: DecisionForce, Match: m, Commit: commit.ID}
+		}
+	}
+
+	if m := skipDirective.FindString(push.HeadCommit.Message); m != "" {
+		return &Directive{Decision: DecisionSkip, Match: m, Commit: push.HeadCommit.ID}
+	}
+
+	if len(push.Commits) == 0 {
+		return nil
+	}
+	var first *Directive
+	for _, commit := range push.Commits {
+		m := skipDirective.FindString(commit.Message)
+		if m == "" {
+			return nil
+		}
+		if first == nil {
+			first = &Directive{Decision: DecisionSkip, Match: m, Commit: commit.ID}
+		}
+	}
+
+	return first
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestParseDirective(t *testing.T) {
+	tests := []struct {
+		name     string
+		head     string
+		messages []string
+		want     Decision
+		match    string
+	}{
+		{"none", "Update footer", []string{"Update footer"}, "", ""},
+		{"skip ci in head", "Fix typo [skip ci]", []string{"Update footer", "Fix typo [skip ci]"}, DecisionSkip, "[skip ci]"},
+		{"ci skip", "Fix typo [ci skip]", nil, DecisionSkip, "[ci skip]"},
+		{"skip deploy", "Docs [Skip Deploy]", nil, DecisionSkip, "[Skip Deploy]"},
+		{"no deploy", "Docs [no-deploy]", nil, DecisionSkip, "[no-deploy]"},
+		{"skip only in one commit", "Update footer", []string{"Docs [skip ci]", "Update footer"}, "", ""},
+		{"skip in every commit", "Docs again", []string{"Docs [skip ci]", "Docs [skip deploy]"}, DecisionSkip, "[skip ci]"},
+		{"force deploy", "Update config.yml [force deploy]", nil, DecisionForce, "[force deploy]"},
+		{"force in an earlier commit", "Update footer", []string{"Bump [deploy force]", "Update footer"}, DecisionForce, "[deploy force]"},
+		{"force wins over skip", "Docs [skip ci]", []string{"Config [force deploy]", "Docs [skip ci]"}, DecisionForce, "[force deploy]"},
+		{"not a directive", "Skip ci for docs", nil, "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			push := &PushEvent{HeadCommit: Commit{ID: "head", Message: tt.head}}
+			for _, m := range tt.messages {
+				push.Commits = append(push.Commits, Commit{Message: m})
+			}
+
+			got := parseDirective(push)
+			if tt.want == "" {
+				if got != nil {
+					t.Errorf("expected no directive, got %v", got)
+				}
+				return
+			}
+			if got == nil || got.Decision != tt.want || got.Match != tt.match {
+				t.Errorf("expected %s %s, got %v", tt.want, tt.match, got)
+			}
+		})
+	}
+}
+
+func TestHandlerDirectives(t *testing.T) {
+	config := testConfig(t, testRoutes)
+
+	// No rule matches README.md on main, forcing starts both pipelines of main
+	push := GithubEvent{
+		Ref:        "refs/heads/main",
+		HeadCommit: Commit{ID: "b2c3", Message: "Update README [force deploy]"},
+		Commits:    []Commit{{ID: "b2c3", Modified: []string{"README.md"}}},
+	}
+	svc, cp := testServices()
+	resp, _ := handler(context.Background(), config, svc, newDelivery(t, "push", "", push))
+	result := readResult(t, resp)
+	if len(cp.started) != 2 || result.Directive == nil || result.Directive.Decision != DecisionForce {
+		t.Errorf("expected a forced run of both main pipelines, got %s", resp.Body)
+	}
+
+	push.HeadCommit.Message = "Update src [skip deploy]"
+	push.Commits[0].Modified = []string{"src/config.ts"}
+	svc, cp = testServices()
+	resp, _ = handler(context.Background(), config, svc, newDelivery(t, "push", "", push))
+	result = readResult(t, resp)
+	if len(cp.started) != 0 || result.Directive == nil || result.Directive.Match != "[skip deploy]" {
+		t.Errorf("expected a skipped push, got %s", resp.Body)
+	}
+}
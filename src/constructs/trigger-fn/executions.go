@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// ExecutionRecord links a pipeline execution to the commit it was started for.
+// status-fn reads it to report the progress of the execution back to github.
+type ExecutionRecord struct {
+	ExecutionID string `dynamodbav:"pipeline_execution_id"`
+	Pipeline    string `dynamodbav:"pipeline_name"`
+	Provider    string `dynamodbav:"provider"`
+	Repository  string `dynamodbav:"repository"`
+	SHA         string `dynamodbav:"sha"`
+	Ref         string `dynamodbav:"ref"`
+	Rule        string `dynamodbav:"rule"`
+	// RequestedBy and Reason are set for the manual dispatches
+	RequestedBy string `dynamodbav:"requested_by,omitempty"`
+	Reason      string `dynamodbav:"reason,omitempty"`
+	ExpiresAt   int64  `dynamodbav:"expires_at"`
+}
+
+// ExecutionRecorder records the executions started by trigger-fn
+type ExecutionRecorder interface {
+	Record(ctx context.Context, record ExecutionRecord) error
+}
+
+// DynamoExecutionRecorder keeps the records in a dynamodb table with `pipeline_execution_id`
+// as the partition key and `expires_at` as the TTL attribute
+type DynamoExecutionRecorder struct {
+	Client    dynamodbiface.DynamoDBAPI
+	TableName string
+	TTL       time.Duration
+}
+
+func (r *DynamoExecutionRecorder) Record(ctx context.Context, record ExecutionRecord) error {
+	record.ExpiresAt = time.Now().Add(r.TTL).Unix()
+
+	item, err := dynamodbattribute.MarshalMap(record)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.Client.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(r.TableName),
+		Item:      item,
+	})
+	if err != nil {
+		return fmt.Errorf("error in recording execution %s: %v", record.ExecutionID, err.Error())
+	}
+
+	return nil
+}
+
+// MemoryExecutionRecorder keeps the records in memory, for tests and local runs
+type MemoryExecutionRecorder struct {
+	mu      sync.Mutex
+	Records []ExecutionRecord
+}
+
+func (r *MemoryExecutionRecorder) Record(ctx context.Context, record ExecutionRecord) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.Records = append(r.Records, record)
+	return nil
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// DryRunHeader asks trigger-fn to explain its decision instead of starting the pipelines.
+// The `dry_run` query parameter does the same. The request still has to be signed.
+const DryRunHeader = "x-trigger-dry-run"
+
+// Explanation is the decision trigger-fn takes for a delivery, returned in dry-run mode
+type Explanation struct {
+	Event       string `json:"event"`
+	Action      string `json:"action,omitempty"`
+	Environment string `json:"environment,omitempty"`
+	Repository  string `json:"repository,omitempty"`
+	Ref         string `json:"ref,omitempty"`
+	Branch      string `json:"branch,omitempty"`
+	// Reason is set when the delivery is ignored before the rules are evaluated
+	Reason       string         `json:"reason,omitempty"`
+	Files        []string       `json:"files"`
+	FilesUnknown bool           `json:"files_unknown,omitempty"`
+	Forced       bool           `json:"forced,omitempty"`
+	Lambdas      []string       `json:"lambdas,omitempty"`
+	Authors      []string       `json:"authors,omitempty"`
+	Bot          bool           `json:"bot,omitempty"`
+	Verified     bool           `json:"verified,omitempty"`
+	Rules        []RuleDecision `json:"rules"`
+	// RoutesFile is set when the rules come from the repository, see RepoRoutes
+	RoutesFile string `json:"routes_file,omitempty"`
+	// Pipelines that would be started
+	Pipelines []string `json:"pipelines"`
+}
+
+// RuleDecision explains why a rule matches the change or not
+type RuleDecision struct {
+	Rule     string `json:"rule"`
+	Pipeline string `json:"pipeline"`
+	Matched  bool   `json:"matched"`
+	Reason   string `json:"reason"`
+	// Files maps the changed files selected by the filters of the rule to the filter selecting them
+	Files map[string]string `json:"files,omitempty"`
+	// Lambdas are the affected lambdas selected by the rule
+	Lambdas []string `json:"lambdas,omitempty"`
+}
+
+// isDryRun reports whether the request asks for a dry run
+func isDryRun(evt events.LambdaFunctionURLRequest) bool {
+	for _, v := range []string{evt.Headers[DryRunHeader], evt.QueryStringParameters["dry_run"]} {
+		if dryRun, err := strconv.ParseBool(v); err == nil && dryRun {
+			return true
+		}
+	}
+	return false
+}
+
+// Explain evaluates every rule against the change
+func (routes *Routes) Explain(change Change) Explanation {
+	explanation := Explanation{
+		Event:        change.Event,
+		Action:       change.Action,
+		Environment:  change.Environment,
+		Repository:   change.Repository,
+		Branch:       change.Branch,
+		Files:        change.Files,
+		FilesUnknown: change.FilesUnknown,
+		Forced:       change.Force,
+		Lambdas:      change.Lambdas,
+		Authors:      change.Authors,
+		Bot:          change.Bot,
+		Verified:     change.Verified,
+		Rules:        []RuleDecision{},
+		RoutesFile:   routes.Source,
+		Pipelines:    []string{},
+	}
+
+	started := map[string]bool{}
+	for _, rule := range routes.Rules {
+		decision := rule.Explain(change)
+		explanation.Rules = append(explanation.Rules, decision)
+
+		if decision.Matched && !started[rule.Pipeline] {
+			started[rule.Pipeline] = true
+			explanation.Pipelines = append(explanation.Pipelines, rule.Pipeline)
+		}
+	}
+
+	return explanation
+}
+
+// Explain evaluates the rule against the change, see Rule.Match
+func (rule Rule) Explain(change Change) RuleDecision {
+	decision := RuleDecision{
+		Rule:     rule.Name,
+		Pipeline: rule.Pipeline,
+	}
+
+	switch {
+	case rule.Event != change.Event:
+		decision.Reason = "rule is for " + rule.Event + " events"
+		return decision
+	case rule.Event == "pull_request" && !contains(rule.Actions, change.Action):
+		decision.Reason = "rule is not for " + change.Action + " pull requests"
+		return decision
+	case rule.Event == "deploy" && rule.Environment != change.Environment:
+		decision.Reason = "rule is for the " + rule.Environment + " environment"
+		return decision
+	case rule.repository != nil && !rule.repository.MatchString(strings.ToLower(change.Repository)):
+		decision.Reason = "repository does not match " + rule.Repository
+		return decision
+	case !rule.branch.MatchString(change.Branch):
+		decision.Reason = "branch does not match " + rule.Branch
+		return decision
+	}
+
+	if reason := rule.Authors.Check(change); reason != "" {
+		decision.Reason = reason
+		return decision
+	}
+	if rule.RequireVerified && !change.Verified {
+		decision.Reason = "head commit is not verified"
+		return decision
+	}
+
+	switch {
+	case change.Event == "deploy":
+		decision.Matched = true
+		decision.Reason = "deploy command"
+		return decision
+	case change.Force:
+		decision.Matched = true
+		decision.Reason = "forced by a directive"
+		return decision
+	case change.FilesUnknown:
+		decision.Matched = true
+		decision.Reason = "changed files are unknown, filters are not applied"
+		return decision
+	case len(rule.filters) == 0 && len(rule.lambdas) == 0:
+		decision.Matched = true
+		decision.Reason = "rule does not have filters"
+		return decision
+	}
+
+	for _, lambda := range change.Lambdas {
+		if rule.lambdas.Match(lambda) {
+			decision.Lambdas = append(decision.Lambdas, lambda)
+		}
+	}
+
+	for _, file := range change.Files {
+		matched, filter := rule.filters.Decide(file)
+		if !matched {
+			continue
+		}
+		if decision.Files == nil {
+			decision.Files = map[string]string{}
+		}
+		// A file is selected without a filter when the first filter is an exclusion
+		pattern := ""
+		if filter != nil {
+			pattern = filter.Pattern
+		}
+		decision.Files[file] = pattern
+	}
+
+	decision.Matched = len(decision.Files) > 0 || len(decision.Lambdas) > 0
+	switch {
+	case len(decision.Files) > 0:
+		decision.Reason = "changed files match the filters"
+	case len(decision.Lambdas) > 0:
+		decision.Reason = "changed files affect the lambdas"
+	case len(rule.lambdas) == 0:
+		decision.Reason = "no changed file matches the filters"
+	case len(rule.filters) == 0:
+		decision.Reason = "no changed file affects the lambdas"
+	default:
+		decision.Reason = "no changed file matches the filters or affects the lambdas"
+	}
+
+	return decision
+}
+
+// skipped explains a delivery ignored before the rules are evaluated, nil outside of a dry run
+func skipped(dryRun bool, event, ref, reason string) *Explanation {
+	if !dryRun {
+		return nil
+	}
+
+	return &Explanation{
+		Event:     event,
+		Ref:       ref,
+		Reason:    reason,
+		Files:     []string{},
+		Rules:     []RuleDecision{},
+		Pipelines: []string{},
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestRuleExplain(t *testing.T) {
+	routes, err := parseRoutes([]byte(testRoutes))
+	if err != nil {
+		t.Fatalf("error in parsing routes: %v", err)
+	}
+
+	explanation := routes.Explain(Change{
+		Event:  "push",
+		Branch: "main",
+		Files:  []string{"src/config.ts", "docs/diagram.dot", "README.md"},
+	})
+
+	if !reflect.DeepEqual(explanation.Pipelines, []string{"website-prod", "website-docs"}) {
+		t.Errorf("unexpected pipelines %v", explanation.Pipelines)
+	}
+
+	want := []RuleDecision{
+		{
+			Rule: "prod", Pipeline: "website-prod", Matched: true,
+			Reason: "changed files match the filters",
+			Files:  map[string]string{"src/config.ts": "src/"},
+		},
+		{
+			Rule: "staging", Pipeline: "website-staging",
+			Reason: "branch does not match release/*",
+		},
+		{
+			Rule: "docs", Pipeline: "website-docs", Matched: true,
+			Reason: "changed files match the filters",
+			Files:  map[string]string{"docs/diagram.dot": "docs/**"},
+		},
+	}
+	if !reflect.DeepEqual(explanation.Rules, want) {
+		t.Errorf("expected %+v, got %+v", want, explanation.Rules)
+	}
+}
+
+func TestHandlerDryRun(t *testing.T) {
+	config := testConfig(t, testRoutes)
+	svc, cp := testServices()
+
+	push := GithubEvent{
+		Ref:     "refs/heads/main",
+		Commits: []Commit{{Modified: []string{"src/config.ts"}}},
+	}
+
+	evt := newDelivery(t, "push", "72d3162e", push)
+	evt.Headers[DryRunHeader] = "true"
+	resp, _ := handler(context.Background(), config, svc, evt)
+	result := readResult(t, resp)
+	if resp.StatusCode != http.StatusOK || !result.DryRun || result.Explanation == nil {
+		t.Fatalf("expected an explanation, got %d %s", resp.StatusCode, resp.Body)
+	}
+	if !reflect.DeepEqual(result.Explanation.Pipelines, []string{"website-prod"}) || len(cp.started) != 0 {
+		t.Errorf("expected website-prod to be explained but not started, got %s", resp.Body)
+	}
+
+	// The dry run did not claim the delivery
+	delete(evt.Headers, DryRunHeader)
+	evt.QueryStringParameters = map[string]string{"dry_run": "1"}
+	resp, _ = handler(context.Background(), config, svc, evt)
+	if result := readResult(t, resp); !result.DryRun || len(cp.started) != 0 {
+		t.Errorf("expected a dry run from the query parameter, got %s", resp.Body)
+	}
+
+	evt.QueryStringParameters = nil
+	resp, _ = handler(context.Background(), config, svc, evt)
+	if result := readResult(t, resp); result.DryRun || result.Duplicate || len(cp.started) != 1 {
+		t.Errorf("expected the delivery to start website-prod, got %s", resp.Body)
+	}
+
+	// Unsigned dry runs are rejected like any other request
+	evt = newDelivery(t, "push", "", push)
+	evt.Headers[DryRunHeader] = "true"
+	delete(evt.Headers, SignatureHeader)
+	resp, _ = handler(context.Background(), config, svc, evt)
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected 401, got %d", resp.StatusCode)
+	}
+}
+
+func TestHandlerDryRunSkipped(t *testing.T) {
+	config := testConfig(t, testRoutes)
+	svc, _ := testServices()
+
+	push := GithubEvent{
+		Ref:        "refs/heads/main",
+		HeadCommit: Commit{ID: "b2c3", Message: "Update src [skip ci]"},
+		Commits:    []Commit{{ID: "b2c3", Modified: []string{"src/config.ts"}}},
+	}
+	evt := newDelivery(t, "push", "", push)
+	evt.Headers[DryRunHeader] = "true"
+
+	resp, _ := handler(context.Background(), config, svc, evt)
+	result := readResult(t, resp)
+	if result.Explanation == nil || result.Explanation.Reason != "skipped by a directive" || result.Directive == nil {
+		t.Errorf("expected the skip directive to be explained, got %s", resp.Body)
+	}
+}
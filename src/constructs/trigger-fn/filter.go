@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Filter is a single entry of the `FILTERS` list.
+//
+// The syntax is close to .gitignore,
+//
+//	src/lambda        plain prefix, matches every file starting with it
+//	src/**/*.go       glob, `*` and `?` stop at `/` while `**` matches across directories
+//	*.go              glob without a `/`, matched against the file name only
+//	!docs/**          exclusion, un-matches the files matched by an earlier filter
+//
+// Filters are evaluated in order and the last one matching a file wins. When the
+// first filter is an exclusion every file starts out as matched.
+type Filter struct {
+	Pattern string
+	Negate  bool
+
+	prefix string
+	re     *regexp.Regexp
+}
+
+type Filters []Filter
+
+// parseFilters compiles the raw filters, ignoring blank entries
+func parseFilters(raw []string) (Filters, error) {
+	filters := Filters{}
+	for _, r := range raw {
+		r = strings.TrimSpace(r)
+		if r == "" {
+			continue
+		}
+
+		f, err := parseFilter(r)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, *f)
+	}
+
+	return filters, nil
+}
+
+func parseFilter(raw string) (*Filter, error) {
+	f := &Filter{Pattern: raw}
+
+	pattern := raw
+	if strings.HasPrefix(pattern, "!") {
+		f.Negate = true
+		pattern = strings.TrimPrefix(pattern, "!")
+	}
+	pattern = strings.TrimPrefix(pattern, "/")
+	if pattern == "" {
+		return nil, fmt.Errorf("invalid filter %q", raw)
+	}
+
+	if !strings.ContainsAny(pattern, "*?") {
+		// Plain prefix, the behaviour before globs were supported
+		f.prefix = pattern
+		return f, nil
+	}
+
+	// A glob without any `/` is matched against the file name in every directory
+	if !strings.Contains(pattern, "/") {
+		pattern = "**/" + pattern
+	}
+
+	re, err := compileGlob(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid filter %q: %v", raw, err.Error())
+	}
+	f.re = re
+
+	return f, nil
+}
+
+// compileGlob converts a glob into an anchored regular expression
+func compileGlob(glob string) (*regexp.Regexp, error) {
+	var sb strings.Builder
+	sb.WriteString("^")
+
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch {
+		case c == '*' && strings.HasPrefix(glob[i:], "**/"):
+			// Zero or more directories
+			sb.WriteString("(?:.*/)?")
+			i += 2
+		case c == '*' && strings.HasPrefix(glob[i:], "**"):
+			sb.WriteString(".*")
+			i++
+		case c == '*':
+			sb.WriteString("[^/]*")
+		case c == '?':
+			sb.WriteString("[^/]")
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	sb.WriteString("$")
+
+	return regexp.Compile(sb.String())
+}
+
+func (f Filter) matches(file string) bool {
+	if f.re == nil {
+		return strings.HasPrefix(file, f.prefix)
+	}
+	return f.re.MatchString(path.Clean(file))
+}
+
+// Match reports whether the file is selected by the filters
+func (filters Filters) Match(file string) bool {
+	matched, _ := filters.Decide(file)
+	return matched
+}
+
+// Decide reports whether the file is selected by the filters, and the filter deciding it.
+// The filter is nil when no filter matches the file.
+func (filters Filters) Decide(file string) (bool, *Filter) {
+	matched := len(filters) > 0 && filters[0].Negate
+	var decided *Filter
+	for i, f := range filters {
+		if f.matches(file) {
+			matched = !f.Negate
+			decided = &filters[i]
+		}
+	}
+
+	return matched, decided
+}
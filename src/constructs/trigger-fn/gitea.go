@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+)
+
+const (
+	GiteaEventHeader     = "x-gitea-event"
+	GiteaSignatureHeader = "x-gitea-signature"
+	GiteaDeliveryHeader  = "x-gitea-delivery"
+)
+
+// GiteaPushEvent is the payload of a gitea `push` event, close to the github one
+// https://docs.gitea.com/usage/webhooks
+type GiteaPushEvent struct {
+	Ref        string `json:"ref"`
+	Before     string `json:"before"`
+	After      string `json:"after"`
+	Repository struct {
+		FullName      string `json:"full_name"`
+		DefaultBranch string `json:"default_branch"`
+	} `json:"repository"`
+	Pusher struct {
+		Login    string `json:"login"`
+		Username string `json:"username"`
+	} `json:"pusher"`
+	// Commits are capped by the server, the total is in TotalCommits
+	Commits      []Commit `json:"commits"`
+	TotalCommits int      `json:"total_commits"`
+	HeadCommit   *Commit  `json:"head_commit"`
+}
+
+// GiteaProvider handles the deliveries of gitea, signed with a hex HMAC-SHA256 of the body
+type GiteaProvider struct{}
+
+func (GiteaProvider) Name() string {
+	return ProviderGitea
+}
+
+func (GiteaProvider) Detect(headers map[string]string) bool {
+	return headers[GiteaEventHeader] != ""
+}
+
+func (GiteaProvider) Verify(secret []byte, headers map[string]string, body []byte) error {
+	return validateHMAC(secret, headers[GiteaSignatureHeader], body)
+}
+
+func (GiteaProvider) Event(headers map[string]string) string {
+	return headers[GiteaEventHeader]
+}
+
+func (GiteaProvider) DeliveryID(headers map[string]string) string {
+	return headers[GiteaDeliveryHeader]
+}
+
+func (GiteaProvider) ParsePush(body []byte) (*PushEvent, error) {
+	gtEvt := GiteaPushEvent{}
+	err := json.Unmarshal(body, &gtEvt)
+	if err != nil {
+		return nil, err
+	}
+
+	pusher := gtEvt.Pusher.Login
+	if pusher == "" {
+		pusher = gtEvt.Pusher.Username
+	}
+
+	push := &PushEvent{
+		Provider:      ProviderGitea,
+		Ref:           gtEvt.Ref,
+		Before:        gtEvt.Before,
+		After:         gtEvt.After,
+		Created:       gtEvt.Before == ZeroSHA,
+		Deleted:       gtEvt.After == ZeroSHA,
+		Repository:    gtEvt.Repository.FullName,
+		DefaultBranch: gtEvt.Repository.DefaultBranch,
+		Pusher:        pusher,
+		Commits:       gtEvt.Commits,
+		HeadCommit:    Commit{ID: gtEvt.After},
+	}
+	if gtEvt.HeadCommit != nil {
+		push.HeadCommit = *gtEvt.HeadCommit
+	}
+
+	push.Truncated = push.Created ||
+		len(gtEvt.Commits) == 0 ||
+		gtEvt.TotalCommits > len(gtEvt.Commits)
+
+	return push, nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/google/go-github/github"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+)
+
+// ZeroSHA is sent as `before` when a branch is created and as `after` when it is deleted
+const ZeroSHA = "0000000000000000000000000000000000000000"
+
+// MaxPushCommits is the most commits github includes in a push payload
+const MaxPushCommits = 20
+
+// MaxCompareFiles is the most files github lists in a comparison
+const MaxCompareFiles = 300
+
+type Token struct {
+	PersonalAccessToken string
+}
+
+func (t *Token) Token() (*oauth2.Token, error) {
+	token := &oauth2.Token{
+		AccessToken: t.PersonalAccessToken,
+	}
+	return token, nil
+}
+
+// newGithubClient returns nil when there is no token, the features using the api are then disabled
+func newGithubClient(ctx context.Context, config Config) (*github.Client, error) {
+	if config.GithubToken == "" {
+		return nil, nil
+	}
+
+	client := github.NewClient(oauth2.NewClient(ctx, &Token{
+		PersonalAccessToken: config.GithubToken,
+	}))
+
+	if config.GithubAPIURL != "" {
+		baseURL, err := url.Parse(strings.TrimSuffix(config.GithubAPIURL, "/") + "/")
+		if err != nil {
+			return nil, fmt.Errorf("invalid github api url %s: %v", config.GithubAPIURL, err.Error())
+		}
+		client.BaseURL = baseURL
+	}
+
+	return client, nil
+}
+
+// splitFullName splits `owner/repo`
+func splitFullName(fullName string) (string, string, bool) {
+	owner, repo, ok := strings.Cut(fullName, "/")
+	return owner, repo, ok && owner != "" && repo != ""
+}
+
+// isTruncated reports whether the commits in the push do not carry the full list of changed files.
+// Github caps the commits at 20 and does not list the files of new branches or force pushes.
+func isTruncated(ghEvt GithubEvent) bool {
+	return ghEvt.Before == ZeroSHA ||
+		ghEvt.Created ||
+		ghEvt.Forced ||
+		len(ghEvt.Commits) == 0 ||
+		len(ghEvt.Commits) >= MaxPushCommits
+}
+
+// pushFiles returns the files changed by the push. The commits in the payload are used
+// unless they are truncated, then the changes of a github push are read from the compare api.
+// It reports false when the comparison is too large for github to list every file.
+func pushFiles(ctx context.Context, client *github.Client, push *PushEvent, branch string) ([]string, bool) {
+	files := changedFiles(push.Commits)
+	if !push.Truncated {
+		return files, true
+	}
+
+	fields := log.Fields{
+		"provider":    push.Provider,
+		"repo":        push.Repository,
+		"branch":      branch,
+		"before":      push.Before,
+		"after":       push.After,
+		"commits":     len(push.Commits),
+		"payload_len": len(files),
+	}
+
+	if push.Provider != ProviderGithub {
+		log.WithFields(fields).Warnln("push payload is truncated, using the files in the payload")
+		return files, true
+	}
+	if client == nil {
+		log.WithFields(fields).Warnln("push payload is truncated but there is no github token, using the files in the payload")
+		return files, true
+	}
+
+	// A new branch is compared to the default branch
+	base := push.Before
+	if base == ZeroSHA {
+		base = push.DefaultBranch
+	}
+	if base == "" || base == branch {
+		log.WithFields(fields).Warnln("push payload is truncated but there is nothing to compare with, using the files in the payload")
+		return files, true
+	}
+
+	owner, repo, _ := splitFullName(push.Repository)
+	compared, complete, err := compareFiles(ctx, client, owner, repo, base, push.After)
+	if err != nil {
+		log.WithFields(fields).Errorf("error in comparing commits, using the files in the payload: %v", err.Error())
+		return files, true
+	}
+	if !complete {
+		log.WithFields(fields).WithField("compare_len", len(compared)).Warnln("comparison is too large to list every changed file, the filters of the rules are not applied")
+		return compared, false
+	}
+
+	log.WithFields(fields).WithField("compare_len", len(compared)).Infoln("read changed files from the compare api")
+
+	return compared, true
+}
+
+// comparison is the part of the compare api response trigger-fn needs.
+// `previous_filename` is missing from the go-github types.
+type comparison struct {
+	TotalCommits int               `json:"total_commits"`
+	Commits      []json.RawMessage `json:"commits"`
+	Files        []struct {
+		Filename         string `json:"filename"`
+		PreviousFilename string `json:"previous_filename"`
+	} `json:"files"`
+}
+
+// compareFiles lists the files changed between base and head. The api paginates the commits,
+// not the files, which are all on the first page up to MaxCompareFiles. It reports false when
+// the files may be cut off, github then leaves out files past the cap.
+// https://docs.github.com/en/rest/commits/commits#compare-two-commits
+func compareFiles(ctx context.Context, client *github.Client, owner, repo, base, head string) ([]string, bool, error) {
+	files := []string{}
+	seen := map[string]bool{}
+	add := func(file string) {
+		if file != "" && !seen[file] {
+			seen[file] = true
+			files = append(files, file)
+		}
+	}
+
+	u := fmt.Sprintf("repos/%v/%v/compare/%v...%v", owner, repo, url.PathEscape(base), url.PathEscape(head))
+	req, err := client.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, false, err
+	}
+
+	c := comparison{}
+	_, err = client.Do(ctx, req, &c)
+	if err != nil {
+		return nil, false, err
+	}
+
+	for _, f := range c.Files {
+		// A rename changes both paths
+		add(f.Filename)
+		add(f.PreviousFilename)
+	}
+
+	complete := len(c.Files) < MaxCompareFiles && c.TotalCommits <= len(c.Commits)
+	return files, complete, nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/go-github/github"
+)
+
+// newFakeGithub starts a server standing in for the github api and a client talking to it
+func newFakeGithub(t *testing.T, mux *http.ServeMux) *github.Client {
+	t.Helper()
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	client, err := newGithubClient(context.Background(), Config{
+		GithubToken:  "token",
+		GithubAPIURL: server.URL,
+	})
+	if err != nil {
+		t.Fatalf("error in creating github client: %v", err)
+	}
+	return client
+}
+
+func TestPushFilesFromCompareAPI(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/repos/nkhine/khine.net/compare/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/repos/nkhine/khine.net/compare/main...b2c3" {
+			t.Errorf("unexpected compare %s", r.URL.Path)
+		}
+		fmt.Fprint(w, `{"total_commits": 2, "commits": [{}, {}], "files": [
+			{"filename": "src/config.ts"}, {"filename": "docs/new.md", "previous_filename": "docs/old.md"}, {"filename": "src/cicd.ts"}]}`)
+	})
+	client := newFakeGithub(t, mux)
+
+	// A new branch without the files in the payload
+	push := &PushEvent{
+		Provider:      ProviderGithub,
+		Ref:           "refs/heads/feature",
+		Before:        ZeroSHA,
+		After:         "b2c3",
+		Created:       true,
+		Repository:    "nkhine/khine.net",
+		DefaultBranch: "main",
+		Truncated:     true,
+	}
+
+	got, complete := pushFiles(context.Background(), client, push, "feature")
+	want := []string{"src/config.ts", "docs/new.md", "docs/old.md", "src/cicd.ts"}
+	if !reflect.DeepEqual(got, want) || !complete {
+		t.Errorf("expected %v, got %v %v", want, got, complete)
+	}
+}
+
+func TestPushFilesCappedComparison(t *testing.T) {
+	files := make([]string, MaxCompareFiles)
+	for i := range files {
+		files[i] = fmt.Sprintf(`{"filename": "docs/%d.md"}`, i)
+	}
+
+	for name, body := range map[string]string{
+		"files":   `{"total_commits": 1, "commits": [{}], "files": [` + strings.Join(files, ",") + `]}`,
+		"commits": `{"total_commits": 300, "commits": [{}], "files": [{"filename": "docs/0.md"}]}`,
+	} {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/repos/nkhine/khine.net/compare/", func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, body)
+		})
+		push := &PushEvent{
+			Provider:   ProviderGithub,
+			Ref:        "refs/heads/main",
+			Before:     "a1b2",
+			After:      "b2c3",
+			Forced:     true,
+			Repository: "nkhine/khine.net",
+			Truncated:  true,
+		}
+
+		if _, complete := pushFiles(context.Background(), newFakeGithub(t, mux), push, "main"); complete {
+			t.Errorf("%s: expected the capped comparison to be incomplete", name)
+		}
+	}
+}
+
+func TestPushFilesFromPayload(t *testing.T) {
+	push := &PushEvent{
+		Provider: ProviderGithub,
+		Ref:      "refs/heads/main",
+		Before:   "a1b2",
+		After:    "b2c3",
+		Commits:  []Commit{{Added: []string{"src/config.ts"}}},
+	}
+
+	// Not truncated, the api is not called
+	got, _ := pushFiles(context.Background(), nil, push, "main")
+	if !reflect.DeepEqual(got, []string{"src/config.ts"}) {
+		t.Errorf("expected the files in the payload, got %v", got)
+	}
+
+	// Truncated, but there is no token
+	push.Truncated = true
+	got, _ = pushFiles(context.Background(), nil, push, "main")
+	if !reflect.DeepEqual(got, []string{"src/config.ts"}) {
+		t.Errorf("expected the files in the payload, got %v", got)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+)
+
+const (
+	GitlabEventHeader    = "x-gitlab-event"
+	GitlabTokenHeader    = "x-gitlab-token"
+	GitlabDeliveryHeader = "x-gitlab-event-uuid"
+)
+
+// GitlabPushEvent is the payload of a `Push Hook`
+// https://docs.gitlab.com/ee/user/project/integrations/webhook_events.html#push-events
+type GitlabPushEvent struct {
+	ObjectKind   string `json:"object_kind"`
+	Ref          string `json:"ref"`
+	Before       string `json:"before"`
+	After        string `json:"after"`
+	CheckoutSHA  string `json:"checkout_sha"`
+	UserName     string `json:"user_name"`
+	UserUsername string `json:"user_username"`
+	Project      struct {
+		ID                int    `json:"id"`
+		PathWithNamespace string `json:"path_with_namespace"`
+		DefaultBranch     string `json:"default_branch"`
+	} `json:"project"`
+	// Commits are capped at 20, the total is in TotalCommitsCount
+	Commits           []Commit `json:"commits"`
+	TotalCommitsCount int      `json:"total_commits_count"`
+}
+
+// GitlabProvider handles the deliveries of gitlab, authenticated with the secret token of the webhook
+// https://docs.gitlab.com/ee/user/project/integrations/webhooks.html
+type GitlabProvider struct{}
+
+func (GitlabProvider) Name() string {
+	return ProviderGitlab
+}
+
+func (GitlabProvider) Detect(headers map[string]string) bool {
+	return headers[GitlabEventHeader] != ""
+}
+
+func (GitlabProvider) Verify(secret []byte, headers map[string]string, body []byte) error {
+	return validateToken(secret, headers[GitlabTokenHeader])
+}
+
+func (GitlabProvider) Event(headers map[string]string) string {
+	v := headers[GitlabEventHeader]
+	if v == "Push Hook" {
+		return "push"
+	}
+	return v
+}
+
+func (GitlabProvider) DeliveryID(headers map[string]string) string {
+	return headers[GitlabDeliveryHeader]
+}
+
+func (GitlabProvider) ParsePush(body []byte) (*PushEvent, error) {
+	glEvt := GitlabPushEvent{}
+	err := json.Unmarshal(body, &glEvt)
+	if err != nil {
+		return nil, err
+	}
+
+	push := &PushEvent{
+		Provider:      ProviderGitlab,
+		Ref:           glEvt.Ref,
+		Before:        glEvt.Before,
+		After:         glEvt.After,
+		Created:       glEvt.Before == ZeroSHA,
+		Deleted:       glEvt.After == ZeroSHA,
+		Repository:    glEvt.Project.PathWithNamespace,
+		DefaultBranch: glEvt.Project.DefaultBranch,
+		Pusher:        glEvt.UserUsername,
+		Commits:       glEvt.Commits,
+		HeadCommit:    Commit{ID: glEvt.After},
+	}
+
+	// The commits are oldest first, the head is the last one
+	for _, commit := range glEvt.Commits {
+		if commit.ID == glEvt.After {
+			push.HeadCommit = commit
+		}
+	}
+
+	push.Truncated = push.Created ||
+		len(glEvt.Commits) == 0 ||
+		glEvt.TotalCommitsCount > len(glEvt.Commits)
+
+	return push, nil
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultGithubAPIURL is used when GITHUB_API_URL is not set
+const DefaultGithubAPIURL = "https://api.github.com"
+
+// MetaRetryBackoff is how long the guard waits after a failed refresh, doubled after every
+// consecutive failure up to the TTL, so that e.g. a rate limited meta api is not called on every request
+const MetaRetryBackoff = time.Minute
+
+// fallbackMeta is a copy of the meta api response, used until the ranges are fetched
+// or when the api can not be reached
+//
+//go:embed hooks.json
+var fallbackMeta []byte
+
+// githubMeta is the part of the meta api response trigger-fn needs
+// https://docs.github.com/en/rest/meta/meta#get-github-meta-information
+type githubMeta struct {
+	Hooks []string `json:"hooks"`
+}
+
+// IPGuard only lets through the requests sent from the `hooks` ranges of github.
+// The ranges are read from the meta api and refreshed in the background once they are older than TTL.
+// A failed refresh is retried after a backoff, see MetaRetryBackoff.
+type IPGuard struct {
+	MetaURL string
+	TTL     time.Duration
+	Client  *http.Client
+	// Extra ranges are always allowed, e.g. a self hosted gitea
+	Extra []netip.Prefix
+
+	mu         sync.RWMutex
+	hooks      []netip.Prefix
+	fetchedAt  time.Time
+	refreshing bool
+	// retryAt is when the next refresh is allowed after failed refreshes
+	retryAt  time.Time
+	failures int
+}
+
+// newIPGuard returns nil when the guard is disabled.
+// It starts with the embedded ranges, they are stale until the first refresh.
+func newIPGuard(config Config) (*IPGuard, error) {
+	if !config.SourceIPGuard {
+		return nil, nil
+	}
+
+	apiURL := config.GithubAPIURL
+	if apiURL == "" {
+		apiURL = DefaultGithubAPIURL
+	}
+
+	extra, err := parsePrefixes(strings.Split(config.SourceCIDRs_, ","))
+	if err != nil {
+		return nil, err
+	}
+
+	hooks, err := parseMeta(fallbackMeta)
+	if err != nil {
+		return nil, err
+	}
+
+	return &IPGuard{
+		MetaURL: strings.TrimSuffix(apiURL, "/") + "/meta",
+		TTL:     config.MetaTTL,
+		Client:  &http.Client{Timeout: 5 * time.Second},
+		Extra:   extra,
+		hooks:   hooks,
+	}, nil
+}
+
+// Allowed reports whether the source ip is in the hooks or extra ranges.
+// Stale ranges are still used while they are refreshed.
+func (g *IPGuard) Allowed(sourceIP string) bool {
+	addr, err := netip.ParseAddr(sourceIP)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+
+	g.mu.Lock()
+	if time.Since(g.fetchedAt) > g.TTL && !g.refreshing && time.Now().After(g.retryAt) {
+		g.refreshing = true
+		go func() {
+			err := g.Refresh(context.Background())
+			if err != nil {
+				log.Warnf("error in refreshing github hook ranges, keeping the previous ones: %v", err.Error())
+			}
+		}()
+	}
+	hooks := g.hooks
+	g.mu.Unlock()
+
+	for _, ranges := range [][]netip.Prefix{hooks, g.Extra} {
+		for _, prefix := range ranges {
+			if prefix.Contains(addr) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Refresh fetches the hooks ranges from the meta api. After a failure the next
+// background refresh waits for the backoff.
+func (g *IPGuard) Refresh(ctx context.Context) error {
+	hooks, err := g.fetch(ctx)
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.refreshing = false
+	if err != nil {
+		backoff := MetaRetryBackoff << g.failures
+		if backoff >= g.TTL {
+			backoff = g.TTL
+		} else {
+			g.failures++
+		}
+		g.retryAt = time.Now().Add(backoff)
+		return err
+	}
+
+	g.hooks = hooks
+	g.fetchedAt = time.Now()
+	g.failures = 0
+	g.retryAt = time.Time{}
+
+	log.WithField("ranges", len(hooks)).Infoln("refreshed github hook ranges")
+
+	return nil
+}
+
+// fetch reads the hooks ranges from the meta api
+func (g *IPGuard) fetch(ctx context.Context) ([]netip.Prefix, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, g.MetaURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+
+	resp, err := g.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("meta api returned %d", resp.StatusCode)
+	}
+
+	meta := githubMeta{}
+	err = json.NewDecoder(resp.Body).Decode(&meta)
+	if err != nil {
+		return nil, err
+	}
+	hooks, err := parsePrefixes(meta.Hooks)
+	if err != nil {
+		return nil, err
+	}
+	if len(hooks) == 0 {
+		return nil, fmt.Errorf("meta api did not return any hooks ranges")
+	}
+
+	return hooks, nil
+}
+
+func parseMeta(b []byte) ([]netip.Prefix, error) {
+	meta := githubMeta{}
+	err := json.Unmarshal(b, &meta)
+	if err != nil {
+		return nil, err
+	}
+	return parsePrefixes(meta.Hooks)
+}
+
+// parsePrefixes parses CIDRs, a single address is a range of one. Blank entries are ignored.
+func parsePrefixes(raw []string) ([]netip.Prefix, error) {
+	prefixes := []netip.Prefix{}
+	for _, s := range raw {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+
+		if !strings.Contains(s, "/") {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid source range %s: %v", s, err.Error())
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid source range %s: %v", s, err.Error())
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+
+	return prefixes, nil
+}
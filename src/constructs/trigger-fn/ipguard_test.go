@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newFakeMeta serves the meta api with the given hooks ranges
+func newFakeMeta(t *testing.T, hooks string) (*httptest.Server, *int) {
+	t.Helper()
+
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/meta" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		calls++
+		fmt.Fprintf(w, `{"hooks": [%s], "web": ["192.0.2.0/24"]}`, hooks)
+	}))
+	t.Cleanup(server.Close)
+
+	return server, &calls
+}
+
+func TestIPGuardFallback(t *testing.T) {
+	// Nothing listens there, the embedded ranges are used
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+
+	guard, err := newIPGuard(Config{
+		SourceIPGuard: true,
+		SourceCIDRs_:  "203.0.113.7, 198.51.100.0/24",
+		GithubAPIURL:  server.URL,
+		MetaTTL:       time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := guard.Refresh(context.Background()); err == nil {
+		t.Errorf("expected an error from the closed server")
+	}
+
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"140.82.115.10", true},
+		{"::ffff:140.82.115.10", true},
+		{"2a0a:a440::1", true},
+		{"203.0.113.7", true},
+		{"203.0.113.8", false},
+		{"198.51.100.42", true},
+		{"8.8.8.8", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := guard.Allowed(tt.ip); got != tt.want {
+			t.Errorf("expected %v for %q, got %v", tt.want, tt.ip, got)
+		}
+	}
+}
+
+func TestIPGuardRefresh(t *testing.T) {
+	server, calls := newFakeMeta(t, `"198.51.100.0/24"`)
+
+	guard, err := newIPGuard(Config{SourceIPGuard: true, GithubAPIURL: server.URL, MetaTTL: time.Hour})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := guard.Refresh(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !guard.Allowed("198.51.100.42") || guard.Allowed("140.82.115.10") {
+		t.Errorf("expected only the fetched ranges to be allowed")
+	}
+	// Fresh ranges are not fetched again
+	guard.Allowed("198.51.100.42")
+	if *calls != 1 {
+		t.Errorf("expected 1 call to the meta api, got %d", *calls)
+	}
+}
+
+func TestIPGuardRefreshesInBackground(t *testing.T) {
+	server, _ := newFakeMeta(t, `"198.51.100.0/24"`)
+
+	guard, err := newIPGuard(Config{SourceIPGuard: true, GithubAPIURL: server.URL, MetaTTL: time.Hour})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The embedded ranges are stale, they are used while the new ones are fetched
+	if !guard.Allowed("140.82.115.10") {
+		t.Errorf("expected the embedded ranges to be used")
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for !guard.Allowed("198.51.100.42") {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the ranges to be refreshed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestIPGuardBacksOffAfterFailures(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `{"message": "API rate limit exceeded"}`)
+	}))
+	t.Cleanup(server.Close)
+
+	guard, err := newIPGuard(Config{SourceIPGuard: true, GithubAPIURL: server.URL, MetaTTL: time.Hour})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := guard.Refresh(context.Background()); err == nil {
+		t.Fatalf("expected the rate limited refresh to fail")
+	}
+
+	// The next requests use the embedded ranges without calling the api again
+	for i := 0; i < 5; i++ {
+		if !guard.Allowed("140.82.115.10") {
+			t.Errorf("expected the embedded ranges to be used")
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	if calls != 1 {
+		t.Errorf("expected 1 call to the meta api, got %d", calls)
+	}
+
+	// The backoff doubles after every failure, up to the TTL
+	guard.Refresh(context.Background())
+	if backoff := time.Until(guard.retryAt); backoff <= MetaRetryBackoff || backoff > 2*MetaRetryBackoff {
+		t.Errorf("expected the backoff to double, got %v", backoff)
+	}
+}
+
+func TestHandlerRejectsUnknownSources(t *testing.T) {
+	config := testConfig(t, testRoutes)
+	config.SourceIPGuard = true
+	config.GithubAPIURL = "http://127.0.0.1:0"
+
+	svc, cp := testServices()
+	guard, err := newIPGuard(config)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	svc.SourceIPs = guard
+
+	push := GithubEvent{
+		Ref:     "refs/heads/main",
+		Commits: []Commit{{Modified: []string{"src/config.ts"}}},
+	}
+
+	evt := newDelivery(t, "push", "", push)
+	evt.RequestContext.HTTP.SourceIP = "8.8.8.8"
+	resp, _ := handler(context.Background(), config, svc, evt)
+	if resp.StatusCode != http.StatusForbidden || len(cp.started) != 0 {
+		t.Errorf("expected 403, got %d", resp.StatusCode)
+	}
+
+	evt.RequestContext.HTTP.SourceIP = "140.82.115.10"
+	resp, _ = handler(context.Background(), config, svc, evt)
+	if resp.StatusCode != http.StatusOK || len(cp.started) != 1 {
+		t.Errorf("expected 200, got %d %s", resp.StatusCode, resp.Body)
+	}
+}
@@ -9,21 +9,35 @@ import (
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
-	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/codepipeline"
+	"github.com/aws/aws-sdk-go/service/codepipeline/codepipelineiface"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/google/go-github/github"
 	log "github.com/sirupsen/logrus"
 )
 
+const EventHeader = "x-github-event"
+
+// GithubEvent is the payload of the github `push` event
 type GithubEvent struct {
 	Ref        string `json:"ref"`
 	Before     string `json:"before"`
 	After      string `json:"after"`
+	Created    bool   `json:"created"`
+	Deleted    bool   `json:"deleted"`
+	Forced     bool   `json:"forced"`
 	Repository struct {
-		ID    int `json:"id"`
-		Owner struct {
-			Name string `json:"name"`
-			ID   int    `json:"id"`
+		ID            int    `json:"id"`
+		Name          string `json:"name"`
+		FullName      string `json:"full_name"`
+		DefaultBranch string `json:"default_branch"`
+		Owner         struct {
+			Name  string `json:"name"`
+			Login string `json:"login"`
+			ID    int    `json:"id"`
 		} `json:"owner"`
 		CreatedAt int       `json:"created_at"`
 		UpdatedAt time.Time `json:"updated_at"`
@@ -33,6 +47,10 @@ type GithubEvent struct {
 		Name  string `json:"name"`
 		Email string `json:"email"`
 	} `json:"pusher"`
+	Sender struct {
+		Login string `json:"login"`
+		Type  string `json:"type"`
+	} `json:"sender"`
 	Commits    []Commit `json:"commits"`
 	HeadCommit Commit   `json:"head_commit"`
 	HookID     int      `json:"hook_id"`
@@ -83,133 +101,596 @@ type Commit struct {
 	Modified []string `json:"modified"`
 }
 
+// Execution is a pipeline started (or failed to start) for a matching rule
+type Execution struct {
+	Rule                string `json:"rule"`
+	PipelineName        string `json:"pipeline_name"`
+	PipelineExecutionID string `json:"pipeline_execution_id,omitempty"`
+	Error               string `json:"error,omitempty"`
+	// CoalescedInto is the execution in progress building the same or a newer
+	// commit, no new execution was started and the commit gets no status
+	CoalescedInto string `json:"coalesced_into,omitempty"`
+	// Superseded are the older executions stopped after this one started
+	Superseded []string `json:"superseded,omitempty"`
+}
+
+// Result is the response body sent back to the git provider
+type Result struct {
+	DeliveryID string      `json:"delivery_id,omitempty"`
+	Executions []Execution `json:"executions"`
+	// Queued is set when the delivery is processed asynchronously,
+	// Executions are then always empty
+	Queued bool `json:"queued,omitempty"`
+	// Duplicate is set when the delivery was already processed,
+	// Executions are then the ones started by the original delivery
+	Duplicate bool `json:"duplicate,omitempty"`
+	// Directive found in the commit messages
+	Directive *Directive `json:"directive,omitempty"`
+	// DryRun is set when nothing was started, Explanation is then the decision trigger-fn took
+	DryRun      bool         `json:"dry_run,omitempty"`
+	Explanation *Explanation `json:"explanation,omitempty"`
+	// Error explains why a manual dispatch was rejected
+	Error string `json:"error,omitempty"`
+}
+
+// Services are the clients used by the handler
+type Services struct {
+	Codepipeline codepipelineiface.CodePipelineAPI
+	Deliveries   DeliveryStore
+	Executions   ExecutionRecorder
+	// Github is nil when there is no github token
+	Github *github.Client
+	// Bitbucket is nil when there is no bitbucket token
+	Bitbucket *BitbucketClient
+	// SourceIPs is nil when the source ip guard is disabled
+	SourceIPs *IPGuard
+	// Queue is nil when the deliveries are processed inline
+	Queue DeliveryQueue
+	// Archive is nil when the deliveries are not archived
+	Archive DeliveryArchive
+	// RoutesCache keeps the routes files read from the repository, nil disables the cache
+	RoutesCache *RoutesCache
+}
+
 func main() {
 	config := readConfigFromEnv()
+	sess := session.Must(session.NewSession())
+
+	svc := Services{
+		Codepipeline: codepipeline.New(sess),
+		Deliveries:   NewMemoryDeliveryStore(config.DedupTTL, config.DedupLease),
+		Executions:   &MemoryExecutionRecorder{},
+		RoutesCache:  NewRoutesCache(DefaultRoutesCacheSize),
+	}
+	ghClient, err := newGithubClient(context.Background(), config)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	svc.Github = ghClient
+	if config.BitbucketToken != "" {
+		svc.Bitbucket = &BitbucketClient{
+			Client:  &http.Client{Timeout: 10 * time.Second},
+			BaseURL: config.BitbucketAPIURL,
+			Token:   config.BitbucketToken,
+		}
+	}
+
+	svc.SourceIPs, err = newIPGuard(config)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if svc.SourceIPs != nil {
+		// Falls back to the embedded ranges
+		err = svc.SourceIPs.Refresh(context.Background())
+		if err != nil {
+			log.Warnf("error in fetching github hook ranges, using the embedded ones: %v", err.Error())
+		}
+	}
+
+	if config.DedupTableName != "" {
+		svc.Deliveries = &DynamoDeliveryStore{
+			Client:    dynamodb.New(sess),
+			TableName: config.DedupTableName,
+			TTL:       config.DedupTTL,
+			Lease:     config.DedupLease,
+		}
+	}
+
+	if config.ExecutionsTableName != "" {
+		svc.Executions = &DynamoExecutionRecorder{
+			Client:    dynamodb.New(sess),
+			TableName: config.ExecutionsTableName,
+			TTL:       config.ExecutionsTTL,
+		}
+	}
+
+	if config.ArchiveBucket != "" {
+		svc.Archive = &S3DeliveryArchive{
+			Client: s3.New(sess),
+			Bucket: config.ArchiveBucket,
+			Prefix: config.ArchivePrefix,
+		}
+	}
+
+	if config.QueueURL != "" {
+		svc.Queue = &SQSDeliveryQueue{
+			Client:   sqs.New(sess),
+			QueueURL: config.QueueURL,
+		}
+	}
+
+	if config.Mode == ModeConsumer {
+		// The consumer processes the deliveries itself
+		svc.Queue = nil
+
+		lambda.Start(func(ctx context.Context, evt events.SQSEvent) (events.SQSEventResponse, error) {
+			return consumer(ctx, config, svc, evt)
+		})
+		return
+	}
 
 	lambda.Start(func(ctx context.Context, evt events.LambdaFunctionURLRequest) (events.LambdaFunctionURLResponse, error) {
-		return handler(ctx, config, evt)
+		return handler(ctx, config, svc, evt)
 	})
 }
 
-func handler(ctx context.Context, config Config, evt events.LambdaFunctionURLRequest) (events.LambdaFunctionURLResponse, error) {
-	// Ignore if the event type is not `push`
-	if v, ok := evt.Headers["x-github-event"]; ok {
-		if v != "push" {
-			log.Infof("event type is %s, ignoring it\n", v)
-			return buildResponse(http.StatusOK)
+func handler(ctx context.Context, config Config, svc Services, evt events.LambdaFunctionURLRequest) (events.LambdaFunctionURLResponse, error) {
+	// Manual dispatches are not sent by the git providers
+	if evt.RawPath == DispatchPath {
+		return handleManualDispatch(ctx, config, svc, evt)
+	}
+
+	if svc.SourceIPs != nil && !svc.SourceIPs.Allowed(evt.RequestContext.HTTP.SourceIP) {
+		log.WithFields(log.Fields{
+			"source_ip": evt.RequestContext.HTTP.SourceIP,
+		}).Warnln("rejecting request from outside the allowed source ranges")
+
+		return buildResponse(http.StatusForbidden)
+	}
+
+	payload, err := requestBody(evt)
+	if err != nil {
+		log.Errorf("error in decoding request body: %v", err.Error())
+		return buildResponse(http.StatusBadRequest)
+	}
+
+	provider := detectProvider(evt.Headers)
+	deliveryID := provider.DeliveryID(evt.Headers)
+
+	// Reject anything that is not signed with the webhook secret
+	err = provider.Verify(config.WebhookSecret, evt.Headers, payload)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"provider":    provider.Name(),
+			"delivery_id": deliveryID,
+			"source_ip":   evt.RequestContext.HTTP.SourceIP,
+		}).Warnf("rejecting delivery: %v", err.Error())
+
+		return buildResponse(http.StatusUnauthorized)
+	}
+
+	// A dry run is answered inline and is not a delivery to keep
+	if isDryRun(evt) {
+		return dispatch(ctx, config, svc, provider, evt.Headers, payload, true)
+	}
+
+	if svc.Archive != nil {
+		archiveDelivery(ctx, svc, provider, evt, payload)
+	}
+
+	if svc.Queue != nil {
+		return enqueue(ctx, config, svc, provider, evt, payload)
+	}
+
+	return dispatch(ctx, config, svc, provider, evt.Headers, payload, false)
+}
+
+// dispatch hands an authenticated delivery to the handler of its event.
+// In a dry run the decision is explained and nothing is started.
+func dispatch(ctx context.Context, config Config, svc Services, provider Provider, headers map[string]string, payload []byte, dryRun bool) (events.LambdaFunctionURLResponse, error) {
+	deliveryID := provider.DeliveryID(headers)
+
+	switch v := provider.Event(headers); {
+	case v == "push":
+		return handlePush(ctx, config, svc, provider, deliveryID, payload, dryRun)
+	case v == "pull_request" && provider.Name() == ProviderGithub:
+		return handlePullRequest(ctx, config, svc, deliveryID, payload, dryRun)
+	case v == "issue_comment" && provider.Name() == ProviderGithub:
+		return handleIssueComment(ctx, config, svc, deliveryID, payload, dryRun)
+	default:
+		log.Infof("%s event type is %s, ignoring it\n", provider.Name(), v)
+		if dryRun {
+			return buildJSONResponse(http.StatusOK, Result{
+				Executions:  []Execution{},
+				DryRun:      true,
+				Explanation: skipped(dryRun, v, "", "event is not routed"),
+			})
 		}
+		return buildResponse(http.StatusOK)
 	}
+}
 
-	ghEvt := GithubEvent{}
-	err := json.Unmarshal([]byte(evt.Body), &ghEvt)
+func handlePush(ctx context.Context, config Config, svc Services, provider Provider, deliveryID string, payload []byte, dryRun bool) (events.LambdaFunctionURLResponse, error) {
+	push, err := provider.ParsePush(payload)
 	if err != nil {
 		log.WithFields(log.Fields{
-			"request_body": evt.Body,
+			"provider":     provider.Name(),
+			"request_body": string(payload),
 		}).Errorf("error in umarshalling request body: %v", err.Error())
 
-		return events.LambdaFunctionURLResponse{
-			StatusCode: http.StatusBadRequest,
-			Headers: map[string]string{
-				"Content-Type": "application/json",
-			},
-		}, nil
+		return buildBadRequestResponse()
 	}
 
-	// Check the branch
-	branch := strings.TrimPrefix(ghEvt.Ref, "refs/heads/")
+	// Only pushes to branches are routed, tags are ignored
+	branch, ok := branchRef(push.Ref)
+	if !ok {
+		log.WithFields(log.Fields{
+			"ref":       push.Ref,
+			"pushed_at": push.PushedAt,
+		}).Infoln("ignoring event. ref is not a branch")
+
+		return buildJSONResponse(http.StatusOK, Result{
+			Executions:  []Execution{},
+			DryRun:      dryRun,
+			Explanation: skipped(dryRun, "push", push.Ref, "ref is not a branch"),
+		})
+	}
 
-	if branch != config.GithubBranch {
+	// Nothing to deploy from a deleted branch
+	if push.Deleted || push.After == ZeroSHA {
 		log.WithFields(log.Fields{
-			"config_branch": config.GithubBranch,
-			"evt_branch":    branch,
-			"author":        ghEvt.HeadCommit.Author.Username,
-			"pushed_at":     ghEvt.Repository.PushedAt,
-		}).Infof("ignoring event. branch is not equal to config.GithubBranch")
+			"branch":    branch,
+			"pushed_at": push.PushedAt,
+		}).Infoln("ignoring event. branch was deleted")
 
-		return buildResponse(http.StatusOK)
+		return buildJSONResponse(http.StatusOK, Result{
+			Executions:  []Execution{},
+			DryRun:      dryRun,
+			Explanation: skipped(dryRun, "push", push.Ref, "branch was deleted"),
+		})
 	}
 
-	if !checkCommits(ghEvt.Commits, config.Filters) {
+	directive := parseDirective(push)
+	if directive != nil {
 		log.WithFields(log.Fields{
 			"branch":      branch,
-			"head_commit": ghEvt.HeadCommit.ID,
-			"author":      ghEvt.HeadCommit.Author.Username,
-			"pushed_at":   ghEvt.Repository.PushedAt,
-		}).Infoln("skipping event, did not find any matching changes")
+			"head_commit": push.HeadCommit.ID,
+			"decision":    directive.Decision,
+			"directive":   directive.Match,
+			"commit":      directive.Commit,
+		}).Infoln("found a directive in the commit messages")
 
-		return buildResponse(http.StatusOK)
+		if directive.Decision == DecisionSkip {
+			return buildJSONResponse(http.StatusOK, Result{
+				Executions:  []Execution{},
+				Directive:   directive,
+				DryRun:      dryRun,
+				Explanation: skipped(dryRun, "push", push.Ref, "skipped by a directive"),
+			})
+		}
 	}
 
-	sess := session.Must(session.NewSession())
-	cpsvc := codepipeline.New(sess)
+	// config is a copy, the routes of the repository only apply to this push
+	config.Routes = repoRoutes(ctx, config, svc, push)
 
-	resp, err := cpsvc.StartPipelineExecution(&codepipeline.StartPipelineExecutionInput{
-		Name: aws.String(config.CodepipelineName),
-	})
-	if err != nil {
+	files, complete := []string{}, true
+	if push.Provider == ProviderBitbucket {
+		files = bitbucketPushFiles(ctx, svc.Bitbucket, push, branch)
+	} else {
+		files, complete = pushFiles(ctx, svc.Github, push, branch)
+	}
+
+	change := Change{
+		Event:        "push",
+		Repository:   push.Repository,
+		Branch:       branch,
+		Files:        files,
+		Force:        directive != nil && directive.Decision == DecisionForce,
+		FilesUnknown: !complete,
+		Lambdas:      config.Manifest.Affected(files),
+		Authors:      authors(push.Pusher, commitAuthor(push.HeadCommit)),
+		Bot:          push.Bot,
+	}
+	if config.Routes.NeedsVerification("push", branch) {
+		change.Verified = verifyCommit(ctx, svc, push.Provider, push.Repository, headCommitID(push))
+	}
+	if dryRun {
+		return explain(config, change, push.Ref, directive)
+	}
+
+	rules := config.Routes.Match(change)
+	if len(rules) == 0 {
 		log.WithFields(log.Fields{
-			"codepipeline_name": config.CodepipelineName,
-			"branch":            branch,
-			"head_commit":       ghEvt.HeadCommit.ID,
-			"author":            ghEvt.HeadCommit.Author.Username,
-			"pushed_at":         ghEvt.Repository.PushedAt,
-		}).Errorf("error in starting codepipeline: %v", err.Error())
+			"provider":    push.Provider,
+			"branch":      branch,
+			"head_commit": push.HeadCommit.ID,
+			"author":      push.HeadCommit.Author.Username,
+			"pushed_at":   push.PushedAt,
+		}).Infoln("skipping event, did not find any matching rules")
 
-		return buildResponse(http.StatusInternalServerError)
+		return buildJSONResponse(http.StatusOK, Result{
+			Executions: []Execution{},
+			Directive:  directive,
+		})
 	}
 
-	log.WithFields(log.Fields{
-		"pipeline_execution_id": *resp.PipelineExecutionId,
-		"codepipeline_name":     config.CodepipelineName,
-		"branch":                branch,
-		"head_commit":           ghEvt.HeadCommit.ID,
-		"author":                ghEvt.HeadCommit.Author.Username,
-		"pushed_at":             ghEvt.Repository.PushedAt,
-	}).Infoln("started codepipeline")
+	trigger := pushTrigger(push, branch, files)
+	trigger.Variables[VariableAffectedLambdas] = strings.Join(change.Lambdas, ",")
+	trigger.Directive = directive
+
+	return startAndRecord(ctx, svc, deliveryID, rules, trigger)
+}
 
-	body := map[string]string{
-		"pipeline_execution_id": *resp.PipelineExecutionId,
-		"pipeline_name":         config.CodepipelineName,
+// verifyCommit looks up whether github verified the signature of the commit.
+// Commits that can not be looked up are not verified.
+func verifyCommit(ctx context.Context, svc Services, provider, repository, sha string) bool {
+	fields := log.Fields{
+		"provider":    provider,
+		"repository":  repository,
+		"head_commit": sha,
 	}
-	b, err := json.Marshal(body)
+
+	if provider != ProviderGithub {
+		log.WithFields(fields).Warnln("only github commits can be verified")
+		return false
+	}
+
+	verified, err := isVerified(ctx, svc.Github, repository, sha)
 	if err != nil {
-		return buildResponse(http.StatusInternalServerError)
+		log.WithFields(fields).Errorf("error in looking up commit signature: %v", err.Error())
+		return false
 	}
 
-	return events.LambdaFunctionURLResponse{
-		StatusCode: http.StatusOK,
-		Body:       string(b),
-		Headers: map[string]string{
-			"Content-Type": "application/json",
-		},
-		IsBase64Encoded: false,
-	}, nil
+	return verified
 }
 
-func checkCommits(commits []Commit, filters []string) bool {
-	// Check _all_ commits in the push
-	for _, commit := range commits {
-		if findMatch(commit.Modified, filters) ||
-			findMatch(commit.Added, filters) ||
-			findMatch(commit.Removed, filters) {
-			return true
+// explain answers a dry run with the decision for the change
+func explain(config Config, change Change, ref string, directive *Directive) (events.LambdaFunctionURLResponse, error) {
+	explanation := config.Routes.Explain(change)
+	explanation.Ref = ref
+
+	log.WithFields(log.Fields{
+		"event":     change.Event,
+		"branch":    change.Branch,
+		"pipelines": explanation.Pipelines,
+	}).Infoln("explained dry run")
+
+	return buildJSONResponse(http.StatusOK, Result{
+		Executions:  []Execution{},
+		Directive:   directive,
+		DryRun:      true,
+		Explanation: &explanation,
+	})
+}
+
+// startAndRecord starts the pipelines of the matching rules once per delivery.
+// A redelivery gets back the executions started by the original delivery.
+func startAndRecord(ctx context.Context, svc Services, deliveryID string, rules []Rule, trigger Trigger) (events.LambdaFunctionURLResponse, error) {
+	statusCode, result := startOnce(ctx, svc, deliveryID, rules, trigger)
+	if result == nil {
+		return buildResponse(statusCode)
+	}
+
+	return buildJSONResponse(statusCode, *result)
+}
+
+// startOnce is startAndRecord returning the result, nil when the delivery could not be deduplicated
+func startOnce(ctx context.Context, svc Services, deliveryID string, rules []Rule, trigger Trigger) (int, *Result) {
+	if deliveryID != "" {
+		delivery, claimed, err := svc.Deliveries.Claim(ctx, deliveryID)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"delivery_id": deliveryID,
+			}).Errorf("error in deduplicating delivery: %v", err.Error())
+
+			return http.StatusInternalServerError, nil
+		}
+
+		if !claimed {
+			log.WithFields(trigger.Fields).WithFields(log.Fields{
+				"delivery_id": deliveryID,
+				"completed":   delivery.Completed,
+			}).Infoln("ignoring redelivery of an already processed delivery")
+
+			statusCode := http.StatusOK
+			if !delivery.Completed {
+				// The original delivery is still starting the pipelines
+				statusCode = http.StatusAccepted
+			}
+
+			return statusCode, &Result{
+				DeliveryID: deliveryID,
+				Executions: delivery.Executions,
+				Duplicate:  true,
+			}
+		}
+	}
+
+	result := startPipelines(ctx, svc, deliveryID, rules, trigger)
+	result.DeliveryID = deliveryID
+	result.Directive = trigger.Directive
+
+	statusCode := http.StatusOK
+	for _, execution := range result.Executions {
+		if execution.Error != "" {
+			statusCode = http.StatusInternalServerError
+		}
+	}
+
+	if deliveryID != "" {
+		var err error
+		if statusCode != http.StatusOK {
+			// Let github redeliver it, the pipelines already started are not started again
+			err = svc.Deliveries.Release(ctx, deliveryID)
+		} else {
+			err = svc.Deliveries.Complete(ctx, deliveryID, result.Executions)
+		}
+		if err != nil {
+			log.WithFields(log.Fields{
+				"delivery_id": deliveryID,
+			}).Errorf("error in recording delivery: %v", err.Error())
 		}
 	}
 
-	return false
+	return statusCode, &result
 }
 
-func findMatch(files []string, filters []string) bool {
-	for _, filter := range filters {
-		for _, file := range files {
+// startPipelines starts every pipeline targeted by the matching rules.
+// A pipeline targeted by several rules is only started once.
+func startPipelines(ctx context.Context, svc Services, deliveryID string, rules []Rule, trigger Trigger) Result {
+	result := Result{Executions: []Execution{}}
+	started := map[string]bool{}
+
+	for _, rule := range rules {
+		if started[rule.Pipeline] {
+			continue
+		}
+		started[rule.Pipeline] = true
+
+		result.Executions = append(result.Executions, startPipelineOnce(ctx, svc, deliveryID, rule, trigger))
+	}
+
+	return result
+}
+
+// startPipelineOnce starts the pipeline of the rule once per delivery. Each pipeline is claimed
+// separately, so the redelivery of a partially failed delivery only starts the failed pipelines.
+func startPipelineOnce(ctx context.Context, svc Services, deliveryID string, rule Rule, trigger Trigger) Execution {
+	if deliveryID == "" {
+		return startPipeline(ctx, svc, rule, trigger)
+	}
+
+	id := deliveryID + "#" + rule.Pipeline
+	fields := log.Fields{
+		"delivery_id":       deliveryID,
+		"codepipeline_name": rule.Pipeline,
+	}
+
+	previous, claimed, err := svc.Deliveries.Claim(ctx, id)
+	if err != nil {
+		log.WithFields(fields).Errorf("error in deduplicating pipeline: %v", err.Error())
+		return Execution{Rule: rule.Name, PipelineName: rule.Pipeline, Error: err.Error()}
+	}
+	if !claimed {
+		if previous.Completed && len(previous.Executions) == 1 {
+			log.WithFields(trigger.Fields).WithFields(fields).Infoln("pipeline was already started for this delivery")
+			return previous.Executions[0]
+		}
+		// An earlier attempt is still starting it, the delivery is retried later
+		return Execution{Rule: rule.Name, PipelineName: rule.Pipeline, Error: "pipeline is being started by another attempt"}
+	}
+
+	execution := startPipeline(ctx, svc, rule, trigger)
+	if execution.Error != "" {
+		err = svc.Deliveries.Release(ctx, id)
+	} else {
+		err = svc.Deliveries.Complete(ctx, id, []Execution{execution})
+	}
+	if err != nil {
+		log.WithFields(fields).Errorf("error in recording pipeline: %v", err.Error())
+	}
+
+	return execution
+}
+
+// startPipeline starts the pipeline of the rule according to its concurrency policy
+func startPipeline(ctx context.Context, svc Services, rule Rule, trigger Trigger) Execution {
+	execution := Execution{
+		Rule:         rule.Name,
+		PipelineName: rule.Pipeline,
+	}
+	fields := log.Fields{
+		"rule":              rule.Name,
+		"codepipeline_name": rule.Pipeline,
+		"concurrency":       rule.Concurrency,
+	}
+
+	running := []RunningExecution{}
+	if rule.Concurrency != PolicyQueue {
+		var err error
+		running, err = runningExecutions(svc.Codepipeline, rule.Pipeline)
+		if err != nil {
+			// Starting the pipeline anyway is the same as the default queue policy
+			log.WithFields(trigger.Fields).WithFields(fields).Warnf("error in checking executions in progress: %v", err.Error())
+		}
+	}
+
+	if rule.Concurrency == PolicyCoalesce {
+		// Only github commits can be compared, other providers coalesce identical commits
+		client := svc.Github
+		if trigger.Provider != ProviderGithub {
+			client = nil
+		}
+		into := coalesceInto(ctx, client, trigger.Repository, running, trigger.SHA)
+		if into != nil {
+			log.WithFields(trigger.Fields).WithFields(fields).WithFields(log.Fields{
+				"pipeline_execution_id": into.ID,
+				"commit":                into.Commit,
+			}).Infoln("not starting codepipeline, an execution in progress is already building this or a newer commit")
+
+			execution.PipelineExecutionID = into.ID
+			execution.CoalescedInto = into.ID
+			return execution
+		}
+	}
+
+	resp, err := svc.Codepipeline.StartPipelineExecution(buildStartInput(rule, trigger))
+	if err != nil {
+		log.WithFields(trigger.Fields).WithFields(fields).Errorf("error in starting codepipeline: %v", err.Error())
+
+		execution.Error = err.Error()
+		return execution
+	}
+	execution.PipelineExecutionID = *resp.PipelineExecutionId
+
+	log.WithFields(trigger.Fields).WithFields(fields).WithFields(log.Fields{
+		"pipeline_execution_id": execution.PipelineExecutionID,
+	}).Infoln("started codepipeline")
+
+	err = svc.Executions.Record(ctx, ExecutionRecord{
+		ExecutionID: execution.PipelineExecutionID,
+		Pipeline:    rule.Pipeline,
+		Provider:    trigger.Provider,
+		Repository:  trigger.Repository,
+		SHA:         trigger.SHA,
+		Ref:         trigger.Variables[VariableRef],
+		Rule:        rule.Name,
+		RequestedBy: trigger.RequestedBy,
+		Reason:      trigger.Reason,
+	})
+	if err != nil {
+		// The execution has started, github just won't get its status
+		log.WithFields(trigger.Fields).WithFields(fields).Errorf("error in recording execution: %v", err.Error())
+	}
+
+	if rule.Concurrency == PolicySupersede && len(running) > 0 {
+		execution.Superseded = supersede(svc.Codepipeline, rule.Pipeline, running, execution.PipelineExecutionID, trigger.SHA)
+
+		log.WithFields(trigger.Fields).WithFields(fields).WithFields(log.Fields{
+			"pipeline_execution_id": execution.PipelineExecutionID,
+			"superseded":            execution.Superseded,
+		}).Infoln("stopped superseded executions")
+	}
+
+	return execution
+}
 
-			if strings.HasPrefix(file, filter) {
-				return true
+// changedFiles returns every file added, modified or removed in the commits
+func changedFiles(commits []Commit) []string {
+	files := []string{}
+	seen := map[string]bool{}
+	for _, commit := range commits {
+		for _, list := range [][]string{commit.Added, commit.Modified, commit.Removed} {
+			for _, file := range list {
+				if !seen[file] {
+					seen[file] = true
+					files = append(files, file)
+				}
 			}
 		}
 	}
 
-	return false
+	return files
 }
 
 func buildResponse(statusCode int) (events.LambdaFunctionURLResponse, error) {
@@ -217,3 +698,28 @@ func buildResponse(statusCode int) (events.LambdaFunctionURLResponse, error) {
 		StatusCode: statusCode,
 	}, nil
 }
+
+func buildBadRequestResponse() (events.LambdaFunctionURLResponse, error) {
+	return events.LambdaFunctionURLResponse{
+		StatusCode: http.StatusBadRequest,
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+		},
+	}, nil
+}
+
+func buildJSONResponse(statusCode int, body interface{}) (events.LambdaFunctionURLResponse, error) {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return buildResponse(http.StatusInternalServerError)
+	}
+
+	return events.LambdaFunctionURLResponse{
+		StatusCode: statusCode,
+		Body:       string(b),
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+		},
+		IsBase64Encoded: false,
+	}, nil
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/codepipeline"
+	"github.com/aws/aws-sdk-go/service/codepipeline/codepipelineiface"
+)
+
+var testSecret = []byte("trigger-fn-test-secret")
+
+// fakeCodepipeline records the executions started instead of calling codepipeline
+type fakeCodepipeline struct {
+	codepipelineiface.CodePipelineAPI
+
+	started []*codepipeline.StartPipelineExecutionInput
+	stopped []string
+	// executions returned by ListPipelineExecutions, pages of pageSize when it is set
+	executions []*codepipeline.PipelineExecutionSummary
+	pageSize   int
+	listed     int
+	// failures is the number of times each pipeline fails to start
+	failures map[string]int
+}
+
+func (f *fakeCodepipeline) ListPipelineExecutions(input *codepipeline.ListPipelineExecutionsInput) (*codepipeline.ListPipelineExecutionsOutput, error) {
+	f.listed++
+	if f.pageSize == 0 {
+		return &codepipeline.ListPipelineExecutionsOutput{
+			PipelineExecutionSummaries: f.executions,
+		}, nil
+	}
+
+	start := 0
+	if input.NextToken != nil {
+		start, _ = strconv.Atoi(*input.NextToken)
+	}
+	end := start + f.pageSize
+	output := &codepipeline.ListPipelineExecutionsOutput{}
+	if end < len(f.executions) {
+		output.NextToken = aws.String(strconv.Itoa(end))
+	} else {
+		end = len(f.executions)
+	}
+	output.PipelineExecutionSummaries = f.executions[start:end]
+	return output, nil
+}
+
+func (f *fakeCodepipeline) StopPipelineExecution(input *codepipeline.StopPipelineExecutionInput) (*codepipeline.StopPipelineExecutionOutput, error) {
+	f.stopped = append(f.stopped, *input.PipelineExecutionId)
+	return &codepipeline.StopPipelineExecutionOutput{
+		PipelineExecutionId: input.PipelineExecutionId,
+	}, nil
+}
+
+func (f *fakeCodepipeline) StartPipelineExecution(input *codepipeline.StartPipelineExecutionInput) (*codepipeline.StartPipelineExecutionOutput, error) {
+	if f.failures[*input.Name] > 0 {
+		f.failures[*input.Name]--
+		return nil, fmt.Errorf("throttled")
+	}
+	f.started = append(f.started, input)
+	return &codepipeline.StartPipelineExecutionOutput{
+		PipelineExecutionId: aws.String(fmt.Sprintf("execution-%d", len(f.started))),
+	}, nil
+}
+
+func testConfig(t *testing.T, routes string) Config {
+	t.Helper()
+
+	r, err := parseRoutes([]byte(routes))
+	if err != nil {
+		t.Fatalf("error in parsing routes: %v", err)
+	}
+	return Config{
+		Routes:        r,
+		WebhookSecret: testSecret,
+	}
+}
+
+func testServices() (Services, *fakeCodepipeline) {
+	cp := &fakeCodepipeline{}
+	return Services{
+		Codepipeline: cp,
+		Deliveries:   NewMemoryDeliveryStore(time.Hour, time.Minute),
+		Executions:   &MemoryExecutionRecorder{},
+	}, cp
+}
+
+// newDelivery builds a signed function url request like github sends it
+func newDelivery(t *testing.T, event, deliveryID string, payload interface{}) events.LambdaFunctionURLRequest {
+	t.Helper()
+
+	b, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatalf("error in marshalling payload: %v", err)
+	}
+	return events.LambdaFunctionURLRequest{
+		Headers: map[string]string{
+			"x-github-event": event,
+			DeliveryHeader:   deliveryID,
+			SignatureHeader:  sign(testSecret, b),
+		},
+		Body: string(b),
+	}
+}
+
+func readResult(t *testing.T, resp events.LambdaFunctionURLResponse) Result {
+	t.Helper()
+
+	result := Result{}
+	if err := json.Unmarshal([]byte(resp.Body), &result); err != nil {
+		t.Fatalf("error in unmarshalling response %q: %v", resp.Body, err)
+	}
+	return result
+}
+
+func TestHandlerRejectsUnsignedDeliveries(t *testing.T) {
+	config := testConfig(t, testRoutes)
+	svc, cp := testServices()
+
+	evt := newDelivery(t, "push", "1", GithubEvent{Ref: "refs/heads/main"})
+	evt.Headers[SignatureHeader] = sign([]byte("forged"), []byte(evt.Body))
+
+	resp, _ := handler(context.Background(), config, svc, evt)
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected 401, got %d", resp.StatusCode)
+	}
+
+	delete(evt.Headers, SignatureHeader)
+	resp, _ = handler(context.Background(), config, svc, evt)
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected 401, got %d", resp.StatusCode)
+	}
+
+	if len(cp.started) != 0 {
+		t.Errorf("expected no executions, got %d", len(cp.started))
+	}
+}
+
+func TestHandlerDeduplicatesDeliveries(t *testing.T) {
+	config := testConfig(t, testRoutes)
+	svc, cp := testServices()
+
+	push := GithubEvent{
+		Ref:     "refs/heads/main",
+		Commits: []Commit{{Modified: []string{"src/config.ts", "docs/diagram.dot"}}},
+	}
+
+	resp, _ := handler(context.Background(), config, svc, newDelivery(t, "push", "72d3162e", push))
+	first := readResult(t, resp)
+	if resp.StatusCode != http.StatusOK || len(first.Executions) != 2 || first.Duplicate {
+		t.Fatalf("expected two new executions, got %d %s", resp.StatusCode, resp.Body)
+	}
+
+	resp, _ = handler(context.Background(), config, svc, newDelivery(t, "push", "72d3162e", push))
+	second := readResult(t, resp)
+	if resp.StatusCode != http.StatusOK || !second.Duplicate {
+		t.Fatalf("expected a duplicate, got %d %s", resp.StatusCode, resp.Body)
+	}
+	if !reflect.DeepEqual(first.Executions, second.Executions) {
+		t.Errorf("expected %v, got %v", first.Executions, second.Executions)
+	}
+
+	// A new delivery of the same push is a new request
+	handler(context.Background(), config, svc, newDelivery(t, "push", "9a1b2c3d", push))
+	if len(cp.started) != 4 {
+		t.Errorf("expected 4 executions, got %d", len(cp.started))
+	}
+}
+
+func TestHandlerRetriesFailedPipelines(t *testing.T) {
+	config := testConfig(t, testRoutes)
+	svc, cp := testServices()
+	cp.failures = map[string]int{"website-docs": 1}
+
+	push := GithubEvent{
+		Ref:     "refs/heads/main",
+		Commits: []Commit{{Modified: []string{"src/config.ts", "docs/diagram.dot"}}},
+	}
+
+	resp, _ := handler(context.Background(), config, svc, newDelivery(t, "push", "72d3162e", push))
+	if resp.StatusCode != http.StatusInternalServerError || len(cp.started) != 1 {
+		t.Fatalf("expected website-docs to fail, got %d %s", resp.StatusCode, resp.Body)
+	}
+
+	// The redelivery only starts the failed pipeline
+	resp, _ = handler(context.Background(), config, svc, newDelivery(t, "push", "72d3162e", push))
+	result := readResult(t, resp)
+	if resp.StatusCode != http.StatusOK || result.Duplicate || len(cp.started) != 2 || *cp.started[1].Name != "website-docs" {
+		t.Fatalf("expected website-docs to be retried, got %d %s", resp.StatusCode, resp.Body)
+	}
+	if len(result.Executions) != 2 || result.Executions[0].PipelineExecutionID != "execution-1" {
+		t.Errorf("expected the first execution to be reported again, got %+v", result.Executions)
+	}
+
+	resp, _ = handler(context.Background(), config, svc, newDelivery(t, "push", "72d3162e", push))
+	if result := readResult(t, resp); !result.Duplicate || len(cp.started) != 2 {
+		t.Errorf("expected a duplicate once every pipeline started, got %s", resp.Body)
+	}
+}
+
+// expireClaims backdates the claims of the memory store past its lease
+func expireClaims(store *MemoryDeliveryStore) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	for id, d := range store.deliveries {
+		d.ClaimedAt -= int64((store.Lease + time.Second) / time.Second)
+		store.deliveries[id] = d
+	}
+}
+
+func TestHandlerTakesOverStaleClaims(t *testing.T) {
+	config := testConfig(t, testRoutes)
+	svc, cp := testServices()
+
+	push := GithubEvent{
+		Ref:     "refs/heads/main",
+		Commits: []Commit{{Modified: []string{"src/config.ts"}}},
+	}
+
+	// An attempt claimed the delivery and its pipeline, then timed out
+	svc.Deliveries.Claim(context.Background(), "72d3162e")
+	svc.Deliveries.Claim(context.Background(), "72d3162e#website-prod")
+
+	resp, _ := handler(context.Background(), config, svc, newDelivery(t, "push", "72d3162e", push))
+	if resp.StatusCode != http.StatusAccepted || len(cp.started) != 0 {
+		t.Fatalf("expected the claim to be held within the lease, got %d %s", resp.StatusCode, resp.Body)
+	}
+
+	expireClaims(svc.Deliveries.(*MemoryDeliveryStore))
+	resp, _ = handler(context.Background(), config, svc, newDelivery(t, "push", "72d3162e", push))
+	if result := readResult(t, resp); resp.StatusCode != http.StatusOK || result.Duplicate || len(cp.started) != 1 {
+		t.Fatalf("expected the stale claim to be taken over, got %d %s", resp.StatusCode, resp.Body)
+	}
+
+	// A completed delivery does not go stale
+	expireClaims(svc.Deliveries.(*MemoryDeliveryStore))
+	resp, _ = handler(context.Background(), config, svc, newDelivery(t, "push", "72d3162e", push))
+	if result := readResult(t, resp); !result.Duplicate || len(cp.started) != 1 {
+		t.Errorf("expected a duplicate, got %s", resp.Body)
+	}
+}
+
+func mustParseFilters(t *testing.T, raw ...string) Filters {
+	t.Helper()
+
+	filters, err := parseFilters(raw)
+	if err != nil {
+		t.Fatalf("error in parsing filters: %v", err)
+	}
+	return filters
+}
+
+func TestFiltersMatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		filters []string
+		files   []string
+		want    bool
+	}{
+		{
+			name:    "no files",
+			filters: []string{"src/"},
+			want:    false,
+		},
+		{
+			name:    "plain prefix",
+			filters: []string{"src/lambda"},
+			files:   []string{"src/lambda/api/auth/main.go"},
+			want:    true,
+		},
+		{
+			name:    "plain prefix without separator",
+			filters: []string{"src/lambda"},
+			files:   []string{"src/lambdas.md"},
+			want:    true,
+		},
+		{
+			name:    "no match in any file",
+			filters: []string{"src/", "bin/"},
+			files:   []string{"README.md", "docs/diagram.dot"},
+			want:    false,
+		},
+		{
+			name:    "match in a later file",
+			filters: []string{"src/templates"},
+			files:   []string{"README.md", "src/templates/header/logo.svg"},
+			want:    true,
+		},
+		{
+			name:    "double star glob",
+			filters: []string{"src/**/*.go"},
+			files:   []string{"src/lambda/api/auth/main.go"},
+			want:    true,
+		},
+		{
+			name:    "double star matches zero directories",
+			filters: []string{"src/**/*.go"},
+			files:   []string{"src/main.go"},
+			want:    true,
+		},
+		{
+			name:    "single star does not cross directories",
+			filters: []string{"src/*.go"},
+			files:   []string{"src/lambda/main.go"},
+			want:    false,
+		},
+		{
+			name:    "extension",
+			filters: []string{"*.html"},
+			files:   []string{"src/templates/account/email.html"},
+			want:    true,
+		},
+		{
+			name:    "extension does not match other files",
+			filters: []string{"*.html"},
+			files:   []string{"src/templates/header/logo.svg"},
+			want:    false,
+		},
+		{
+			name:    "question mark",
+			filters: []string{"src/lambda/api/?ealth/**"},
+			files:   []string{"src/lambda/api/health/main.go"},
+			want:    true,
+		},
+		{
+			name:    "exclusion after glob",
+			filters: []string{"src/**/*.go", "!**/*_test.go"},
+			files:   []string{"src/lambda/workflow/email/utils_test.go"},
+			want:    false,
+		},
+		{
+			name:    "exclusion keeps other files",
+			filters: []string{"src/**/*.go", "!**/*_test.go"},
+			files: []string{
+				"src/lambda/workflow/email/utils_test.go",
+				"src/lambda/workflow/email/utils.go",
+			},
+			want: true,
+		},
+		{
+			name:    "exclusion of a directory",
+			filters: []string{"src/", "!src/templates/**"},
+			files:   []string{"src/templates/footer/footer.html"},
+			want:    false,
+		},
+		{
+			name:    "later filter overrides exclusion",
+			filters: []string{"src/", "!src/templates/**", "src/templates/footer/"},
+			files:   []string{"src/templates/footer/footer.html"},
+			want:    true,
+		},
+		{
+			name:    "only exclusions",
+			filters: []string{"!docs/**", "!*.md"},
+			files:   []string{"README.md", "docs/diagram.dot"},
+			want:    false,
+		},
+		{
+			name:    "only exclusions with other changes",
+			filters: []string{"!docs/**", "!*.md"},
+			files:   []string{"README.md", "Makefile"},
+			want:    true,
+		},
+		{
+			name:    "blank filters are ignored",
+			filters: []string{"", " src/ "},
+			files:   []string{"src/config.ts"},
+			want:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filters := mustParseFilters(t, tt.filters...)
+			got := false
+			for _, file := range tt.files {
+				got = got || filters.Match(file)
+			}
+			if got != tt.want {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestParseFilters(t *testing.T) {
+	for _, raw := range []string{"!", "/", "!/"} {
+		if _, err := parseFilters([]string{raw}); err == nil {
+			t.Errorf("expected an error for %q", raw)
+		}
+	}
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/google/go-github/github"
+	log "github.com/sirupsen/logrus"
+)
+
+// DispatchPath is the route of the manual dispatches, next to the webhooks on `/`
+const DispatchPath = "/dispatch"
+
+// Headers of a dispatch signed with the dispatch secret.
+// The signature is `sha256=` followed by the hex HMAC of `<timestamp>.<body>`.
+const (
+	DispatchSignatureHeader = "x-dispatch-signature-256"
+	DispatchTimestampHeader = "x-dispatch-timestamp"
+	// DispatchIDHeader is an optional idempotency key, a dispatch is only started once per id
+	DispatchIDHeader = "x-dispatch-id"
+)
+
+// MaxDispatchSkew is how old or early a signed dispatch can be
+const MaxDispatchSkew = 5 * time.Minute
+
+var (
+	commitSHA    = regexp.MustCompile(`^[0-9a-f]{40}$`)
+	variableName = regexp.MustCompile(`^[A-Za-z0-9@_-]+$`)
+)
+
+// DispatchRequest starts a pipeline without a push, e.g. to build a commit again
+//
+//	{
+//	  "pipeline": "website-prod",
+//	  "repository": "khine.net/website",
+//	  "ref": "main",
+//	  "sha": "c3d4...",
+//	  "variables": {"LOG_LEVEL": "debug"},
+//	  "reason": "rebuild after the certificate renewal"
+//	}
+//
+// The pipeline has to be started by a push rule matching the repository and the branch of the ref,
+// whose author policy allows the requester. The sha has to be on the branch, and verified when the
+// rule requires it. Without a sha the pipeline builds whatever its source action fetches.
+type DispatchRequest struct {
+	Pipeline string `json:"pipeline"`
+	// Repository full name, defaults to GITHUB_REPOSITORY
+	Repository string `json:"repository"`
+	// Ref is a branch, with or without `refs/heads/`
+	Ref       string            `json:"ref"`
+	SHA       string            `json:"sha"`
+	Variables map[string]string `json:"variables"`
+	Reason    string            `json:"reason"`
+	// Requester identifies the person behind a signed dispatch,
+	// IAM dispatches are recorded with the arn of the caller
+	Requester string `json:"requester"`
+}
+
+// handleManualDispatch starts the pipeline of an authenticated dispatch request
+func handleManualDispatch(ctx context.Context, config Config, svc Services, evt events.LambdaFunctionURLRequest) (events.LambdaFunctionURLResponse, error) {
+	payload, err := requestBody(evt)
+	if err != nil {
+		log.Errorf("error in decoding request body: %v", err.Error())
+		return buildResponse(http.StatusBadRequest)
+	}
+
+	auth, requester, err := authenticateDispatch(config, evt, payload, time.Now())
+	if err != nil {
+		log.WithFields(log.Fields{
+			"source_ip": evt.RequestContext.HTTP.SourceIP,
+		}).Warnf("rejecting dispatch: %v", err.Error())
+
+		return buildResponse(http.StatusUnauthorized)
+	}
+
+	req := DispatchRequest{}
+	err = json.Unmarshal(payload, &req)
+	if err != nil {
+		return dispatchError(http.StatusBadRequest, fmt.Sprintf("invalid request: %v", err.Error()))
+	}
+	if requester == "" {
+		requester = req.Requester
+	}
+	if req.Repository == "" {
+		req.Repository = config.GithubRepository
+	}
+
+	fields := log.Fields{
+		"auth":       auth,
+		"requester":  requester,
+		"pipeline":   req.Pipeline,
+		"repository": req.Repository,
+		"ref":        req.Ref,
+		"sha":        req.SHA,
+		"reason":     req.Reason,
+	}
+
+	rule, err := validateDispatch(config.Routes, req, requester)
+	if err != nil {
+		log.WithFields(fields).Warnf("rejecting dispatch: %v", err.Error())
+		return dispatchError(http.StatusBadRequest, err.Error())
+	}
+
+	reason, err := checkDispatchCommit(ctx, svc.Github, rule, req)
+	if err != nil {
+		log.WithFields(fields).Errorf("error in checking dispatch commit: %v", err.Error())
+		return buildResponse(http.StatusInternalServerError)
+	}
+	if reason != "" {
+		log.WithFields(fields).Warnf("rejecting dispatch: %v", reason)
+		return dispatchError(http.StatusBadRequest, reason)
+	}
+
+	deliveryID := ""
+	if id := evt.Headers[DispatchIDHeader]; id != "" {
+		deliveryID = "dispatch-" + id
+	}
+
+	log.WithFields(fields).Infoln("dispatching pipeline")
+
+	return startAndRecord(ctx, svc, deliveryID, []Rule{rule}, dispatchTrigger(req, requester, auth))
+}
+
+// authenticateDispatch returns how the request was authenticated and, for IAM, who sent it.
+// IAM requests come through a function url with the AWS_IAM auth type, which fills in the authorizer.
+func authenticateDispatch(config Config, evt events.LambdaFunctionURLRequest, body []byte, now time.Time) (string, string, error) {
+	if authorizer := evt.RequestContext.Authorizer; authorizer != nil && authorizer.IAM != nil {
+		return "iam", authorizer.IAM.UserARN, nil
+	}
+
+	if len(config.DispatchSecret) == 0 {
+		return "", "", fmt.Errorf("request is not signed by IAM and there is no dispatch secret")
+	}
+
+	timestamp, err := strconv.ParseInt(evt.Headers[DispatchTimestampHeader], 10, 64)
+	if err != nil {
+		return "", "", fmt.Errorf("missing or invalid %s header", DispatchTimestampHeader)
+	}
+	skew := now.Sub(time.Unix(timestamp, 0))
+	if skew > MaxDispatchSkew || skew < -MaxDispatchSkew {
+		return "", "", fmt.Errorf("request timestamp is %v off", skew)
+	}
+
+	sig := evt.Headers[DispatchSignatureHeader]
+	if !strings.HasPrefix(sig, "sha256=") {
+		return "", "", fmt.Errorf("missing or invalid %s header", DispatchSignatureHeader)
+	}
+	signed := append([]byte(evt.Headers[DispatchTimestampHeader]+"."), body...)
+	err = validateHMAC(config.DispatchSecret, strings.TrimPrefix(sig, "sha256="), signed)
+	if err != nil {
+		return "", "", err
+	}
+
+	return "signature", "", nil
+}
+
+// validateDispatch returns the push rule starting the pipeline on the branch of the request for the requester
+func validateDispatch(routes *Routes, req DispatchRequest, requester string) (Rule, error) {
+	switch {
+	case requester == "":
+		return Rule{}, fmt.Errorf("requester is required")
+	case req.Reason == "":
+		return Rule{}, fmt.Errorf("reason is required")
+	case req.Pipeline == "":
+		return Rule{}, fmt.Errorf("pipeline is required")
+	case req.Ref == "":
+		return Rule{}, fmt.Errorf("ref is required")
+	case req.SHA != "" && !commitSHA.MatchString(req.SHA):
+		return Rule{}, fmt.Errorf("sha must be a full commit sha")
+	}
+
+	branch := strings.TrimPrefix(req.Ref, "refs/heads/")
+	routed := false
+	denied := ""
+	for _, rule := range routes.Rules {
+		if rule.Event != "push" || rule.Pipeline != req.Pipeline {
+			continue
+		}
+		routed = true
+		if rule.repository != nil && !rule.repository.MatchString(strings.ToLower(req.Repository)) {
+			continue
+		}
+		if !rule.branch.MatchString(branch) {
+			continue
+		}
+		if reason := rule.Authors.Check(Change{Authors: []string{requester}}); reason != "" {
+			denied = fmt.Sprintf("rule %s does not allow the requester: %s", rule.Name, reason)
+			continue
+		}
+
+		if len(req.Variables) > 0 && !rule.Variables {
+			return Rule{}, fmt.Errorf("rule %s does not pass variables to %s", rule.Name, rule.Pipeline)
+		}
+		for name := range req.Variables {
+			if !variableName.MatchString(name) {
+				return Rule{}, fmt.Errorf("invalid variable name %q", name)
+			}
+			if isTriggerVariable(name) {
+				return Rule{}, fmt.Errorf("variable %s is set by trigger-fn", name)
+			}
+		}
+
+		return rule, nil
+	}
+
+	if !routed {
+		return Rule{}, fmt.Errorf("pipeline %s is not started by any push rule", req.Pipeline)
+	}
+	if denied != "" {
+		return Rule{}, errors.New(denied)
+	}
+	if req.Repository != "" {
+		return Rule{}, fmt.Errorf("pipeline %s is not started for %s on %s", req.Pipeline, branch, req.Repository)
+	}
+	return Rule{}, fmt.Errorf("pipeline %s is not started for %s", req.Pipeline, branch)
+}
+
+// checkDispatchCommit returns why the commit of the dispatch can not be built by the rule, or an
+// empty string when it can. The commit has to be on the branch, so that e.g. the head of a fork pull
+// request is not built with the variables of the branch.
+func checkDispatchCommit(ctx context.Context, client *github.Client, rule Rule, req DispatchRequest) (string, error) {
+	branch := strings.TrimPrefix(req.Ref, "refs/heads/")
+	if req.SHA == "" {
+		if rule.RequireVerified {
+			return fmt.Sprintf("rule %s requires verified commits, sha is required", rule.Name), nil
+		}
+		return "", nil
+	}
+
+	if client == nil {
+		return fmt.Sprintf("there is no github token to check that %s is on %s", req.SHA, branch), nil
+	}
+	owner, repo, ok := splitFullName(req.Repository)
+	if !ok {
+		return fmt.Sprintf("invalid repository %s", req.Repository), nil
+	}
+
+	// https://docs.github.com/en/rest/commits/commits#compare-two-commits
+	comparison, _, err := client.Repositories.CompareCommits(ctx, owner, repo, branch, req.SHA)
+	if err != nil {
+		return "", fmt.Errorf("error in comparing %s with %s: %v", req.SHA, branch, err.Error())
+	}
+	// The branch contains the commit when the commit is behind or at its head
+	if status := comparison.GetStatus(); status != "behind" && status != "identical" {
+		return fmt.Sprintf("%s is not on %s", req.SHA, branch), nil
+	}
+
+	if rule.RequireVerified {
+		verified, err := isVerified(ctx, client, req.Repository, req.SHA)
+		if err != nil {
+			return "", fmt.Errorf("error in looking up commit signature: %v", err.Error())
+		}
+		if !verified {
+			return fmt.Sprintf("%s is not verified", req.SHA), nil
+		}
+	}
+
+	return "", nil
+}
+
+func isTriggerVariable(name string) bool {
+	switch name {
+	case VariableCommitID, VariableRef, VariableBranch, VariablePusher, VariableCommitMessage, VariableChangedPaths,
+		VariableAffectedLambdas, VariablePRNumber, VariablePRAction, VariableBaseBranch, VariableEnvironment:
+		return true
+	}
+	return false
+}
+
+func dispatchTrigger(req DispatchRequest, requester, auth string) Trigger {
+	branch := strings.TrimPrefix(req.Ref, "refs/heads/")
+
+	variables := map[string]string{}
+	for name, value := range req.Variables {
+		variables[name] = value
+	}
+	variables[VariableCommitID] = req.SHA
+	variables[VariableRef] = "refs/heads/" + branch
+	variables[VariableBranch] = branch
+	variables[VariablePusher] = requester
+
+	trigger := Trigger{
+		SHA:         req.SHA,
+		Provider:    ProviderGithub,
+		Variables:   variables,
+		RequestedBy: requester,
+		Reason:      req.Reason,
+		Fields: log.Fields{
+			"repository":  req.Repository,
+			"branch":      branch,
+			"head_commit": req.SHA,
+			"requester":   requester,
+			"auth":        auth,
+			"reason":      req.Reason,
+		},
+	}
+	// Statuses can only be reported for a known commit
+	if req.SHA != "" {
+		trigger.Repository = req.Repository
+	}
+
+	return trigger
+}
+
+func dispatchError(statusCode int, message string) (events.LambdaFunctionURLResponse, error) {
+	return buildJSONResponse(statusCode, Result{
+		Executions: []Execution{},
+		Error:      message,
+	})
+}
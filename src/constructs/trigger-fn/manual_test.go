@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+var testDispatchSecret = []byte("trigger-fn-dispatch-secret")
+
+const testDispatchSHA = "c3d4e5f60718293a4b5c6d7e8f9012345678abcd"
+
+// newDispatch builds a manual dispatch signed with the dispatch secret
+func newDispatch(t *testing.T, req DispatchRequest) events.LambdaFunctionURLRequest {
+	t.Helper()
+
+	b, err := json.Marshal(req)
+	if err != nil {
+		t.Fatalf("error in marshalling request: %v", err)
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	mac := hmac.New(sha256.New, testDispatchSecret)
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(b)
+
+	return events.LambdaFunctionURLRequest{
+		RawPath: DispatchPath,
+		Headers: map[string]string{
+			DispatchTimestampHeader: timestamp,
+			DispatchSignatureHeader: "sha256=" + hex.EncodeToString(mac.Sum(nil)),
+		},
+		Body: string(b),
+	}
+}
+
+func TestHandleManualDispatch(t *testing.T) {
+	config := testConfig(t, testEnvRoutes)
+	config.DispatchSecret = testDispatchSecret
+	config.GithubRepository = "nkhine/khine.net"
+	config.Routes.Rules[0].SourceAction = "Source"
+	svc, cp := testServices()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/repos/nkhine/khine.net/compare/main..."+testDispatchSHA, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"status":"behind"}`)
+	})
+	svc.Github = newFakeGithub(t, mux)
+
+	req := DispatchRequest{
+		Pipeline:  "website-prod",
+		Ref:       "refs/heads/main",
+		SHA:       testDispatchSHA,
+		Variables: map[string]string{"LOG_LEVEL": "debug"},
+		Reason:    "rebuild after the certificate renewal",
+		Requester: "nkhine",
+	}
+	evt := newDispatch(t, req)
+	evt.Headers[DispatchIDHeader] = "rebuild-1"
+
+	resp, _ := handler(context.Background(), config, svc, evt)
+	if resp.StatusCode != http.StatusOK || len(cp.started) != 1 {
+		t.Fatalf("expected website-prod to be started, got %d %s", resp.StatusCode, resp.Body)
+	}
+	if v := *cp.started[0].SourceRevisions[0].RevisionValue; v != testDispatchSHA {
+		t.Errorf("expected the requested commit, got %s", v)
+	}
+	variables := map[string]string{}
+	for _, v := range cp.started[0].Variables {
+		variables[*v.Name] = *v.Value
+	}
+	if variables["LOG_LEVEL"] != "debug" || variables[VariablePusher] != "nkhine" || variables[VariableBranch] != "main" {
+		t.Errorf("unexpected variables %v", variables)
+	}
+
+	records := svc.Executions.(*MemoryExecutionRecorder).Records
+	if len(records) != 1 || records[0].RequestedBy != "nkhine" || records[0].Reason != req.Reason || records[0].Repository != "nkhine/khine.net" {
+		t.Errorf("expected the requester to be recorded, got %+v", records)
+	}
+
+	// The dispatch id is an idempotency key
+	resp, _ = handler(context.Background(), config, svc, evt)
+	if result := readResult(t, resp); !result.Duplicate || len(cp.started) != 1 {
+		t.Errorf("expected the dispatch to be started once, got %s", resp.Body)
+	}
+}
+
+func TestManualDispatchAuthentication(t *testing.T) {
+	config := testConfig(t, testEnvRoutes)
+	config.DispatchSecret = testDispatchSecret
+	svc, cp := testServices()
+
+	req := DispatchRequest{Pipeline: "website-prod", Ref: "main", Reason: "rerun", Requester: "nkhine"}
+
+	evt := newDispatch(t, req)
+	evt.Body = `{"pipeline":"website-docs","ref":"main","reason":"rerun","requester":"nkhine"}`
+	if resp, _ := handler(context.Background(), config, svc, evt); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected a tampered body to be rejected, got %d", resp.StatusCode)
+	}
+
+	evt = newDispatch(t, req)
+	_, _, err := authenticateDispatch(config, evt, []byte(evt.Body), time.Now().Add(10*time.Minute))
+	if err == nil {
+		t.Errorf("expected a stale request to be rejected")
+	}
+
+	// Without the secret only IAM is accepted
+	config.DispatchSecret = nil
+	if resp, _ := handler(context.Background(), config, svc, newDispatch(t, req)); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected the signed request to be rejected, got %d", resp.StatusCode)
+	}
+
+	evt = events.LambdaFunctionURLRequest{RawPath: DispatchPath, Body: `{"pipeline":"website-prod","ref":"main","reason":"rerun"}`}
+	evt.RequestContext.Authorizer = &events.LambdaFunctionURLRequestContextAuthorizerDescription{
+		IAM: &events.LambdaFunctionURLRequestContextAuthorizerIAMDescription{
+			UserARN: "arn:aws:iam::123456789012:user/nkhine",
+		},
+	}
+	resp, _ := handler(context.Background(), config, svc, evt)
+	if resp.StatusCode != http.StatusOK || len(cp.started) != 1 {
+		t.Fatalf("expected the IAM request to start website-prod, got %d %s", resp.StatusCode, resp.Body)
+	}
+	if records := svc.Executions.(*MemoryExecutionRecorder).Records; records[0].RequestedBy != "arn:aws:iam::123456789012:user/nkhine" {
+		t.Errorf("expected the caller arn to be recorded, got %+v", records[0])
+	}
+}
+
+func TestValidateDispatch(t *testing.T) {
+	routes, err := parseRoutes([]byte(testEnvRoutes))
+	if err != nil {
+		t.Fatalf("error in parsing routes: %v", err)
+	}
+
+	valid := DispatchRequest{Pipeline: "website-prod", Ref: "main", Reason: "rerun"}
+	tests := []struct {
+		name   string
+		modify func(req *DispatchRequest)
+		want   string
+	}{
+		{"valid", func(req *DispatchRequest) {}, ""},
+		{"no reason", func(req *DispatchRequest) { req.Reason = "" }, "reason is required"},
+		{"short sha", func(req *DispatchRequest) { req.SHA = "c3d4e5f" }, "sha must be a full commit sha"},
+		{"unknown pipeline", func(req *DispatchRequest) { req.Pipeline = "someone-else" }, "pipeline someone-else is not started by any push rule"},
+		{"other branch", func(req *DispatchRequest) { req.Ref = "refs/heads/feature" }, "pipeline website-prod is not started for feature"},
+		{"reserved variable", func(req *DispatchRequest) { req.Variables = map[string]string{VariableCommitID: "x"} }, "variable COMMIT_ID is set by trigger-fn"},
+		{"no variables", func(req *DispatchRequest) {
+			req.Pipeline = "website-docs"
+			req.Variables = map[string]string{"LOG_LEVEL": "debug"}
+		}, "rule docs does not pass variables to website-docs"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := valid
+			tt.modify(&req)
+
+			_, err := validateDispatch(routes, req, "nkhine")
+			got := ""
+			if err != nil {
+				got = err.Error()
+			}
+			if got != tt.want {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestValidateDispatchAuthors(t *testing.T) {
+	routes, err := parseRoutes([]byte("rules:\n  - name: prod\n    branch: main\n    pipeline: website-prod\n    authors:\n      allow: [nkhine]\n"))
+	if err != nil {
+		t.Fatalf("error in parsing routes: %v", err)
+	}
+
+	req := DispatchRequest{Pipeline: "website-prod", Ref: "main", Reason: "rerun"}
+	if _, err := validateDispatch(routes, req, "nkhine"); err != nil {
+		t.Errorf("expected nkhine to be allowed, got %v", err)
+	}
+	_, err = validateDispatch(routes, req, "someone")
+	if err == nil || err.Error() != "rule prod does not allow the requester: someone is not allowed" {
+		t.Errorf("expected someone to be rejected, got %v", err)
+	}
+}
+
+func TestCheckDispatchCommit(t *testing.T) {
+	statuses := map[string]string{"a1b2": "behind", "b2c3": "identical", "c3d4": "diverged"}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/repos/nkhine/khine.net/compare/", func(w http.ResponseWriter, r *http.Request) {
+		sha := strings.TrimPrefix(r.URL.Path, "/repos/nkhine/khine.net/compare/main...")
+		fmt.Fprintf(w, `{"status":%q}`, statuses[sha])
+	})
+	mux.HandleFunc("/repos/nkhine/khine.net/commits/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"commit":{"verification":{"verified":%v}}}`, strings.HasSuffix(r.URL.Path, "/a1b2"))
+	})
+	client := newFakeGithub(t, mux)
+
+	rule := Rule{Name: "prod"}
+	verified := Rule{Name: "prod", RequireVerified: true}
+	tests := []struct {
+		rule Rule
+		sha  string
+		want string
+	}{
+		{rule, "", ""},
+		{rule, "a1b2", ""},
+		{rule, "b2c3", ""},
+		{rule, "c3d4", "c3d4 is not on main"},
+		{verified, "a1b2", ""},
+		{verified, "b2c3", "b2c3 is not verified"},
+		{verified, "", "rule prod requires verified commits, sha is required"},
+	}
+	for _, tt := range tests {
+		req := DispatchRequest{Repository: "nkhine/khine.net", Ref: "refs/heads/main", SHA: tt.sha}
+		got, err := checkDispatchCommit(context.Background(), client, tt.rule, req)
+		if err != nil || got != tt.want {
+			t.Errorf("%s: expected %q, got %q %v", tt.sha, tt.want, got, err)
+		}
+	}
+
+	req := DispatchRequest{Repository: "nkhine/khine.net", Ref: "main", SHA: "a1b2"}
+	if got, _ := checkDispatchCommit(context.Background(), nil, rule, req); got == "" {
+		t.Errorf("expected the commit to be rejected without a github token")
+	}
+}
+
+func TestValidateDispatchRepository(t *testing.T) {
+	routes, err := parseRoutes([]byte("rules:\n  - repository: khine.net/*\n    branch: main\n    pipeline: website-prod\n"))
+	if err != nil {
+		t.Fatalf("error in parsing routes: %v", err)
+	}
+
+	req := DispatchRequest{Pipeline: "website-prod", Repository: "khine.net/website", Ref: "main", Reason: "rerun"}
+	if _, err := validateDispatch(routes, req, "nkhine"); err != nil {
+		t.Errorf("expected the dispatch to be valid, got %v", err)
+	}
+
+	req.Repository = "nkhine/blog"
+	_, err = validateDispatch(routes, req, "nkhine")
+	if err == nil || err.Error() != "pipeline website-prod is not started for main on nkhine/blog" {
+		t.Errorf("expected the other repository to be rejected, got %v", err)
+	}
+}
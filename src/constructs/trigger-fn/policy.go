@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/google/go-github/github"
+)
+
+// knownBots are bot accounts whose name does not end with `[bot]`
+var knownBots = map[string]bool{
+	"dependabot":   true,
+	"renovate":     true,
+	"renovate-bot": true,
+}
+
+// AuthorPolicy restricts who can start the pipeline of a rule, e.g.
+//
+//	authors:
+//	  allow: [nkhine]
+//	  deny: [old-ci-user]
+//	  ignore_bots: true
+type AuthorPolicy struct {
+	// Allow lists the only pushers allowed to start the pipeline, everyone is allowed when empty
+	Allow []string `json:"allow" yaml:"allow"`
+	// Deny lists the pushers and commit authors that never start the pipeline
+	Deny []string `json:"deny" yaml:"deny"`
+	// IgnoreBots skips the events pushed or authored by a bot, e.g. dependabot[bot] or renovate[bot]
+	IgnoreBots bool `json:"ignore_bots" yaml:"ignore_bots"`
+}
+
+// Check returns why the authors of the change are not allowed, or an empty string when they are.
+// The first author is the pusher, the others are the authors of the commits.
+func (policy AuthorPolicy) Check(change Change) string {
+	for _, author := range change.Authors {
+		if containsFold(policy.Deny, author) {
+			return fmt.Sprintf("%s is denied", author)
+		}
+		if policy.IgnoreBots && isBot(author) {
+			return fmt.Sprintf("%s is a bot", author)
+		}
+	}
+	if policy.IgnoreBots && change.Bot {
+		return "event was sent by a bot"
+	}
+
+	if len(policy.Allow) > 0 {
+		pusher := ""
+		if len(change.Authors) > 0 {
+			pusher = change.Authors[0]
+		}
+		if !containsFold(policy.Allow, pusher) {
+			return fmt.Sprintf("%s is not allowed", pusher)
+		}
+	}
+
+	return ""
+}
+
+func isBot(name string) bool {
+	name = strings.ToLower(name)
+	return strings.HasSuffix(name, "[bot]") || knownBots[name]
+}
+
+func containsFold(list []string, s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// splitList splits a comma separated list, ignoring blank entries
+func splitList(s string) []string {
+	list := []string{}
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// authors returns the pusher followed by the other distinct authors
+func authors(pusher string, others ...string) []string {
+	list := []string{pusher}
+	seen := map[string]bool{strings.ToLower(pusher): true}
+	for _, author := range others {
+		if author != "" && !seen[strings.ToLower(author)] {
+			seen[strings.ToLower(author)] = true
+			list = append(list, author)
+		}
+	}
+
+	return list
+}
+
+// commitAuthor returns the username of the author of the commit, or its name
+func commitAuthor(commit Commit) string {
+	if commit.Author.Username != "" {
+		return commit.Author.Username
+	}
+	return commit.Author.Name
+}
+
+// NeedsVerification reports whether a rule for the event on the branch requires a verified head commit
+func (routes *Routes) NeedsVerification(event, branch string) bool {
+	for _, rule := range routes.Rules {
+		if rule.Event == event && rule.branch.MatchString(branch) && rule.RequireVerified {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isVerified reports whether github verified the signature of the commit
+// https://docs.github.com/en/rest/commits/commits#get-a-commit
+func isVerified(ctx context.Context, client *github.Client, fullName, sha string) (bool, error) {
+	if client == nil {
+		return false, fmt.Errorf("there is no github token to look up the commit")
+	}
+	owner, repo, ok := splitFullName(fullName)
+	if !ok {
+		return false, fmt.Errorf("invalid repository %s", fullName)
+	}
+
+	commit, _, err := client.Repositories.GetCommit(ctx, owner, repo, sha)
+	if err != nil {
+		return false, err
+	}
+
+	return commit.GetCommit().GetVerification().GetVerified(), nil
+}
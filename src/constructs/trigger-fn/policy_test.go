@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+const testPolicyRoutes = `
+rules:
+  - name: prod
+    branch: main
+    pipeline: website-prod
+    authors:
+      deny: [old-ci-user]
+      ignore_bots: true
+    require_verified: true
+  - name: staging
+    branch: main
+    pipeline: website-staging
+    authors:
+      allow: [nkhine]
+`
+
+func TestAuthorPolicyCheck(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy AuthorPolicy
+		change Change
+		want   string
+	}{
+		{"no policy", AuthorPolicy{}, Change{Authors: []string{"dependabot[bot]"}}, ""},
+		{"allowed pusher", AuthorPolicy{Allow: []string{"nkhine"}}, Change{Authors: []string{"NKhine", "someone"}}, ""},
+		{"pusher not allowed", AuthorPolicy{Allow: []string{"nkhine"}}, Change{Authors: []string{"someone", "nkhine"}}, "someone is not allowed"},
+		{"denied author", AuthorPolicy{Deny: []string{"old-ci-user"}}, Change{Authors: []string{"nkhine", "old-ci-user"}}, "old-ci-user is denied"},
+		{"bot suffix", AuthorPolicy{IgnoreBots: true}, Change{Authors: []string{"renovate[bot]"}}, "renovate[bot] is a bot"},
+		{"known bot", AuthorPolicy{IgnoreBots: true}, Change{Authors: []string{"nkhine", "dependabot"}}, "dependabot is a bot"},
+		{"bot sender", AuthorPolicy{IgnoreBots: true}, Change{Authors: []string{"nkhine"}, Bot: true}, "event was sent by a bot"},
+		{"bots allowed", AuthorPolicy{}, Change{Authors: []string{"nkhine"}, Bot: true}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.Check(tt.change); got != tt.want {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestAuthors(t *testing.T) {
+	got := authors("nkhine", "NKhine", "", "someone")
+	if want := []string{"nkhine", "someone"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
+
+func TestHandlerAuthorPolicies(t *testing.T) {
+	verified := false
+	mux := http.NewServeMux()
+	mux.HandleFunc("/repos/nkhine/khine.net/commits/b2c3", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"sha":"b2c3","commit":{"verification":{"verified":%t}}}`, verified)
+	})
+
+	config := testConfig(t, testPolicyRoutes)
+	svc, cp := testServices()
+	svc.Github = newFakeGithub(t, mux)
+
+	push := func(pusher string) GithubEvent {
+		evt := GithubEvent{
+			Ref:        "refs/heads/main",
+			After:      "b2c3",
+			HeadCommit: Commit{ID: "b2c3"},
+			Commits:    []Commit{{ID: "b2c3", Modified: []string{"src/config.ts"}}},
+		}
+		evt.Repository.FullName = "nkhine/khine.net"
+		evt.Pusher.Name = pusher
+		return evt
+	}
+
+	started := func() []string {
+		pipelines := []string{}
+		for _, input := range cp.started {
+			pipelines = append(pipelines, *input.Name)
+		}
+		cp.started = nil
+		return pipelines
+	}
+
+	// The head commit is not verified
+	resp, _ := handler(context.Background(), config, svc, newDelivery(t, "push", "", push("nkhine")))
+	if got := started(); !reflect.DeepEqual(got, []string{"website-staging"}) {
+		t.Errorf("expected website-staging only, got %v: %s", got, resp.Body)
+	}
+
+	verified = true
+	resp, _ = handler(context.Background(), config, svc, newDelivery(t, "push", "", push("nkhine")))
+	if got := started(); !reflect.DeepEqual(got, []string{"website-prod", "website-staging"}) {
+		t.Errorf("expected both pipelines, got %v: %s", got, resp.Body)
+	}
+
+	// Bots are ignored by prod and not allowed by staging
+	resp, _ = handler(context.Background(), config, svc, newDelivery(t, "push", "", push("dependabot[bot]")))
+	if got := started(); len(got) != 0 {
+		t.Errorf("expected no pipeline for dependabot, got %v: %s", got, resp.Body)
+	}
+
+	verified = false
+	evt := newDelivery(t, "push", "", push("nkhine"))
+	evt.Headers[DryRunHeader] = "true"
+	resp, _ = handler(context.Background(), config, svc, evt)
+	result := readResult(t, resp)
+	if result.Explanation == nil || len(result.Explanation.Rules) != 2 {
+		t.Fatalf("expected an explanation, got %s", resp.Body)
+	}
+	if reason := result.Explanation.Rules[0].Reason; reason != "head commit is not verified" {
+		t.Errorf("unexpected reason %q", reason)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// Names of the supported git providers
+const (
+	ProviderGithub    = "github"
+	ProviderGitlab    = "gitlab"
+	ProviderGitea     = "gitea"
+	ProviderBitbucket = "bitbucket"
+)
+
+// PushEvent is a push normalised across the git providers
+type PushEvent struct {
+	// Provider is the name of the provider that sent the push
+	Provider string
+	Ref      string
+	Before   string
+	After    string
+	Created  bool
+	Deleted  bool
+	Forced   bool
+	// Repository full name, e.g. `nkhine/khine.net`
+	Repository    string
+	DefaultBranch string
+	Pusher        string
+	// PushedAt is only sent by github
+	PushedAt   int
+	HeadCommit Commit
+	Commits    []Commit
+	// Truncated is set when the commits do not carry the full list of changed files
+	Truncated bool
+	// Bot is set when the provider reports that a bot account sent the push
+	Bot bool
+}
+
+// Provider detects, authenticates and normalises the webhook deliveries of a git provider
+type Provider interface {
+	Name() string
+	// Detect reports whether the request was sent by the provider
+	Detect(headers map[string]string) bool
+	// Verify authenticates the request with the shared webhook secret
+	Verify(secret []byte, headers map[string]string, body []byte) error
+	// Event returns the type of the event, `push` for pushes
+	Event(headers map[string]string) string
+	DeliveryID(headers map[string]string) string
+	ParsePush(body []byte) (*PushEvent, error)
+}
+
+// Providers are detected in order. Gitea also sends the github headers so it goes first.
+var Providers = []Provider{
+	GiteaProvider{},
+	GitlabProvider{},
+	BitbucketProvider{},
+	GithubProvider{},
+}
+
+// detectProvider finds the provider that sent the request, github when none is detected
+func detectProvider(headers map[string]string) Provider {
+	for _, provider := range Providers {
+		if provider.Detect(headers) {
+			return provider
+		}
+	}
+
+	return GithubProvider{}
+}
+
+// GithubProvider handles the deliveries of github and github enterprise
+// https://docs.github.com/en/webhooks/webhook-events-and-payloads#delivery-headers
+type GithubProvider struct{}
+
+func (GithubProvider) Name() string {
+	return ProviderGithub
+}
+
+func (GithubProvider) Detect(headers map[string]string) bool {
+	return headers[EventHeader] != ""
+}
+
+func (GithubProvider) Verify(secret []byte, headers map[string]string, body []byte) error {
+	return validateSignature(secret, headers[SignatureHeader], body)
+}
+
+// Event defaults to push, the event header used to be optional
+func (GithubProvider) Event(headers map[string]string) string {
+	if v := headers[EventHeader]; v != "" {
+		return v
+	}
+	return "push"
+}
+
+func (GithubProvider) DeliveryID(headers map[string]string) string {
+	return headers[DeliveryHeader]
+}
+
+func (GithubProvider) ParsePush(body []byte) (*PushEvent, error) {
+	ghEvt := GithubEvent{}
+	err := json.Unmarshal(body, &ghEvt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &PushEvent{
+		Provider:      ProviderGithub,
+		Ref:           ghEvt.Ref,
+		Before:        ghEvt.Before,
+		After:         ghEvt.After,
+		Created:       ghEvt.Created,
+		Deleted:       ghEvt.Deleted,
+		Forced:        ghEvt.Forced,
+		Repository:    ghEvt.Repository.FullName,
+		DefaultBranch: ghEvt.Repository.DefaultBranch,
+		Pusher:        ghEvt.Pusher.Name,
+		PushedAt:      ghEvt.Repository.PushedAt,
+		HeadCommit:    ghEvt.HeadCommit,
+		Commits:       ghEvt.Commits,
+		Truncated:     isTruncated(ghEvt),
+		Bot:           ghEvt.Sender.Type == "Bot",
+	}, nil
+}
+
+// branchRef returns the branch of a `refs/heads/` ref
+func branchRef(ref string) (string, bool) {
+	if !strings.HasPrefix(ref, "refs/heads/") {
+		return "", false
+	}
+	return strings.TrimPrefix(ref, "refs/heads/"), true
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+const gitlabPush = `{
+  "object_kind": "push",
+  "ref": "refs/heads/main",
+  "before": "a1b2",
+  "after": "c3d4",
+  "checkout_sha": "c3d4",
+  "user_username": "nkhine",
+  "project": {"path_with_namespace": "nkhine/khine.net", "default_branch": "main"},
+  "commits": [
+    {"id": "b2c3", "message": "Update footer", "modified": ["src/templates/footer/footer.html"]},
+    {"id": "c3d4", "message": "Update docs", "added": ["docs/diagram.dot"]}
+  ],
+  "total_commits_count": 2
+}`
+
+const giteaPush = `{
+  "ref": "refs/heads/main",
+  "before": "a1b2",
+  "after": "c3d4",
+  "repository": {"full_name": "nkhine/khine.net", "default_branch": "main"},
+  "pusher": {"login": "nkhine"},
+  "commits": [
+    {"id": "c3d4", "message": "Update config", "modified": ["src/config.ts"]}
+  ],
+  "total_commits": 1,
+  "head_commit": {"id": "c3d4", "message": "Update config", "modified": ["src/config.ts"]}
+}`
+
+const bitbucketPush = `{
+  "actor": {"display_name": "Nay Khine", "nickname": "nkhine"},
+  "repository": {"full_name": "nkhine/khine.net"},
+  "push": {"changes": [{
+    "old": {"type": "branch", "name": "main", "target": {"hash": "a1b2"}},
+    "new": {"type": "branch", "name": "main", "target": {"hash": "c3d4", "message": "Update config"}},
+    "commits": [{"hash": "c3d4", "message": "Update config"}, {"hash": "b2c3", "message": "Update footer"}]
+  }]}
+}`
+
+func hexHMAC(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestDetectProvider(t *testing.T) {
+	tests := []struct {
+		headers map[string]string
+		want    string
+	}{
+		{map[string]string{"x-github-event": "push"}, ProviderGithub},
+		// Gitea also sends the github headers
+		{map[string]string{"x-github-event": "push", "x-gitea-event": "push"}, ProviderGitea},
+		{map[string]string{"x-gitlab-event": "Push Hook"}, ProviderGitlab},
+		{map[string]string{"x-event-key": "repo:push"}, ProviderBitbucket},
+		{map[string]string{}, ProviderGithub},
+	}
+
+	for _, tt := range tests {
+		if got := detectProvider(tt.headers).Name(); got != tt.want {
+			t.Errorf("expected %s for %v, got %s", tt.want, tt.headers, got)
+		}
+	}
+}
+
+func TestProviderVerify(t *testing.T) {
+	body := []byte(`{"ref": "refs/heads/main"}`)
+
+	tests := []struct {
+		name     string
+		provider Provider
+		headers  map[string]string
+		want     error
+	}{
+		{"gitlab token", GitlabProvider{}, map[string]string{GitlabTokenHeader: string(testSecret)}, nil},
+		{"gitlab wrong token", GitlabProvider{}, map[string]string{GitlabTokenHeader: "forged"}, ErrInvalidSignature},
+		{"gitlab no token", GitlabProvider{}, map[string]string{}, ErrMissingSignature},
+		{"gitea signature", GiteaProvider{}, map[string]string{GiteaSignatureHeader: hexHMAC(testSecret, body)}, nil},
+		{"gitea forged", GiteaProvider{}, map[string]string{GiteaSignatureHeader: hexHMAC([]byte("forged"), body)}, ErrInvalidSignature},
+		{"bitbucket signature", BitbucketProvider{}, map[string]string{BitbucketSignatureHeader: sign(testSecret, body)}, nil},
+		{"bitbucket no signature", BitbucketProvider{}, map[string]string{}, ErrMissingSignature},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.provider.Verify(testSecret, tt.headers, body); got != tt.want {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestParsePush(t *testing.T) {
+	tests := []struct {
+		provider Provider
+		body     string
+		head     string
+		files    []string
+		want     PushEvent
+	}{
+		{GitlabProvider{}, gitlabPush, "Update docs", []string{"src/templates/footer/footer.html", "docs/diagram.dot"}, PushEvent{
+			Provider: ProviderGitlab, Ref: "refs/heads/main", Before: "a1b2", After: "c3d4",
+			Repository: "nkhine/khine.net", DefaultBranch: "main", Pusher: "nkhine",
+		}},
+		{GiteaProvider{}, giteaPush, "Update config", []string{"src/config.ts"}, PushEvent{
+			Provider: ProviderGitea, Ref: "refs/heads/main", Before: "a1b2", After: "c3d4",
+			Repository: "nkhine/khine.net", DefaultBranch: "main", Pusher: "nkhine",
+		}},
+		{BitbucketProvider{}, bitbucketPush, "Update config", []string{}, PushEvent{
+			Provider: ProviderBitbucket, Ref: "refs/heads/main", Before: "a1b2", After: "c3d4",
+			Repository: "nkhine/khine.net", Pusher: "nkhine", Truncated: true,
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.provider.Name(), func(t *testing.T) {
+			push, err := tt.provider.ParsePush([]byte(tt.body))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if push.HeadCommit.ID != "c3d4" || push.HeadCommit.Message != tt.head {
+				t.Errorf("unexpected head commit %v", push.HeadCommit)
+			}
+			if files := changedFiles(push.Commits); !reflect.DeepEqual(files, tt.files) {
+				t.Errorf("expected files %v, got %v", tt.files, files)
+			}
+
+			got := *push
+			got.HeadCommit, got.Commits = Commit{}, nil
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestHandlerProviders(t *testing.T) {
+	config := testConfig(t, testRoutes)
+
+	tests := []struct {
+		name    string
+		headers map[string]string
+		body    string
+		want    []string
+	}{
+		{
+			name:    "gitlab push runs both main pipelines",
+			headers: map[string]string{GitlabEventHeader: "Push Hook", GitlabTokenHeader: string(testSecret)},
+			body:    gitlabPush,
+			want:    []string{"website-prod", "website-docs"},
+		},
+		{
+			name:    "gitea push runs the filtered pipeline",
+			headers: map[string]string{GiteaEventHeader: "push", GiteaSignatureHeader: hexHMAC(testSecret, []byte(giteaPush))},
+			body:    giteaPush,
+			want:    []string{"website-prod"},
+		},
+		{
+			name:    "bitbucket push without a token only runs the rules without filters",
+			headers: map[string]string{BitbucketEventHeader: "repo:push", BitbucketSignatureHeader: sign(testSecret, []byte(bitbucketPush))},
+			body:    bitbucketPush,
+			want:    []string{},
+		},
+		{
+			name:    "gitlab merge requests are ignored",
+			headers: map[string]string{GitlabEventHeader: "Merge Request Hook", GitlabTokenHeader: string(testSecret)},
+			body:    `{"object_kind": "merge_request"}`,
+			want:    []string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc, cp := testServices()
+			resp, _ := handler(context.Background(), config, svc, events.LambdaFunctionURLRequest{
+				Headers: tt.headers,
+				Body:    tt.body,
+			})
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("expected 200, got %d %s", resp.StatusCode, resp.Body)
+			}
+
+			got := []string{}
+			for _, input := range cp.started {
+				got = append(got, *input.Name)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestHandlerBitbucketDiffstat(t *testing.T) {
+	config := testConfig(t, testRoutes)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			t.Errorf("expected the bitbucket token, got %q", r.Header.Get("Authorization"))
+		}
+		switch r.URL.RequestURI() {
+		case "/repositories/nkhine/khine.net/diffstat/c3d4..a1b2?pagelen=500":
+			fmt.Fprintf(w, `{"values": [{"old": {"path": "docs/old.md"}, "new": {"path": "docs/new.md"}}], "next": "http://%s/page2"}`, r.Host)
+		case "/page2":
+			fmt.Fprint(w, `{"values": [{"old": {"path": "src/config.ts"}, "new": null}]}`)
+		default:
+			t.Errorf("unexpected request %s", r.URL.RequestURI())
+		}
+	}))
+	defer server.Close()
+
+	svc, cp := testServices()
+	svc.Bitbucket = &BitbucketClient{Client: server.Client(), BaseURL: server.URL, Token: "token"}
+
+	handler(context.Background(), config, svc, events.LambdaFunctionURLRequest{
+		Headers: map[string]string{BitbucketEventHeader: "repo:push", BitbucketSignatureHeader: sign(testSecret, []byte(bitbucketPush))},
+		Body:    bitbucketPush,
+	})
+
+	got := []string{}
+	for _, input := range cp.started {
+		got = append(got, *input.Name)
+	}
+	if want := []string{"website-prod", "website-docs"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
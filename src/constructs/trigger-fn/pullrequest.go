@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/google/go-github/github"
+	log "github.com/sirupsen/logrus"
+)
+
+// PullRequestEvent is the payload of the `pull_request` event
+// https://docs.github.com/en/webhooks/webhook-events-and-payloads#pull_request
+type PullRequestEvent struct {
+	Action      string `json:"action"`
+	Number      int    `json:"number"`
+	PullRequest struct {
+		Number  int    `json:"number"`
+		State   string `json:"state"`
+		Title   string `json:"title"`
+		Merged  bool   `json:"merged"`
+		HTMLURL string `json:"html_url"`
+		User    struct {
+			Login string `json:"login"`
+		} `json:"user"`
+		Head struct {
+			Ref string `json:"ref"`
+			SHA string `json:"sha"`
+			// Repo is null when the fork was deleted
+			Repo struct {
+				FullName string `json:"full_name"`
+			} `json:"repo"`
+		} `json:"head"`
+		Base struct {
+			Ref string `json:"ref"`
+			SHA string `json:"sha"`
+		} `json:"base"`
+	} `json:"pull_request"`
+	Repository struct {
+		Name     string `json:"name"`
+		FullName string `json:"full_name"`
+	} `json:"repository"`
+	Sender struct {
+		Login string `json:"login"`
+		Type  string `json:"type"`
+	} `json:"sender"`
+}
+
+// handlePullRequest starts the preview pipelines when a pull request is opened or updated
+// and the teardown pipelines when it is closed, depending on the actions of the rules.
+// The pull requests from forks are ignored unless ALLOW_FORK_PULL_REQUESTS is set.
+func handlePullRequest(ctx context.Context, config Config, svc Services, deliveryID string, payload []byte, dryRun bool) (events.LambdaFunctionURLResponse, error) {
+	prEvt := PullRequestEvent{}
+	err := json.Unmarshal(payload, &prEvt)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"request_body": string(payload),
+		}).Errorf("error in umarshalling request body: %v", err.Error())
+
+		return buildBadRequestResponse()
+	}
+
+	pr := prEvt.PullRequest
+	fields := log.Fields{
+		"pr_number":   pr.Number,
+		"pr_action":   prEvt.Action,
+		"base_branch": pr.Base.Ref,
+		"head_commit": pr.Head.SHA,
+		"author":      pr.User.Login,
+		"head_repo":   pr.Head.Repo.FullName,
+	}
+
+	if isFork(prEvt) && !config.AllowForkPullRequests {
+		log.WithFields(fields).Infoln("skipping pull request from a fork")
+		return buildJSONResponse(http.StatusOK, Result{
+			Executions:  []Execution{},
+			DryRun:      dryRun,
+			Explanation: skipped(dryRun, "pull_request", fmt.Sprintf("refs/pull/%d/head", pr.Number), "pull request is from a fork"),
+		})
+	}
+
+	files := []string{}
+	if config.Routes.NeedsFiles("pull_request", pr.Base.Ref) {
+		if svc.Github == nil {
+			log.WithFields(fields).Warnln("rules have filters but there is no github token to list the pull request files")
+		} else {
+			files, err = pullRequestFiles(ctx, svc.Github, prEvt.Repository.FullName, pr.Number)
+			if err != nil {
+				log.WithFields(fields).Errorf("error in listing pull request files: %v", err.Error())
+				return buildResponse(http.StatusInternalServerError)
+			}
+		}
+	}
+
+	change := Change{
+		Event:      "pull_request",
+		Action:     prEvt.Action,
+		Repository: prEvt.Repository.FullName,
+		Branch:     pr.Base.Ref,
+		Files:      files,
+		Lambdas:    config.Manifest.Affected(files),
+		Authors:    authors(prEvt.Sender.Login, pr.User.Login),
+		Bot:        prEvt.Sender.Type == "Bot",
+	}
+	if config.Routes.NeedsVerification("pull_request", pr.Base.Ref) {
+		change.Verified = verifyCommit(ctx, svc, ProviderGithub, prEvt.Repository.FullName, pr.Head.SHA)
+	}
+	if dryRun {
+		return explain(config, change, fmt.Sprintf("refs/pull/%d/head", pr.Number), nil)
+	}
+
+	rules := config.Routes.Match(change)
+	if len(rules) == 0 {
+		log.WithFields(fields).Infoln("skipping event, did not find any matching rules")
+		return buildJSONResponse(http.StatusOK, Result{Executions: []Execution{}})
+	}
+
+	trigger := pullRequestTrigger(prEvt, files)
+	trigger.Variables[VariableAffectedLambdas] = strings.Join(change.Lambdas, ",")
+
+	return startAndRecord(ctx, svc, deliveryID, rules, trigger)
+}
+
+// isFork reports whether the head of the pull request is not in the base repository
+func isFork(prEvt PullRequestEvent) bool {
+	return !strings.EqualFold(prEvt.PullRequest.Head.Repo.FullName, prEvt.Repository.FullName)
+}
+
+func pullRequestTrigger(prEvt PullRequestEvent, files []string) Trigger {
+	pr := prEvt.PullRequest
+
+	return Trigger{
+		SHA:        pr.Head.SHA,
+		Provider:   ProviderGithub,
+		Repository: prEvt.Repository.FullName,
+		Variables: map[string]string{
+			VariableCommitID:     pr.Head.SHA,
+			VariableRef:          fmt.Sprintf("refs/pull/%d/head", pr.Number),
+			VariableBranch:       pr.Head.Ref,
+			VariableBaseBranch:   pr.Base.Ref,
+			VariablePusher:       prEvt.Sender.Login,
+			VariablePRNumber:     strconv.Itoa(pr.Number),
+			VariablePRAction:     prEvt.Action,
+			VariableChangedPaths: summarisePaths(files),
+		},
+		Fields: log.Fields{
+			"pr_number":   pr.Number,
+			"pr_action":   prEvt.Action,
+			"base_branch": pr.Base.Ref,
+			"head_commit": pr.Head.SHA,
+			"author":      pr.User.Login,
+		},
+	}
+}
+
+// pullRequestFiles lists the files changed by a pull request, going through all the pages
+func pullRequestFiles(ctx context.Context, client *github.Client, fullName string, number int) ([]string, error) {
+	owner, repo, ok := splitFullName(fullName)
+	if !ok {
+		return nil, fmt.Errorf("invalid repository %s", fullName)
+	}
+
+	files := []string{}
+	opts := &github.ListOptions{PerPage: 100}
+	for {
+		page, resp, err := client.PullRequests.ListFiles(ctx, owner, repo, number, opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range page {
+			files = append(files, f.GetFilename())
+		}
+
+		if resp.NextPage == 0 {
+			break
+		}
+		opts.Page = resp.NextPage
+	}
+
+	return files, nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+const testPullRequestRoutes = `
+rules:
+  - name: prod
+    branch: main
+    pipeline: website-prod
+  - name: preview
+    event: pull_request
+    branch: main
+    pipeline: website-preview
+    variables: true
+    source_action: Source
+  - name: teardown
+    event: pull_request
+    actions: [closed]
+    branch: main
+    pipeline: website-teardown
+    variables: true
+`
+
+func TestHandlePullRequest(t *testing.T) {
+	config := testConfig(t, testPullRequestRoutes)
+
+	tests := []struct {
+		action string
+		base   string
+		want   string
+	}{
+		{"opened", "main", "website-preview"},
+		{"synchronize", "main", "website-preview"},
+		{"closed", "main", "website-teardown"},
+		{"labeled", "main", ""},
+		{"opened", "release/1.0", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.action+" "+tt.base, func(t *testing.T) {
+			svc, cp := testServices()
+
+			prEvt := PullRequestEvent{Action: tt.action, Number: 42}
+			prEvt.PullRequest.Number = 42
+			prEvt.PullRequest.Head.Ref = "feature/footer"
+			prEvt.PullRequest.Head.SHA = "c3d4"
+			prEvt.PullRequest.Base.Ref = tt.base
+
+			resp, _ := handler(context.Background(), config, svc, newDelivery(t, "pull_request", "", prEvt))
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("expected 200, got %d", resp.StatusCode)
+			}
+
+			if tt.want == "" {
+				if len(cp.started) != 0 {
+					t.Errorf("expected no executions, got %d", len(cp.started))
+				}
+				return
+			}
+
+			if len(cp.started) != 1 || *cp.started[0].Name != tt.want {
+				t.Fatalf("expected %s to start, got %v", tt.want, cp.started)
+			}
+
+			variables := map[string]string{}
+			for _, v := range cp.started[0].Variables {
+				variables[*v.Name] = *v.Value
+			}
+			if variables[VariablePRNumber] != "42" || variables[VariableCommitID] != "c3d4" {
+				t.Errorf("expected the pull request number and head sha, got %v", variables)
+			}
+		})
+	}
+}
+
+func TestHandlePullRequestFromFork(t *testing.T) {
+	config := testConfig(t, testPullRequestRoutes)
+
+	prEvt := PullRequestEvent{Action: "opened", Number: 42}
+	prEvt.PullRequest.Number = 42
+	prEvt.PullRequest.Head.SHA = "c3d4"
+	prEvt.PullRequest.Head.Repo.FullName = "someone/khine.net"
+	prEvt.PullRequest.Base.Ref = "main"
+	prEvt.Repository.FullName = "nkhine/khine.net"
+
+	svc, cp := testServices()
+	resp, _ := handler(context.Background(), config, svc, newDelivery(t, "pull_request", "", prEvt))
+	if resp.StatusCode != http.StatusOK || len(cp.started) != 0 {
+		t.Fatalf("expected the fork to be ignored, got %d %s", resp.StatusCode, resp.Body)
+	}
+
+	evt := newDelivery(t, "pull_request", "", prEvt)
+	evt.Headers[DryRunHeader] = "true"
+	resp, _ = handler(context.Background(), config, svc, evt)
+	if result := readResult(t, resp); result.Explanation == nil || result.Explanation.Reason != "pull request is from a fork" {
+		t.Errorf("expected the fork to be explained, got %s", resp.Body)
+	}
+
+	config.AllowForkPullRequests = true
+	handler(context.Background(), config, svc, newDelivery(t, "pull_request", "", prEvt))
+	if len(cp.started) != 1 || *cp.started[0].Name != "website-preview" {
+		t.Errorf("expected the opted in fork to start website-preview, got %v", cp.started)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	log "github.com/sirupsen/logrus"
+)
+
+// Modes of the trigger-fn binary, see Config.Mode
+const (
+	ModeWebhook  = "webhook"
+	ModeConsumer = "consumer"
+)
+
+// MaxQueueMessageSize is the largest message sqs accepts.
+// Bigger deliveries are processed inline.
+const MaxQueueMessageSize = 256 * 1024
+
+// QueuedDelivery is an authenticated delivery waiting to be processed
+type QueuedDelivery struct {
+	Headers    map[string]string `json:"headers"`
+	Payload    string            `json:"payload"`
+	SourceIP   string            `json:"source_ip"`
+	ReceivedAt time.Time         `json:"received_at"`
+}
+
+// DeliveryQueue hands the deliveries over to the consumer
+type DeliveryQueue interface {
+	Enqueue(ctx context.Context, delivery QueuedDelivery) error
+}
+
+type SQSDeliveryQueue struct {
+	Client   sqsiface.SQSAPI
+	QueueURL string
+}
+
+func (q *SQSDeliveryQueue) Enqueue(ctx context.Context, delivery QueuedDelivery) error {
+	b, err := json.Marshal(delivery)
+	if err != nil {
+		return err
+	}
+
+	_, err = q.Client.SendMessageWithContext(ctx, &sqs.SendMessageInput{
+		QueueUrl:    aws.String(q.QueueURL),
+		MessageBody: aws.String(string(b)),
+	})
+	if err != nil {
+		return fmt.Errorf("error in sending delivery to %s: %v", q.QueueURL, err.Error())
+	}
+
+	return nil
+}
+
+// enqueue queues an authenticated delivery and answers straight away,
+// well within the 10 seconds github waits for a response
+func enqueue(ctx context.Context, config Config, svc Services, provider Provider, evt events.LambdaFunctionURLRequest, payload []byte) (events.LambdaFunctionURLResponse, error) {
+	deliveryID := provider.DeliveryID(evt.Headers)
+	fields := log.Fields{
+		"provider":    provider.Name(),
+		"delivery_id": deliveryID,
+	}
+
+	delivery := QueuedDelivery{
+		Headers:    evt.Headers,
+		Payload:    string(payload),
+		SourceIP:   evt.RequestContext.HTTP.SourceIP,
+		ReceivedAt: time.Now(),
+	}
+
+	b, err := json.Marshal(delivery)
+	if err != nil || len(b) > MaxQueueMessageSize {
+		log.WithFields(fields).WithField("payload_len", len(payload)).Warnln("delivery is too large for the queue, processing it inline")
+		return dispatch(ctx, config, svc, provider, evt.Headers, payload, false)
+	}
+
+	err = svc.Queue.Enqueue(ctx, delivery)
+	if err != nil {
+		log.WithFields(fields).Errorf("error in queueing delivery: %v", err.Error())
+		return buildResponse(http.StatusInternalServerError)
+	}
+
+	log.WithFields(fields).Infoln("queued delivery")
+
+	return buildJSONResponse(http.StatusAccepted, Result{
+		DeliveryID: deliveryID,
+		Executions: []Execution{},
+		Queued:     true,
+	})
+}
+
+// consumer processes the queued deliveries. A delivery failing with a server error, or still
+// being started by an earlier attempt, is reported back to sqs to be retried, and ends up in
+// the dead letter queue. A duplicate of a completed delivery is removed from the queue.
+func consumer(ctx context.Context, config Config, svc Services, evt events.SQSEvent) (events.SQSEventResponse, error) {
+	resp := events.SQSEventResponse{
+		BatchItemFailures: []events.SQSBatchItemFailure{},
+	}
+
+	for _, record := range evt.Records {
+		fields := log.Fields{
+			"message_id":    record.MessageId,
+			"receive_count": record.Attributes["ApproximateReceiveCount"],
+		}
+
+		delivery := QueuedDelivery{}
+		err := json.Unmarshal([]byte(record.Body), &delivery)
+		if err != nil {
+			// Kept for the dead letter queue
+			log.WithFields(fields).Errorf("error in unmarshalling queued delivery: %v", err.Error())
+			resp.BatchItemFailures = append(resp.BatchItemFailures, events.SQSBatchItemFailure{ItemIdentifier: record.MessageId})
+			continue
+		}
+
+		// The delivery was authenticated before it was queued
+		provider := detectProvider(delivery.Headers)
+		fields["provider"] = provider.Name()
+		fields["delivery_id"] = provider.DeliveryID(delivery.Headers)
+		fields["queued_for"] = time.Since(delivery.ReceivedAt).String()
+
+		result, err := dispatch(ctx, config, svc, provider, delivery.Headers, []byte(delivery.Payload), false)
+		// 202 is an earlier attempt holding a claim within its lease. The message is received again
+		// after the visibility timeout, longer than the lease, so the claim of an attempt that died
+		// is taken over then.
+		if err != nil || result.StatusCode >= http.StatusInternalServerError || result.StatusCode == http.StatusAccepted {
+			log.WithFields(fields).WithField("status_code", result.StatusCode).Warnln("delivery failed, it will be retried")
+			resp.BatchItemFailures = append(resp.BatchItemFailures, events.SQSBatchItemFailure{ItemIdentifier: record.MessageId})
+			continue
+		}
+
+		log.WithFields(fields).WithField("status_code", result.StatusCode).Infoln("processed queued delivery")
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/service/codepipeline"
+)
+
+// memoryQueue keeps the queued deliveries as sqs messages
+type memoryQueue struct {
+	messages []events.SQSMessage
+}
+
+func (q *memoryQueue) Enqueue(ctx context.Context, delivery QueuedDelivery) error {
+	b, err := json.Marshal(delivery)
+	if err != nil {
+		return err
+	}
+	q.messages = append(q.messages, events.SQSMessage{
+		MessageId: delivery.Headers[DeliveryHeader],
+		Body:      string(b),
+	})
+	return nil
+}
+
+// brokenCodepipeline fails every start
+type brokenCodepipeline struct {
+	fakeCodepipeline
+}
+
+func (f *brokenCodepipeline) StartPipelineExecution(input *codepipeline.StartPipelineExecutionInput) (*codepipeline.StartPipelineExecutionOutput, error) {
+	return nil, errors.New("ThrottlingException: Rate exceeded")
+}
+
+func TestHandlerQueuesDeliveries(t *testing.T) {
+	config := testConfig(t, testRoutes)
+	svc, cp := testServices()
+	queue := &memoryQueue{}
+	svc.Queue = queue
+
+	push := GithubEvent{
+		Ref:     "refs/heads/main",
+		Commits: []Commit{{Modified: []string{"src/config.ts"}}},
+	}
+	resp, _ := handler(context.Background(), config, svc, newDelivery(t, "push", "72d3162e", push))
+	result := readResult(t, resp)
+	if resp.StatusCode != http.StatusAccepted || !result.Queued || len(cp.started) != 0 {
+		t.Fatalf("expected a queued delivery, got %d %s", resp.StatusCode, resp.Body)
+	}
+
+	// Forged deliveries are not queued
+	evt := newDelivery(t, "push", "9a1b2c3d", push)
+	evt.Headers[SignatureHeader] = sign([]byte("forged"), []byte(evt.Body))
+	resp, _ = handler(context.Background(), config, svc, evt)
+	if resp.StatusCode != http.StatusUnauthorized || len(queue.messages) != 1 {
+		t.Fatalf("expected only the signed delivery to be queued, got %d", len(queue.messages))
+	}
+
+	svc.Queue = nil
+	batch, err := consumer(context.Background(), config, svc, events.SQSEvent{Records: queue.messages})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(batch.BatchItemFailures) != 0 || len(cp.started) != 1 {
+		t.Errorf("expected the queued delivery to start website-prod, got %d failures and %d executions",
+			len(batch.BatchItemFailures), len(cp.started))
+	}
+}
+
+func TestConsumerReportsFailures(t *testing.T) {
+	config := testConfig(t, testRoutes)
+	svc, _ := testServices()
+	svc.Codepipeline = &brokenCodepipeline{}
+
+	queue := &memoryQueue{}
+	push := GithubEvent{
+		Ref:     "refs/heads/main",
+		Commits: []Commit{{Modified: []string{"src/config.ts"}}},
+	}
+	evt := newDelivery(t, "push", "72d3162e", push)
+	queue.Enqueue(context.Background(), QueuedDelivery{Headers: evt.Headers, Payload: evt.Body})
+	// Ignored tag push
+	evt = newDelivery(t, "push", "9a1b2c3d", GithubEvent{Ref: "refs/tags/v1.0.0"})
+	queue.Enqueue(context.Background(), QueuedDelivery{Headers: evt.Headers, Payload: evt.Body})
+	queue.messages = append(queue.messages, events.SQSMessage{MessageId: "garbage", Body: "{"})
+
+	batch, err := consumer(context.Background(), config, svc, events.SQSEvent{Records: queue.messages})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	got := []string{}
+	for _, failure := range batch.BatchItemFailures {
+		got = append(got, failure.ItemIdentifier)
+	}
+	if len(got) != 2 || got[0] != "72d3162e" || got[1] != "garbage" {
+		t.Errorf("expected 72d3162e and garbage to fail, got %v", got)
+	}
+}
+
+func TestConsumerRetriesDeliveriesInProgress(t *testing.T) {
+	config := testConfig(t, testRoutes)
+	svc, cp := testServices()
+
+	queue := &memoryQueue{}
+	evt := newDelivery(t, "push", "72d3162e", GithubEvent{
+		Ref:     "refs/heads/main",
+		Commits: []Commit{{Modified: []string{"src/config.ts"}}},
+	})
+	queue.Enqueue(context.Background(), QueuedDelivery{Headers: evt.Headers, Payload: evt.Body})
+
+	// An earlier attempt claimed the delivery and has not completed it
+	svc.Deliveries.Claim(context.Background(), "72d3162e")
+
+	batch, _ := consumer(context.Background(), config, svc, events.SQSEvent{Records: queue.messages})
+	if len(batch.BatchItemFailures) != 1 || len(cp.started) != 0 {
+		t.Fatalf("expected the delivery in progress to be retried, got %+v", batch.BatchItemFailures)
+	}
+
+	// The earlier attempt died, the retry takes over its claim
+	expireClaims(svc.Deliveries.(*MemoryDeliveryStore))
+	batch, _ = consumer(context.Background(), config, svc, events.SQSEvent{Records: queue.messages})
+	if len(batch.BatchItemFailures) != 0 || len(cp.started) != 1 {
+		t.Fatalf("expected the stale claim to be taken over, got %+v", batch.BatchItemFailures)
+	}
+
+	// A duplicate of the completed delivery is removed from the queue
+	batch, _ = consumer(context.Background(), config, svc, events.SQSEvent{Records: queue.messages})
+	if len(batch.BatchItemFailures) != 0 || len(cp.started) != 1 {
+		t.Errorf("expected the duplicate to be removed, got %+v", batch.BatchItemFailures)
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/google/go-github/github"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// DefaultRoutesCacheSize is the number of trees whose routes are kept in memory
+const DefaultRoutesCacheSize = 100
+
+// RepoRoutes is the routing table kept in the repository, e.g. `.deploy.yml`
+//
+//	rules:
+//	  - name: prod
+//	    branch: main
+//	    filters: ["src/", "!docs/**"]
+//	    pipeline: website-prod
+//
+// The file only narrows which pushes start the pipelines of the env config. Each rule has to
+// narrow a push rule of the env config starting the same pipeline, on a branch that env rule
+// already matches, so a branch can not retarget e.g. the prod pipeline to itself. The pull
+// request and deploy rules are only read from the env config.
+// Every other setting of the rule, e.g. its variables, source action, concurrency or author
+// policy, comes from that env rule. Unknown fields are rejected.
+type RepoRoutes struct {
+	Rules []RepoRule `yaml:"rules"`
+}
+
+// RepoRule is a Rule restricted to the settings the repository can change
+type RepoRule struct {
+	Name string `yaml:"name"`
+	// Event can only be push, the default
+	Event    string   `yaml:"event"`
+	Branch   string   `yaml:"branch"`
+	Filters  []string `yaml:"filters"`
+	Lambdas  []string `yaml:"lambdas"`
+	Pipeline string   `yaml:"pipeline"`
+}
+
+// parseRepoRoutes validates the repository file and merges it with the env routes
+func parseRepoRoutes(b []byte, config Config) (*Routes, error) {
+	file := RepoRoutes{}
+	err := yaml.UnmarshalStrict(b, &file)
+	if err != nil {
+		return nil, fmt.Errorf("error in parsing routes: %v", err.Error())
+	}
+
+	routes := &Routes{Source: config.RepoRoutesFile}
+	for i, r := range file.Rules {
+		if r.Event != "" && r.Event != "push" {
+			return nil, fmt.Errorf("rule %d: only push rules are read from the repository, %s rules stay in the env config", i, r.Event)
+		}
+		template, err := config.Routes.narrowedRule(r)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %v", i, err.Error())
+		}
+
+		rule := template
+		rule.Name = r.Name
+		rule.Branch = r.Branch
+		rule.Filters = r.Filters
+		rule.Lambdas = r.Lambdas
+		rule.Pipeline = r.Pipeline
+		routes.Rules = append(routes.Rules, rule)
+	}
+
+	err = routes.compile()
+	if err != nil {
+		return nil, err
+	}
+	if config.Manifest == nil && routes.NeedsManifest() {
+		return nil, fmt.Errorf("rules with lambdas need a dependency manifest")
+	}
+
+	return routes, nil
+}
+
+// narrowedRule returns the first env push rule the repository rule narrows, i.e. starting the
+// same pipeline on a branch it already matches
+func (routes *Routes) narrowedRule(r RepoRule) (Rule, error) {
+	routed := false
+	for _, rule := range routes.Rules {
+		if rule.Pipeline != r.Pipeline {
+			continue
+		}
+		routed = true
+
+		switch {
+		case rule.Event != "push":
+		case r.Branch != rule.Branch && (strings.ContainsAny(r.Branch, "*?") || !rule.branch.MatchString(r.Branch)):
+		default:
+			return rule, nil
+		}
+	}
+
+	if !routed {
+		return Rule{}, fmt.Errorf("%s is not in the env config", r.Pipeline)
+	}
+	return Rule{}, fmt.Errorf("no env rule of %s allows push events on %s", r.Pipeline, r.Branch)
+}
+
+// repoRoutes returns the routes of the repository file at the pushed commit.
+// The env routes are used when the file is disabled, missing or invalid.
+func repoRoutes(ctx context.Context, config Config, svc Services, push *PushEvent) *Routes {
+	if config.RepoRoutesFile == "" {
+		return config.Routes
+	}
+
+	sha := headCommitID(push)
+	fields := log.Fields{
+		"provider":    push.Provider,
+		"repository":  push.Repository,
+		"head_commit": sha,
+		"file":        config.RepoRoutesFile,
+	}
+	if push.Provider != ProviderGithub || svc.Github == nil {
+		log.WithFields(fields).Warnln("routes file can only be read from github with a token, using the env routes")
+		return config.Routes
+	}
+
+	// Commits with the same tree have the same file
+	tree := push.HeadCommit.TreeID
+	if tree == "" {
+		tree = sha
+	}
+	if routes, ok := svc.RoutesCache.Get(push.Repository, tree); ok {
+		if routes == nil {
+			return config.Routes
+		}
+		return routes
+	}
+
+	b, found, err := readRepoFile(ctx, svc.Github, push.Repository, config.RepoRoutesFile, sha)
+	if err != nil {
+		// Not cached, the next push tries again
+		log.WithFields(fields).Errorf("error in reading routes file, using the env routes: %v", err.Error())
+		return config.Routes
+	}
+
+	var routes *Routes
+	if !found {
+		log.WithFields(fields).Infoln("routes file not found, using the env routes")
+	} else {
+		routes, err = parseRepoRoutes(b, config)
+		if err != nil {
+			log.WithFields(fields).Warnf("invalid routes file, using the env routes: %v", err.Error())
+			routes = nil
+		}
+	}
+	svc.RoutesCache.Put(push.Repository, tree, routes)
+
+	if routes == nil {
+		return config.Routes
+	}
+	return routes
+}
+
+// readRepoFile reads a file of the repository at the commit, found is false when it does not exist
+// https://docs.github.com/en/rest/repos/contents#get-repository-content
+func readRepoFile(ctx context.Context, client *github.Client, fullName, path, sha string) ([]byte, bool, error) {
+	owner, repo, ok := splitFullName(fullName)
+	if !ok {
+		return nil, false, fmt.Errorf("invalid repository %s", fullName)
+	}
+
+	content, _, resp, err := client.Repositories.GetContents(ctx, owner, repo, path, &github.RepositoryContentGetOptions{
+		Ref: sha,
+	})
+	if resp != nil && resp.StatusCode == http.StatusNotFound {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if content == nil {
+		return nil, false, fmt.Errorf("%s is not a file", path)
+	}
+
+	s, err := content.GetContent()
+	if err != nil {
+		return nil, false, err
+	}
+	return []byte(s), true, nil
+}
+
+// RoutesCache keeps the routes read from the repositories by repository and tree sha.
+// A nil entry records a missing or invalid file. The oldest entries are evicted first.
+type RoutesCache struct {
+	Size int
+
+	mu      sync.Mutex
+	entries map[string]*Routes
+	keys    []string
+}
+
+func NewRoutesCache(size int) *RoutesCache {
+	return &RoutesCache{
+		Size:    size,
+		entries: map[string]*Routes{},
+	}
+}
+
+// Get returns the cached routes, a nil cache never has any
+func (c *RoutesCache) Get(repository, tree string) (*Routes, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	routes, ok := c.entries[routesCacheKey(repository, tree)]
+	return routes, ok
+}
+
+func (c *RoutesCache) Put(repository, tree string, routes *Routes) {
+	if c == nil {
+		return
+	}
+	key := routesCacheKey(repository, tree)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.entries[key]; !ok {
+		c.keys = append(c.keys, key)
+	}
+	c.entries[key] = routes
+
+	for len(c.keys) > c.Size {
+		delete(c.entries, c.keys[0])
+		c.keys = c.keys[1:]
+	}
+}
+
+// routesCacheKey is the repository and the tree, two repositories can have the same tree
+func routesCacheKey(repository, tree string) string {
+	return strings.ToLower(repository) + "@" + tree
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testEnvRoutes = `
+rules:
+  - name: prod
+    branch: main
+    filters: ["src/"]
+    pipeline: website-prod
+    variables: true
+    concurrency: supersede
+  - name: docs
+    branch: main
+    filters: ["docs/**"]
+    pipeline: website-docs
+`
+
+const testRepoRoutes = `
+rules:
+  - name: prod
+    branch: main
+    filters: ["src/", "config.yml"]
+    pipeline: website-prod
+`
+
+func TestParseRepoRoutes(t *testing.T) {
+	config := testConfig(t, testEnvRoutes)
+	config.RepoRoutesFile = ".deploy.yml"
+
+	routes, err := parseRepoRoutes([]byte(testRepoRoutes), config)
+	if err != nil {
+		t.Fatalf("error in parsing repository routes: %v", err)
+	}
+	rule := routes.Rules[0]
+	if !rule.Variables || rule.Concurrency != PolicySupersede || !reflect.DeepEqual(rule.Filters, []string{"src/", "config.yml"}) {
+		t.Errorf("expected the settings of the env rule with the filters of the file, got %+v", rule)
+	}
+	if routes.Source != ".deploy.yml" {
+		t.Errorf("unexpected source %q", routes.Source)
+	}
+
+	invalid := map[string]string{
+		"unknown pipeline": "rules:\n  - branch: main\n    pipeline: someone-else\n",
+		"unknown field":    "rules:\n  - branch: main\n    pipeline: website-prod\n    concurrency: queue\n",
+		"missing branch":   "rules:\n  - pipeline: website-prod\n",
+		"no rules":         "rules: []\n",
+		"lambdas":          "rules:\n  - branch: main\n    lambdas: [src/lambda/api/]\n    pipeline: website-prod\n",
+		"other branch":     "rules:\n  - branch: feature/x\n    pipeline: website-prod\n",
+		"wider branch":     "rules:\n  - branch: '*'\n    pipeline: website-prod\n",
+		"actions":          "rules:\n  - branch: main\n    actions: [opened]\n    pipeline: website-prod\n",
+	}
+	for name, file := range invalid {
+		if _, err := parseRepoRoutes([]byte(file), config); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+
+	// Only the push rules are read from the repository
+	for _, event := range []string{"pull_request", "deploy"} {
+		file := "rules:\n  - event: " + event + "\n    branch: main\n    pipeline: website-prod\n"
+		_, err := parseRepoRoutes([]byte(file), config)
+		if err == nil || !strings.Contains(err.Error(), "only push rules are read from the repository") {
+			t.Errorf("%s: expected the event to be rejected, got %v", event, err)
+		}
+	}
+	if _, err := parseRepoRoutes([]byte("rules:\n  - event: push\n    branch: main\n    pipeline: website-prod\n"), config); err != nil {
+		t.Errorf("expected an explicit push event to be accepted, got %v", err)
+	}
+}
+
+func TestHandlerRepoRoutes(t *testing.T) {
+	files := map[string]string{"c3d4": testRepoRoutes}
+	requests := 0
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/repos/nkhine/khine.net/contents/.deploy.yml", func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		file, ok := files[r.URL.Query().Get("ref")]
+		if !ok {
+			http.Error(w, `{"message":"Not Found"}`, http.StatusNotFound)
+			return
+		}
+		fmt.Fprintf(w, `{"type":"file","encoding":"base64","content":%q}`, base64.StdEncoding.EncodeToString([]byte(file)))
+	})
+
+	config := testConfig(t, testEnvRoutes)
+	config.RepoRoutesFile = ".deploy.yml"
+	svc, cp := testServices()
+	svc.Github = newFakeGithub(t, mux)
+	svc.RoutesCache = NewRoutesCache(DefaultRoutesCacheSize)
+
+	push := func(sha, tree string) GithubEvent {
+		evt := GithubEvent{
+			Ref:        "refs/heads/main",
+			After:      sha,
+			HeadCommit: Commit{ID: sha, TreeID: tree},
+			Commits:    []Commit{{ID: sha, Modified: []string{"config.yml"}}},
+		}
+		evt.Repository.FullName = "nkhine/khine.net"
+		return evt
+	}
+
+	// config.yml only starts website-prod with the filters of the file
+	resp, _ := handler(context.Background(), config, svc, newDelivery(t, "push", "", push("c3d4", "t1")))
+	if len(cp.started) != 1 || *cp.started[0].Name != "website-prod" {
+		t.Fatalf("expected website-prod to be started, got %s", resp.Body)
+	}
+
+	// The file is cached by tree
+	handler(context.Background(), config, svc, newDelivery(t, "push", "", push("d4e5", "t1")))
+	if len(cp.started) != 2 || requests != 1 {
+		t.Errorf("expected the cached routes to be used, got %d requests", requests)
+	}
+
+	// Without the file the env routes apply
+	resp, _ = handler(context.Background(), config, svc, newDelivery(t, "push", "", push("e5f6", "t2")))
+	if len(cp.started) != 2 || requests != 2 {
+		t.Errorf("expected the env routes to be used, got %s", resp.Body)
+	}
+
+	// Invalid files fall back to the env routes too
+	files["f6a7"] = strings.Replace(testRepoRoutes, "website-prod", "someone-else", 1)
+	evt := newDelivery(t, "push", "", push("f6a7", "t3"))
+	evt.Headers[DryRunHeader] = "true"
+	resp, _ = handler(context.Background(), config, svc, evt)
+	if result := readResult(t, resp); result.Explanation == nil || result.Explanation.RoutesFile != "" || len(result.Explanation.Pipelines) != 0 {
+		t.Errorf("expected the env routes to be explained, got %s", resp.Body)
+	}
+
+	evt = newDelivery(t, "push", "", push("c3d4", "t1"))
+	evt.Headers[DryRunHeader] = "true"
+	resp, _ = handler(context.Background(), config, svc, evt)
+	if result := readResult(t, resp); result.Explanation == nil || result.Explanation.RoutesFile != ".deploy.yml" {
+		t.Errorf("expected the routes file to be explained, got %s", resp.Body)
+	}
+}
+
+func TestHandlerRepoRoutesCanNotRetarget(t *testing.T) {
+	// A feature branch routes itself to the prod pipeline
+	file := "rules:\n  - branch: feature/x\n    pipeline: website-prod\n"
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/repos/nkhine/khine.net/contents/.deploy.yml", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"type":"file","encoding":"base64","content":%q}`, base64.StdEncoding.EncodeToString([]byte(file)))
+	})
+
+	config := testConfig(t, testEnvRoutes)
+	config.RepoRoutesFile = ".deploy.yml"
+	svc, cp := testServices()
+	svc.Github = newFakeGithub(t, mux)
+
+	evt := GithubEvent{
+		Ref:        "refs/heads/feature/x",
+		After:      "c3d4",
+		HeadCommit: Commit{ID: "c3d4", TreeID: "t1"},
+		Commits:    []Commit{{ID: "c3d4", Modified: []string{"src/index.ts"}}},
+	}
+	evt.Repository.FullName = "nkhine/khine.net"
+
+	resp, _ := handler(context.Background(), config, svc, newDelivery(t, "push", "", evt))
+	if len(cp.started) != 0 {
+		t.Errorf("expected the feature branch not to start website-prod, got %s", resp.Body)
+	}
+
+	// Narrowing the branch glob of an env rule is allowed
+	config = testConfig(t, "rules:\n  - branch: release/*\n    pipeline: website-staging\n    source_action: Source\n")
+	routes, err := parseRepoRoutes([]byte("rules:\n  - branch: release/1.2\n    pipeline: website-staging\n"), config)
+	if err != nil || routes.Rules[0].SourceAction != "Source" {
+		t.Errorf("expected the release branch to be accepted, got %v", err)
+	}
+}
+
+func TestRoutesCacheEviction(t *testing.T) {
+	cache := NewRoutesCache(2)
+	cache.Put("nkhine/khine.net", "t1", &Routes{})
+	cache.Put("nkhine/khine.net", "t2", nil)
+	cache.Put("nkhine/khine.net", "t3", &Routes{})
+
+	if _, ok := cache.Get("nkhine/khine.net", "t1"); ok {
+		t.Errorf("expected the oldest tree to be evicted")
+	}
+	if routes, ok := cache.Get("nkhine/khine.net", "t2"); !ok || routes != nil {
+		t.Errorf("expected the missing file to be cached")
+	}
+	if _, ok := cache.Get("nkhine/blog", "t3"); ok {
+		t.Errorf("expected the same tree of another repository not to be cached")
+	}
+}
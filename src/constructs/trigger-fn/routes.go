@@ -0,0 +1,392 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"gopkg.in/yaml.v2"
+)
+
+// Change is what the rules are matched against
+type Change struct {
+	// Event is the github event, `push` or `pull_request`, or `deploy` for a deploy command
+	Event string
+	// Action of a pull_request event, e.g. `opened`
+	Action string
+	// Environment of a deploy command, e.g. `staging`
+	Environment string
+	// Repository full name, e.g. `khine.net/website`
+	Repository string
+	// Branch pushed to, or the base branch of a pull request
+	Branch string
+	Files  []string
+	// Force matches the rules of the branch regardless of their filters,
+	// see the `[force deploy]` directive
+	Force bool
+	// FilesUnknown is set when the provider only lists part of the changed files,
+	// the rules of the branch match regardless of their filters
+	FilesUnknown bool
+	// Lambdas affected by the changed files, see DependencyManifest
+	Lambdas []string
+	// Authors are the pusher followed by the author of the head commit
+	Authors []string
+	// Bot is set when the provider reports that a bot sent the event
+	Bot bool
+	// Verified is set when github verified the signature of the head commit,
+	// it is only looked up for the rules requiring it
+	Verified bool
+}
+
+// DefaultPullRequestActions start the preview of a pull request
+var DefaultPullRequestActions = []string{"opened", "synchronize", "reopened"}
+
+// Rule routes the events on the matching branches to a pipeline.
+// A rule without filters matches every event on its branches.
+type Rule struct {
+	Name     string   `json:"name" yaml:"name"`
+	Branch   string   `json:"branch" yaml:"branch"`
+	Filters  []string `json:"filters" yaml:"filters"`
+	Pipeline string   `json:"pipeline" yaml:"pipeline"`
+
+	// Event is `push` (the default), `pull_request` or `deploy`. Branch is then matched
+	// against the base branch of the pull request.
+	Event string `json:"event" yaml:"event"`
+	// Actions of the pull requests matching the rule,
+	// defaults to DefaultPullRequestActions
+	Actions []string `json:"actions" yaml:"actions"`
+	// Lambdas selects the changes affecting the lambdas, e.g. `src/lambda/api/` or `src/lambda/*/auth`,
+	// whichever files changed. It uses the syntax of the filters and needs a DependencyManifest.
+	Lambdas []string `json:"lambdas" yaml:"lambdas"`
+	// Environment deployed by a `/deploy <environment>` pull request comment, see deploy.go.
+	// The filters of deploy rules are ignored.
+	Environment string `json:"environment" yaml:"environment"`
+	// Repository glob, e.g. `khine.net/website` or `khine.net/*`, matched case-insensitively against
+	// the full name of the repository. Every repository matches when it is empty, which only makes
+	// sense for a repository webhook since an organization webhook delivers the events of all its repositories.
+	Repository string `json:"repository" yaml:"repository"`
+
+	// Variables passes the commit metadata as pipeline variables, see variables.go
+	Variables bool `json:"variables" yaml:"variables"`
+	// SourceAction is the source action whose revision is overridden with the pushed commit
+	SourceAction string `json:"source_action" yaml:"source_action"`
+	// Concurrency is `queue` (the default), `supersede` or `coalesce`, see ConcurrencyPolicy
+	Concurrency ConcurrencyPolicy `json:"concurrency" yaml:"concurrency"`
+	// Authors restricts who can start the pipeline, see AuthorPolicy
+	Authors AuthorPolicy `json:"authors" yaml:"authors"`
+	// RequireVerified only starts the pipeline when github verified the signature of the head commit
+	RequireVerified bool `json:"require_verified" yaml:"require_verified"`
+
+	branch     *regexp.Regexp
+	repository *regexp.Regexp
+	filters    Filters
+	lambdas    Filters
+}
+
+// Routes is the routing table of trigger-fn, e.g.
+//
+//	rules:
+//	  - name: prod
+//	    repository: khine.net/website
+//	    branch: main
+//	    pipeline: website-prod
+//	    variables: true
+//	    source_action: Source
+//	    concurrency: supersede
+//	    require_verified: true
+//	    authors:
+//	      ignore_bots: true
+//	  - name: staging
+//	    branch: release/*
+//	    pipeline: website-staging
+//	  - name: docs
+//	    branch: main
+//	    filters: ["docs/**"]
+//	    pipeline: website-docs
+//	  - name: preview
+//	    event: pull_request
+//	    branch: main
+//	    pipeline: website-preview
+//	    variables: true
+//	  - name: teardown
+//	    event: pull_request
+//	    actions: [closed]
+//	    branch: main
+//	    pipeline: website-teardown
+//	    variables: true
+//	  - name: deploy-staging
+//	    event: deploy
+//	    environment: staging
+//	    branch: main
+//	    pipeline: website-staging
+//	    source_action: Source
+//
+// Since YAML is a superset of JSON the same document can be written as JSON
+type Routes struct {
+	Rules []Rule `json:"rules" yaml:"rules"`
+
+	// Source is the repository file the routes were read from, empty for the env routes
+	Source string `json:"-" yaml:"-"`
+}
+
+func parseRoutes(b []byte) (*Routes, error) {
+	routes := &Routes{}
+	err := yaml.Unmarshal(b, routes)
+	if err != nil {
+		return nil, fmt.Errorf("error in parsing routes: %v", err.Error())
+	}
+
+	err = routes.compile()
+	if err != nil {
+		return nil, err
+	}
+
+	return routes, nil
+}
+
+// compile validates the rules and compiles their branch globs and filters
+func (routes *Routes) compile() error {
+	if len(routes.Rules) == 0 {
+		return fmt.Errorf("routes do not have any rules")
+	}
+
+	for i := range routes.Rules {
+		rule := &routes.Rules[i]
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule-%d", i)
+		}
+		if rule.Branch == "" {
+			return fmt.Errorf("rule %s does not have a branch", rule.Name)
+		}
+		if rule.Pipeline == "" {
+			return fmt.Errorf("rule %s does not have a pipeline", rule.Name)
+		}
+
+		switch rule.Event {
+		case "":
+			rule.Event = "push"
+		case "push":
+		case "pull_request":
+			if len(rule.Actions) == 0 {
+				rule.Actions = DefaultPullRequestActions
+			}
+		case "deploy":
+			if rule.Environment == "" {
+				return fmt.Errorf("rule %s does not have an environment", rule.Name)
+			}
+		default:
+			return fmt.Errorf("rule %s has an unsupported event %s", rule.Name, rule.Event)
+		}
+
+		if rule.Concurrency == "" {
+			rule.Concurrency = PolicyQueue
+		}
+		if !rule.Concurrency.valid() {
+			return fmt.Errorf("rule %s has an unsupported concurrency policy %s", rule.Name, rule.Concurrency)
+		}
+
+		re, err := compileGlob(rule.Branch)
+		if err != nil {
+			return fmt.Errorf("invalid branch in rule %s: %v", rule.Name, err.Error())
+		}
+		rule.branch = re
+
+		if rule.Repository != "" {
+			re, err := compileGlob(strings.ToLower(rule.Repository))
+			if err != nil {
+				return fmt.Errorf("invalid repository in rule %s: %v", rule.Name, err.Error())
+			}
+			rule.repository = re
+		}
+
+		filters, err := parseFilters(rule.Filters)
+		if err != nil {
+			return fmt.Errorf("invalid filters in rule %s: %v", rule.Name, err.Error())
+		}
+		rule.filters = filters
+
+		lambdas, err := parseFilters(rule.Lambdas)
+		if err != nil {
+			return fmt.Errorf("invalid lambdas in rule %s: %v", rule.Name, err.Error())
+		}
+		rule.lambdas = lambdas
+	}
+
+	return nil
+}
+
+// Match returns the rules matching the change
+func (routes *Routes) Match(change Change) []Rule {
+	rules := []Rule{}
+	for _, rule := range routes.Rules {
+		if rule.Match(change) {
+			rules = append(rules, rule)
+		}
+	}
+
+	return rules
+}
+
+// NeedsFiles reports whether a rule for the event on the branch has filters or lambdas,
+// i.e. whether the changed files have to be looked up
+func (routes *Routes) NeedsFiles(event, branch string) bool {
+	for _, rule := range routes.Rules {
+		if rule.Event == event && rule.branch.MatchString(branch) && (len(rule.filters) > 0 || len(rule.lambdas) > 0) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// NeedsManifest reports whether a rule selects the changes by their lambdas
+func (routes *Routes) NeedsManifest() bool {
+	for _, rule := range routes.Rules {
+		if len(rule.lambdas) > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (rule Rule) Match(change Change) bool {
+	return rule.Explain(change).Matched
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// loadRoutes reads the routes from `ROUTES`, then `ROUTES_S3_URI`.
+// When neither is set it builds a single rule from the `CODEPIPELINE_NAME`, `REPOSITORY`,
+// `GITHUB_BRANCH`, `FILTERS`, `PIPELINE_VARIABLES`, `SOURCE_ACTION_NAME`, `CONCURRENCY_POLICY`,
+// `ALLOWED_AUTHORS`, `DENIED_AUTHORS`, `IGNORE_BOTS` and `REQUIRE_VERIFIED_COMMITS` variables,
+// plus the pull request rules for `PREVIEW_PIPELINE_NAME` and `TEARDOWN_PIPELINE_NAME`.
+func loadRoutes(config Config) (*Routes, error) {
+	if config.Routes_ != "" {
+		return parseRoutes([]byte(config.Routes_))
+	}
+
+	if config.RoutesS3URI != "" {
+		b, err := readS3Object(config.RoutesS3URI)
+		if err != nil {
+			return nil, err
+		}
+		return parseRoutes(b)
+	}
+
+	if config.CodepipelineName == "" || config.GithubBranch == "" {
+		return nil, fmt.Errorf("one of ROUTES, ROUTES_S3_URI or CODEPIPELINE_NAME and GITHUB_BRANCH is required")
+	}
+
+	routes := &Routes{
+		Rules: []Rule{
+			{
+				Name:       "default",
+				Repository: config.Repository,
+				Branch:     config.GithubBranch,
+				Filters:    strings.Split(config.Filters_, ","),
+				Lambdas:    splitList(config.Lambdas_),
+				Pipeline:   config.CodepipelineName,
+
+				Variables:    config.PipelineVariables,
+				SourceAction: config.SourceActionName,
+				Concurrency:  ConcurrencyPolicy(config.ConcurrencyPolicy),
+				Authors: AuthorPolicy{
+					Allow:      splitList(config.AllowedAuthors_),
+					Deny:       splitList(config.DeniedAuthors_),
+					IgnoreBots: config.IgnoreBots,
+				},
+				RequireVerified: config.RequireVerified,
+			},
+		},
+	}
+
+	// The previews need the pull request number, so the variables are always passed
+	if config.PreviewPipelineName != "" {
+		routes.Rules = append(routes.Rules, Rule{
+			Name:         "preview",
+			Event:        "pull_request",
+			Repository:   config.Repository,
+			Branch:       config.GithubBranch,
+			Pipeline:     config.PreviewPipelineName,
+			Variables:    true,
+			SourceAction: config.SourceActionName,
+		})
+	}
+	if config.TeardownPipelineName != "" {
+		routes.Rules = append(routes.Rules, Rule{
+			Name:       "teardown",
+			Event:      "pull_request",
+			Actions:    []string{"closed"},
+			Repository: config.Repository,
+			Branch:     config.GithubBranch,
+			Pipeline:   config.TeardownPipelineName,
+			Variables:  true,
+		})
+	}
+
+	// DEPLOY_PIPELINES maps the environments of the deploy commands to pipelines
+	for _, env := range splitList(config.DeployPipelines_) {
+		name, pipeline, ok := strings.Cut(env, "=")
+		if !ok || name == "" || pipeline == "" {
+			return nil, fmt.Errorf("invalid DEPLOY_PIPELINES entry %s, expected <environment>=<pipeline>", env)
+		}
+		routes.Rules = append(routes.Rules, Rule{
+			Name:         "deploy-" + name,
+			Event:        "deploy",
+			Environment:  name,
+			Repository:   config.Repository,
+			Branch:       config.GithubBranch,
+			Pipeline:     pipeline,
+			Variables:    config.PipelineVariables,
+			SourceAction: config.SourceActionName,
+			Authors: AuthorPolicy{
+				Allow:      splitList(config.AllowedAuthors_),
+				Deny:       splitList(config.DeniedAuthors_),
+				IgnoreBots: config.IgnoreBots,
+			},
+			RequireVerified: config.RequireVerified,
+		})
+	}
+
+	err := routes.compile()
+	if err != nil {
+		return nil, err
+	}
+
+	return routes, nil
+}
+
+// readS3Object downloads an object addressed like s3://bucket/key
+func readS3Object(uri string) ([]byte, error) {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "s3" {
+		return nil, fmt.Errorf("invalid s3 uri %s", uri)
+	}
+
+	sess := session.Must(session.NewSession())
+	s3svc := s3.New(sess)
+
+	obj, err := s3svc.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(u.Host),
+		Key:    aws.String(strings.TrimPrefix(u.Path, "/")),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error in downloading %s: %v", uri, err.Error())
+	}
+	defer obj.Body.Close()
+
+	return io.ReadAll(obj.Body)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+const testRoutes = `
+rules:
+  - name: prod
+    branch: main
+    filters: ["src/", "!docs/**"]
+    pipeline: website-prod
+  - name: staging
+    branch: release/*
+    pipeline: website-staging
+  - name: docs
+    branch: main
+    filters: ["docs/**"]
+    pipeline: website-docs
+`
+
+func TestRoutesMatch(t *testing.T) {
+	routes, err := parseRoutes([]byte(testRoutes))
+	if err != nil {
+		t.Fatalf("error in parsing routes: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		branch string
+		files  []string
+		want   []string
+	}{
+		{"prod only", "main", []string{"src/config.ts"}, []string{"prod"}},
+		{"docs only", "main", []string{"docs/diagram.dot"}, []string{"docs"}},
+		{"fan out", "main", []string{"src/config.ts", "docs/diagram.dot"}, []string{"prod", "docs"}},
+		{"release branch", "release/1.2", []string{"README.md"}, []string{"staging"}},
+		{"nested release branch", "release/1.2/hotfix", []string{"README.md"}, []string{}},
+		{"unknown branch", "feature/x", []string{"src/config.ts"}, []string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := []string{}
+			for _, rule := range routes.Match(Change{Event: "push", Branch: tt.branch, Files: tt.files}) {
+				got = append(got, rule.Name)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestParseRoutesJSON(t *testing.T) {
+	routes, err := parseRoutes([]byte(`{"rules": [{"branch": "main", "pipeline": "website-prod"}]}`))
+	if err != nil {
+		t.Fatalf("error in parsing routes: %v", err)
+	}
+	if routes.Rules[0].Name != "rule-0" {
+		t.Errorf("expected a generated rule name, got %s", routes.Rules[0].Name)
+	}
+
+	for _, raw := range []string{
+		`{"rules": []}`,
+		`{"rules": [{"pipeline": "website-prod"}]}`,
+		`{"rules": [{"branch": "main"}]}`,
+	} {
+		if _, err := parseRoutes([]byte(raw)); err == nil {
+			t.Errorf("expected an error for %s", raw)
+		}
+	}
+}
+
+func TestRoutesMatchRepository(t *testing.T) {
+	routes, err := parseRoutes([]byte(`
+rules:
+  - name: website
+    repository: khine.net/website
+    branch: main
+    pipeline: website-prod
+  - name: lambdas
+    repository: khine.net/lambda-*
+    branch: main
+    pipeline: lambdas-prod
+  - name: any
+    branch: release/*
+    pipeline: release
+`))
+	if err != nil {
+		t.Fatalf("error in parsing routes: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		repository string
+		branch     string
+		want       []string
+	}{
+		{"exact", "khine.net/website", "main", []string{"website"}},
+		{"case insensitive", "Khine.net/Website", "main", []string{"website"}},
+		{"glob", "khine.net/lambda-api", "main", []string{"lambdas"}},
+		{"other repository", "khine.net/blog", "main", []string{}},
+		{"any repository", "khine.net/blog", "release/1.2", []string{"any"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := []string{}
+			for _, rule := range routes.Match(Change{Event: "push", Repository: tt.repository, Branch: tt.branch}) {
+				got = append(got, rule.Name)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+
+	decision := routes.Rules[0].Explain(Change{Event: "push", Repository: "khine.net/blog", Branch: "main"})
+	if decision.Reason != "repository does not match khine.net/website" {
+		t.Errorf("unexpected reason %q", decision.Reason)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+const SignatureHeader = "x-hub-signature-256"
+const SignaturePrefix = "sha256="
+
+var (
+	ErrMissingSignature = errors.New("request is not signed")
+	ErrInvalidSignature = errors.New("signature does not match the request body")
+)
+
+// validateSignature checks the `X-Hub-Signature-256` header sent by github against
+// the HMAC-SHA256 of the raw request body, keyed with the shared webhook secret.
+// https://docs.github.com/en/webhooks/using-webhooks/validating-webhook-deliveries
+func validateSignature(secret []byte, signature string, body []byte) error {
+	if signature == "" {
+		return ErrMissingSignature
+	}
+	if !strings.HasPrefix(signature, SignaturePrefix) {
+		return ErrInvalidSignature
+	}
+
+	return validateHMAC(secret, strings.TrimPrefix(signature, SignaturePrefix), body)
+}
+
+// validateHMAC checks a hex encoded HMAC-SHA256 of the body
+func validateHMAC(secret []byte, signature string, body []byte) error {
+	if signature == "" {
+		return ErrMissingSignature
+	}
+
+	got, err := hex.DecodeString(signature)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+
+	// hmac.Equal does a constant time comparison
+	if !hmac.Equal(got, mac.Sum(nil)) {
+		return ErrInvalidSignature
+	}
+
+	return nil
+}
+
+// validateToken checks a secret sent as is in a header, the way gitlab does
+func validateToken(secret []byte, token string) error {
+	if token == "" {
+		return ErrMissingSignature
+	}
+
+	if subtle.ConstantTimeCompare([]byte(token), secret) != 1 {
+		return ErrInvalidSignature
+	}
+
+	return nil
+}
+
+// requestBody returns the raw bytes github signed.
+// Function URLs base64 encode the body when the content is not text.
+func requestBody(evt events.LambdaFunctionURLRequest) ([]byte, error) {
+	if evt.IsBase64Encoded {
+		return base64.StdEncoding.DecodeString(evt.Body)
+	}
+	return []byte(evt.Body), nil
+}
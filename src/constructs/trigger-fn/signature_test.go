@@ -0,0 +1,41 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+)
+
+func sign(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return SignaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestValidateSignature(t *testing.T) {
+	secret := []byte("It's a Secret to Everybody")
+	body := []byte("Hello, World!")
+
+	tests := []struct {
+		name      string
+		signature string
+		want      error
+	}{
+		// Example from the github docs
+		{"github docs example", "sha256=757107ea0eb2509fc211221cce984b8a37570b6d7586c22c46f4379c8b043e17", nil},
+		{"computed", sign(secret, body), nil},
+		{"missing", "", ErrMissingSignature},
+		{"sha1 header", "sha1=01dc10d0c83e72ed246219cdd91669667fe2ca59", ErrInvalidSignature},
+		{"not hex", "sha256=zz", ErrInvalidSignature},
+		{"wrong secret", sign([]byte("another secret"), body), ErrInvalidSignature},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := validateSignature(secret, tt.signature, body); got != tt.want {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
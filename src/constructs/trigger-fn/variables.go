@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/codepipeline"
+	log "github.com/sirupsen/logrus"
+)
+
+// MaxVariableLength is the longest value codepipeline accepts for a pipeline variable
+const MaxVariableLength = 1000
+
+// Names of the pipeline variables set by trigger-fn.
+// The pipeline has to be a V2 pipeline declaring all of them.
+const (
+	VariableCommitID      = "COMMIT_ID"
+	VariableRef           = "REF"
+	VariableBranch        = "BRANCH"
+	VariablePusher        = "PUSHER"
+	VariableCommitMessage = "COMMIT_MESSAGE"
+	VariableChangedPaths  = "CHANGED_PATHS"
+	// Only set with a dependency manifest, see DependencyManifest
+	VariableAffectedLambdas = "AFFECTED_LAMBDAS"
+
+	// Only set for pull requests
+	VariablePRNumber   = "PR_NUMBER"
+	VariablePRAction   = "PR_ACTION"
+	VariableBaseBranch = "BASE_BRANCH"
+
+	// Only set for deploy commands, along with the pull request variables
+	VariableEnvironment = "DEPLOY_ENVIRONMENT"
+)
+
+// Trigger is the event starting the pipelines
+type Trigger struct {
+	// SHA of the commit to build
+	SHA string
+	// Provider of the repository, e.g. `github`
+	Provider string
+	// Repository full name, e.g. `nkhine/khine.net`
+	Repository string
+	// Variables passed to the rules with variables enabled
+	Variables map[string]string
+	// Fields describing the event in the logs
+	Fields log.Fields
+	// Directive found in the commit messages, if any
+	Directive *Directive
+	// RequestedBy and Reason are set for the manual dispatches
+	RequestedBy string
+	Reason      string
+}
+
+func pushTrigger(push *PushEvent, branch string, files []string) Trigger {
+	sha := headCommitID(push)
+
+	return Trigger{
+		SHA:        sha,
+		Provider:   push.Provider,
+		Repository: push.Repository,
+		Variables: map[string]string{
+			VariableCommitID:      sha,
+			VariableRef:           push.Ref,
+			VariableBranch:        branch,
+			VariablePusher:        push.Pusher,
+			VariableCommitMessage: push.HeadCommit.Message,
+			VariableChangedPaths:  summarisePaths(files),
+		},
+		Fields: log.Fields{
+			"provider":    push.Provider,
+			"branch":      branch,
+			"head_commit": push.HeadCommit.ID,
+			"author":      push.HeadCommit.Author.Username,
+			"pushed_at":   push.PushedAt,
+		},
+	}
+}
+
+// buildStartInput builds the StartPipelineExecution request for a matching rule
+func buildStartInput(rule Rule, trigger Trigger) *codepipeline.StartPipelineExecutionInput {
+	input := &codepipeline.StartPipelineExecutionInput{
+		Name: aws.String(rule.Pipeline),
+	}
+
+	if rule.Variables {
+		input.Variables = toPipelineVariables(trigger.Variables)
+	}
+
+	// Build exactly the pushed commit instead of whatever the source action fetches
+	sha := trigger.SHA
+	if rule.SourceAction != "" && sha != "" {
+		input.SourceRevisions = []*codepipeline.SourceRevisionOverride{
+			{
+				ActionName:    aws.String(rule.SourceAction),
+				RevisionType:  aws.String(codepipeline.SourceRevisionTypeCommitId),
+				RevisionValue: aws.String(sha),
+			},
+		}
+	}
+
+	return input
+}
+
+func headCommitID(push *PushEvent) string {
+	if push.HeadCommit.ID != "" {
+		return push.HeadCommit.ID
+	}
+	return push.After
+}
+
+// toPipelineVariables converts the values to pipeline variables.
+// Codepipeline rejects empty values so they are left out, long values are truncated.
+func toPipelineVariables(values map[string]string) []*codepipeline.PipelineVariable {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	variables := []*codepipeline.PipelineVariable{}
+	for _, name := range names {
+		value := truncate(values[name], MaxVariableLength)
+		if value == "" {
+			continue
+		}
+		variables = append(variables, &codepipeline.PipelineVariable{
+			Name:  aws.String(name),
+			Value: aws.String(value),
+		})
+	}
+
+	if len(variables) == 0 {
+		return nil
+	}
+	return variables
+}
+
+// summarisePaths joins as many paths as fit in a pipeline variable,
+// e.g. `src/config.ts,src/cicd.ts (+12 more)`
+func summarisePaths(files []string) string {
+	var sb strings.Builder
+	for i, file := range files {
+		more := fmt.Sprintf(" (+%d more)", len(files)-i)
+		if sb.Len()+len(file)+1+len(more) > MaxVariableLength {
+			sb.WriteString(more)
+			break
+		}
+		if i > 0 {
+			sb.WriteString(",")
+		}
+		sb.WriteString(file)
+	}
+
+	return sb.String()
+}
+
+// truncate cuts s to at most n bytes without splitting a multi byte character
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+
+	s = s[:n]
+	for len(s) > 0 && !utf8.ValidString(s) {
+		s = s[:len(s)-1]
+	}
+	return s
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBuildStartInput(t *testing.T) {
+	push := &PushEvent{
+		Ref:        "refs/heads/main",
+		After:      "b2c3",
+		Pusher:     "nkhine",
+		HeadCommit: Commit{Message: "Update footer"},
+	}
+
+	trigger := pushTrigger(push, "main", nil)
+
+	input := buildStartInput(Rule{Pipeline: "website-prod"}, trigger)
+	if input.Variables != nil || input.SourceRevisions != nil {
+		t.Errorf("expected only the pipeline name, got %v", input)
+	}
+
+	input = buildStartInput(Rule{Pipeline: "website-prod", Variables: true, SourceAction: "Source"}, trigger)
+
+	got := map[string]string{}
+	for _, v := range input.Variables {
+		got[*v.Name] = *v.Value
+	}
+	want := map[string]string{
+		VariableCommitID:      "b2c3",
+		VariableRef:           "refs/heads/main",
+		VariableBranch:        "main",
+		VariablePusher:        "nkhine",
+		VariableCommitMessage: "Update footer",
+	}
+	if len(got) != len(want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("expected %s=%s, got %s", k, v, got[k])
+		}
+	}
+
+	if len(input.SourceRevisions) != 1 || *input.SourceRevisions[0].RevisionValue != "b2c3" {
+		t.Errorf("expected a source revision override for b2c3, got %v", input.SourceRevisions)
+	}
+}
+
+func TestSummarisePaths(t *testing.T) {
+	if got := summarisePaths([]string{"a.go", "b.go"}); got != "a.go,b.go" {
+		t.Errorf("expected a.go,b.go, got %s", got)
+	}
+
+	files := []string{}
+	for i := 0; i < 200; i++ {
+		files = append(files, "src/lambda/api/header/main.go")
+	}
+	got := summarisePaths(files)
+	if len(got) > MaxVariableLength || !strings.HasSuffix(got, "more)") {
+		t.Errorf("expected a truncated summary, got %d bytes: %s", len(got), got)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	if got := truncate("héllo", 2); got != "h" {
+		t.Errorf("expected h, got %q", got)
+	}
+	if got := truncate("hello", 10); got != "hello" {
+		t.Errorf("expected hello, got %q", got)
+	}
+}
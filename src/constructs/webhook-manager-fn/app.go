@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/go-github/github"
+	"golang.org/x/oauth2"
+)
+
+// AppTokenSource issues the installation tokens of a github app, scoped to one repository
+// or, without a repository, to the organization installation.
+// The app needs the repository "Webhooks: read & write" permission to manage a repository webhook,
+// and the organization "Webhooks: read & write" permission to manage an organization webhook.
+// The app authenticates with a JWT signed by its private key, see
+// https://docs.github.com/en/apps/creating-github-apps/authenticating-with-a-github-app/authenticating-as-a-github-app-installation
+type AppTokenSource struct {
+	AppID int64
+	// InstallationID is looked up from the repository, or the organization, when it is 0
+	InstallationID int64
+	PrivateKey     *rsa.PrivateKey
+	Owner          string
+	Repo           string
+
+	// BaseURL of the github api, the public api when nil
+	BaseURL *url.URL
+}
+
+// appTokens keeps the token sources between the invocations of a warm lambda,
+// so the installation tokens are reused until they expire
+var appTokens = struct {
+	sync.Mutex
+	sources map[string]oauth2.TokenSource
+}{sources: map[string]oauth2.TokenSource{}}
+
+// cachedAppTokenSource returns a token source reusing the installation token of the app until it expires
+func cachedAppTokenSource(src *AppTokenSource) oauth2.TokenSource {
+	key := fmt.Sprintf("%d/%d/%s/%s", src.AppID, src.InstallationID, src.Owner, src.Repo)
+
+	appTokens.Lock()
+	defer appTokens.Unlock()
+
+	ts, ok := appTokens.sources[key]
+	if !ok {
+		ts = oauth2.ReuseTokenSource(nil, src)
+		appTokens.sources[key] = ts
+	}
+	return ts
+}
+
+// Token exchanges a new JWT for an installation token
+func (s *AppTokenSource) Token() (*oauth2.Token, error) {
+	ctx := context.Background()
+
+	jwt, err := signAppJWT(s.AppID, s.PrivateKey, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	appClient := github.NewClient(oauth2.NewClient(ctx, oauth2.StaticTokenSource(&oauth2.Token{
+		AccessToken: jwt,
+		TokenType:   "Bearer",
+	})))
+	if s.BaseURL != nil {
+		appClient.BaseURL = s.BaseURL
+	}
+
+	installationID := s.InstallationID
+	if installationID == 0 && s.Repo == "" {
+		installation, _, err := appClient.Apps.FindOrganizationInstallation(ctx, s.Owner)
+		if err != nil {
+			return nil, fmt.Errorf("error in finding the installation of app %d on %s: %v", s.AppID, s.Owner, err.Error())
+		}
+		installationID = installation.GetID()
+	} else if installationID == 0 {
+		installation, _, err := appClient.Apps.FindRepositoryInstallation(ctx, s.Owner, s.Repo)
+		if err != nil {
+			return nil, fmt.Errorf("error in finding the installation of app %d on %s/%s: %v", s.AppID, s.Owner, s.Repo, err.Error())
+		}
+		installationID = installation.GetID()
+	}
+
+	// The token of go-github can not be scoped to repositories, so the request is built here.
+	// The organization webhooks are not managed through a repository, so their token is not scoped
+	var body interface{}
+	if s.Repo != "" {
+		body = map[string][]string{"repositories": {s.Repo}}
+	}
+	req, err := appClient.NewRequest("POST", fmt.Sprintf("app/installations/%d/access_tokens", installationID), body)
+	if err != nil {
+		return nil, fmt.Errorf("error in building the installation token request: %v", err.Error())
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+
+	token := &github.InstallationToken{}
+	_, err = appClient.Do(ctx, req, token)
+	if err != nil {
+		return nil, fmt.Errorf("error in creating an installation token of app %d: %v", s.AppID, err.Error())
+	}
+	if token.GetToken() == "" {
+		return nil, fmt.Errorf("github returned an empty installation token for app %d", s.AppID)
+	}
+
+	return &oauth2.Token{
+		AccessToken: token.GetToken(),
+		TokenType:   "Bearer",
+		Expiry:      token.GetExpiresAt(),
+	}, nil
+}
+
+// signAppJWT returns the RS256 JWT authenticating the app.
+// It is issued a minute in the past against clock drift and expires within the 10 minutes github allows.
+func signAppJWT(appID int64, key *rsa.PrivateKey, now time.Time) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]interface{}{
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(9 * time.Minute).Unix(),
+		"iss": strconv.FormatInt(appID, 10),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("error in signing the app jwt: %v", err.Error())
+	}
+
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// parsePrivateKey reads the PEM private key github generates for the app, PKCS#1 or PKCS#8
+func parsePrivateKey(b []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("private key is not PEM encoded")
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("error in parsing private key: %v", err.Error())
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("private key is not an RSA key")
+	}
+	return rsaKey, nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// verifyAppJWT checks the bearer token of the request is a valid JWT of the app
+func verifyAppJWT(r *http.Request, key *rsa.PublicKey) error {
+	parts := strings.Split(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "), ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("expected a jwt, got %q", r.Header.Get("Authorization"))
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig); err != nil {
+		return err
+	}
+
+	b, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	claims := struct {
+		Iat int64  `json:"iat"`
+		Exp int64  `json:"exp"`
+		Iss string `json:"iss"`
+	}{}
+	if err := json.Unmarshal(b, &claims); err != nil {
+		return err
+	}
+	if claims.Iss != "1234" || claims.Exp-claims.Iat > 600 || claims.Exp < time.Now().Unix() {
+		return fmt.Errorf("unexpected claims %+v", claims)
+	}
+	return nil
+}
+
+func TestAppTokenSource(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("error in generating key: %v", err)
+	}
+
+	exchanges := 0
+	mux := http.NewServeMux()
+	mux.HandleFunc("/repos/nkhine/khine.net/installation", func(w http.ResponseWriter, r *http.Request) {
+		if err := verifyAppJWT(r, &key.PublicKey); err != nil {
+			t.Errorf("invalid jwt: %v", err)
+		}
+		fmt.Fprint(w, `{"id":5}`)
+	})
+	mux.HandleFunc("/app/installations/5/access_tokens", func(w http.ResponseWriter, r *http.Request) {
+		exchanges++
+		if err := verifyAppJWT(r, &key.PublicKey); err != nil {
+			t.Errorf("invalid jwt: %v", err)
+		}
+
+		body := map[string][]string{}
+		json.NewDecoder(r.Body).Decode(&body)
+		if !reflect.DeepEqual(body["repositories"], []string{"khine.net"}) {
+			t.Errorf("expected the token to be scoped to the repository, got %v", body)
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{"token":"ghs_installation","expires_at":%q}`, time.Now().Add(time.Hour).Format(time.RFC3339))
+	})
+	mux.HandleFunc("/repos/nkhine/khine.net/hooks", func(w http.ResponseWriter, r *http.Request) {
+		if auth := r.Header.Get("Authorization"); auth != "Bearer ghs_installation" {
+			t.Errorf("expected the installation token, got %q", auth)
+		}
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, `{"id":42}`)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	baseURL, _ := url.Parse(server.URL + "/")
+	config := *testConfig
+	config.GithubApp = &AppTokenSource{
+		AppID:      1234,
+		PrivateKey: key,
+		Owner:      "nkhine",
+		Repo:       "khine.net",
+		BaseURL:    baseURL,
+	}
+
+	// The installation token is reused by the next clients until it expires
+	for i := 0; i < 2; i++ {
+		client := newGithubClient(context.Background(), &config)
+		client.BaseURL = baseURL
+
+		hook, err := ensureHook(context.Background(), client, &config)
+		if err != nil || hook.GetID() != 42 {
+			t.Fatalf("expected hook 42, got %v %v", hook, err)
+		}
+	}
+	if exchanges != 1 {
+		t.Errorf("expected the installation token to be cached, got %d exchanges", exchanges)
+	}
+}
+
+func TestParsePrivateKey(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("error in generating key: %v", err)
+	}
+	pkcs8, _ := x509.MarshalPKCS8PrivateKey(key)
+
+	for name, block := range map[string]*pem.Block{
+		"pkcs1": {Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)},
+		"pkcs8": {Type: "PRIVATE KEY", Bytes: pkcs8},
+	} {
+		parsed, err := parsePrivateKey(pem.EncodeToMemory(block))
+		if err != nil || !parsed.Equal(key) {
+			t.Errorf("%s: expected the key to be parsed, got %v", name, err)
+		}
+	}
+
+	if _, err := parsePrivateKey([]byte("ghp_not_a_key")); err == nil {
+		t.Errorf("expected an error")
+	}
+}
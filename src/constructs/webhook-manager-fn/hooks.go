@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/aws/aws-lambda-go/cfn"
+	"github.com/google/go-github/github"
+	log "github.com/sirupsen/logrus"
+)
+
+// Scope of the managed webhook. An organization webhook delivers the events of every repository
+// of the organization, trigger-fn routes them with the `repository` of its rules
+const (
+	ScopeRepo = "repo"
+	ScopeOrg  = "org"
+)
+
+// hookAPI manages the webhooks of a repository or of an organization
+type hookAPI interface {
+	Create(ctx context.Context, hook *github.Hook) (*github.Hook, *github.Response, error)
+	Edit(ctx context.Context, id int64, hook *github.Hook) (*github.Hook, *github.Response, error)
+	Delete(ctx context.Context, id int64) (*github.Response, error)
+	List(ctx context.Context, opts *github.ListOptions) ([]*github.Hook, *github.Response, error)
+}
+
+// hooksOf returns the webhooks api of the scope of the config
+func hooksOf(ghClient *github.Client, config *Config) hookAPI {
+	if config.Scope == ScopeOrg {
+		return orgHooks{client: ghClient, org: config.GithubOwner}
+	}
+	return repoHooks{client: ghClient, owner: config.GithubOwner, repo: config.GithubRepo}
+}
+
+type repoHooks struct {
+	client *github.Client
+	owner  string
+	repo   string
+}
+
+func (h repoHooks) Create(ctx context.Context, hook *github.Hook) (*github.Hook, *github.Response, error) {
+	return h.client.Repositories.CreateHook(ctx, h.owner, h.repo, hook)
+}
+
+func (h repoHooks) Edit(ctx context.Context, id int64, hook *github.Hook) (*github.Hook, *github.Response, error) {
+	return h.client.Repositories.EditHook(ctx, h.owner, h.repo, id, hook)
+}
+
+func (h repoHooks) Delete(ctx context.Context, id int64) (*github.Response, error) {
+	return h.client.Repositories.DeleteHook(ctx, h.owner, h.repo, id)
+}
+
+func (h repoHooks) List(ctx context.Context, opts *github.ListOptions) ([]*github.Hook, *github.Response, error) {
+	return h.client.Repositories.ListHooks(ctx, h.owner, h.repo, opts)
+}
+
+type orgHooks struct {
+	client *github.Client
+	org    string
+}
+
+func (h orgHooks) Create(ctx context.Context, hook *github.Hook) (*github.Hook, *github.Response, error) {
+	// Organization webhooks have to be named `web`
+	hook.Name = github.String("web")
+	return h.client.Organizations.CreateHook(ctx, h.org, hook)
+}
+
+func (h orgHooks) Edit(ctx context.Context, id int64, hook *github.Hook) (*github.Hook, *github.Response, error) {
+	return h.client.Organizations.EditHook(ctx, h.org, id, hook)
+}
+
+func (h orgHooks) Delete(ctx context.Context, id int64) (*github.Response, error) {
+	return h.client.Organizations.DeleteHook(ctx, h.org, id)
+}
+
+func (h orgHooks) List(ctx context.Context, opts *github.ListOptions) ([]*github.Hook, *github.Response, error) {
+	return h.client.Organizations.ListHooks(ctx, h.org, opts)
+}
+
+// Defaults of the optional hook properties.
+// `push` starts the pipelines in trigger-fn, `pull_request` the preview pipelines and `issue_comment` the deploy commands
+var DefaultEvents = []string{"push", "pull_request", "issue_comment"}
+
+const DefaultContentType = "json"
+
+// SupportedEvents are the repository webhook events github can deliver, `*` subscribes to all of them
+// https://docs.github.com/en/webhooks/webhook-events-and-payloads
+var SupportedEvents = []string{
+	"*",
+	"branch_protection_rule", "check_run", "check_suite", "code_scanning_alert", "commit_comment",
+	"create", "delete", "dependabot_alert", "deploy_key", "deployment", "deployment_status",
+	"discussion", "discussion_comment", "fork", "gollum", "issue_comment", "issues", "label",
+	"member", "merge_group", "meta", "milestone", "package", "page_build", "project", "project_card",
+	"project_column", "public", "pull_request", "pull_request_review", "pull_request_review_comment",
+	"pull_request_review_thread", "push", "registry_package", "release", "repository",
+	"repository_import", "repository_vulnerability_alert", "secret_scanning_alert",
+	"security_and_analysis", "star", "status", "team_add", "watch", "workflow_dispatch",
+	"workflow_job", "workflow_run",
+}
+
+// OrgEvents can only be delivered by an organization webhook
+var OrgEvents = []string{"membership", "org_block", "organization", "team"}
+
+// validateEvents checks the events are not empty, supported by the scope and not repeated
+func validateEvents(events []string, scope string) error {
+	if len(events) == 0 {
+		return fmt.Errorf("at least one event is required")
+	}
+
+	seen := map[string]bool{}
+	for _, event := range events {
+		if !contains(SupportedEvents, event) && !(scope == ScopeOrg && contains(OrgEvents, event)) {
+			return fmt.Errorf("unsupported event %q for a %s webhook", event, scope)
+		}
+		if seen[event] {
+			return fmt.Errorf("event %q is repeated", event)
+		}
+		seen[event] = true
+	}
+
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// desiredHook is the hook described by the resource properties
+func desiredHook(config *Config) *github.Hook {
+	insecureSSL := "0"
+	if config.InsecureSSL {
+		insecureSSL = "1"
+	}
+
+	hookConfig := map[string]interface{}{
+		"url":          config.WebhookURL,
+		"content_type": config.ContentType,
+		"insecure_ssl": insecureSSL,
+	}
+	if config.WebhookSecret != "" {
+		// trigger-fn validates the `X-Hub-Signature-256` header with this secret
+		hookConfig["secret"] = config.WebhookSecret
+	}
+
+	return &github.Hook{
+		Config: hookConfig,
+		// Note
+		// `push` event is not triggered if the changes were pushed to more than 3 tags/branches at once
+		// https://docs.github.com/en/developers/webhooks-and-events/webhooks/webhook-events-and-payloads#push
+		Events: config.Events,
+		Active: github.Bool(config.Active),
+	}
+}
+
+// ensureHook creates the hook. When github answers 422 because a hook with the
+// same url already exists, that hook is adopted and brought in line with the desired one.
+func ensureHook(ctx context.Context, ghClient *github.Client, config *Config) (*github.Hook, error) {
+	hooks := hooksOf(ghClient, config)
+
+	hook, resp, err := hooks.Create(ctx, desiredHook(config))
+	if err == nil {
+		return hook, nil
+	}
+	if e := forbidden(config, resp, err); e != nil {
+		return nil, e
+	}
+	if resp == nil || resp.StatusCode != http.StatusUnprocessableEntity {
+		return nil, fmt.Errorf("error in registering webhook: %v", err.Error())
+	}
+
+	existing, err := findHook(ctx, hooks, config)
+	if err != nil {
+		return nil, err
+	}
+	if existing == nil {
+		return nil, fmt.Errorf("github answered 422 but there is no hook for %s: %v", config.WebhookURL, resp.Status)
+	}
+
+	log.WithFields(log.Fields{
+		"webhook_url": config.WebhookURL,
+		"gh_owner":    config.GithubOwner,
+		"gh_repo":     config.GithubRepo,
+		"scope":       config.Scope,
+		"hook_id":     existing.GetID(),
+	}).Infoln("webhook already exists, adopting it")
+
+	hook, resp, err = hooks.Edit(ctx, existing.GetID(), desiredHook(config))
+	if e := forbidden(config, resp, err); e != nil {
+		return nil, e
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error in updating webhook %d: %v", existing.GetID(), err.Error())
+	}
+
+	return hook, nil
+}
+
+// findHook returns the hook sending its deliveries to the webhook url, nil when there is none
+func findHook(ctx context.Context, hooks hookAPI, config *Config) (*github.Hook, error) {
+	opts := &github.ListOptions{PerPage: 100}
+	for {
+		page, resp, err := hooks.List(ctx, opts)
+		if e := forbidden(config, resp, err); e != nil {
+			return nil, e
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error in listing webhooks: %v", err.Error())
+		}
+		for _, hook := range page {
+			if url, _ := hook.Config["url"].(string); url == config.WebhookURL {
+				return hook, nil
+			}
+		}
+
+		if resp.NextPage == 0 {
+			return nil, nil
+		}
+		opts.Page = resp.NextPage
+	}
+}
+
+// updateHook edits the hook of the physical resource id in place. The hook is only
+// registered again when the repository or organization changed or the hook is gone.
+func updateHook(ctx context.Context, ghClient *github.Client, config *Config, evt cfn.Event) (*github.Hook, error) {
+	fields := log.Fields{
+		"physical_resource_id": evt.PhysicalResourceID,
+		"webhook_url":          config.WebhookURL,
+		"gh_owner":             config.GithubOwner,
+		"gh_repo":              config.GithubRepo,
+		"scope":                config.Scope,
+	}
+
+	hookId, err := parseHookID(evt.PhysicalResourceID)
+	if err != nil {
+		log.WithFields(fields).Warnf("%v, registering the webhook", err.Error())
+		return ensureHook(ctx, ghClient, config)
+	}
+	if targetChanged(evt, config) {
+		// The old hook is deleted by Cloudformation with the previous physical id
+		log.WithFields(fields).Infoln("repository or organization changed, replacing the webhook")
+		return ensureHook(ctx, ghClient, config)
+	}
+
+	hook, resp, err := hooksOf(ghClient, config).Edit(ctx, hookId, desiredHook(config))
+	if resp != nil && resp.StatusCode == http.StatusNotFound {
+		log.WithFields(fields).Warnln("webhook does not exist anymore, registering it again")
+		return ensureHook(ctx, ghClient, config)
+	}
+	if e := forbidden(config, resp, err); e != nil {
+		return nil, e
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error in updating webhook %d: %v", hookId, err.Error())
+	}
+
+	return hook, nil
+}
+
+// forbidden explains a 403, the github app or the token is missing the permission to manage the
+// webhooks of the repository or organization. It is nil for the other errors, including rate limits.
+func forbidden(config *Config, resp *github.Response, err error) error {
+	if err == nil || resp == nil || resp.StatusCode != http.StatusForbidden {
+		return nil
+	}
+	switch err.(type) {
+	case *github.RateLimitError, *github.AbuseRateLimitError:
+		return nil
+	}
+
+	target, permission, scope := config.GithubOwner+"/"+config.GithubRepo, "repository", "admin:repo_hook"
+	if config.Scope == ScopeOrg {
+		target, permission, scope = "the "+config.GithubOwner+" organization", "organization", "admin:org_hook"
+	}
+
+	if config.GithubApp != nil {
+		return fmt.Errorf("github app %d is not allowed to manage the webhooks of %s, it needs the %s \"Webhooks: read & write\" permission: %v",
+			config.GithubApp.AppID, target, permission, err.Error())
+	}
+	return fmt.Errorf("github token is not allowed to manage the webhooks of %s, it needs the %s scope: %v", target, scope, err.Error())
+}
+
+// targetChanged reports whether the update moves the webhook to another repository or organization
+func targetChanged(evt cfn.Event, config *Config) bool {
+	owner, _ := evt.OldResourceProperties["GithubOwner"].(string)
+	repo, _ := evt.OldResourceProperties["GithubRepo"].(string)
+	scope, _ := evt.OldResourceProperties["Scope"].(string)
+	if scope == "" {
+		scope = ScopeRepo
+	}
+
+	if scope != config.Scope || owner != config.GithubOwner {
+		return true
+	}
+	return config.Scope == ScopeRepo && repo != config.GithubRepo
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/cfn"
+	"github.com/google/go-github/github"
+)
+
+var testConfig = &Config{
+	Scope:         ScopeRepo,
+	GithubOwner:   "nkhine",
+	GithubRepo:    "khine.net",
+	GithubBranch:  "main",
+	WebhookURL:    "https://abc.lambda-url.eu-west-1.on.aws/",
+	WebhookSecret: "secret",
+	Events:        DefaultEvents,
+	ContentType:   DefaultContentType,
+	Active:        true,
+}
+
+// newFakeGithub starts a server standing in for the github api and a client talking to it
+func newFakeGithub(t *testing.T, mux *http.ServeMux) *github.Client {
+	t.Helper()
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	client := github.NewClient(nil)
+	client.BaseURL, _ = url.Parse(server.URL + "/")
+	return client
+}
+
+func TestEnsureHookCreates(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/repos/nkhine/khine.net/hooks", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, `{"id":42}`)
+	})
+
+	hook, err := ensureHook(context.Background(), newFakeGithub(t, mux), testConfig)
+	if err != nil || hook.GetID() != 42 {
+		t.Errorf("expected hook 42, got %v %v", hook, err)
+	}
+}
+
+func TestEnsureHookAdoptsExistingHook(t *testing.T) {
+	var edited *github.Hook
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/repos/nkhine/khine.net/hooks", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			fmt.Fprint(w, `{"message":"Validation Failed","errors":[{"message":"Hook already exists on this repository"}]}`)
+			return
+		}
+
+		if r.URL.Query().Get("page") == "" {
+			w.Header().Set("Link", fmt.Sprintf(`<http://%s%s?page=2>; rel="next"`, r.Host, r.URL.Path))
+			fmt.Fprint(w, `[{"id":1,"config":{"url":"https://example.com/hook"}}]`)
+			return
+		}
+		fmt.Fprintf(w, `[{"id":7,"config":{"url":%q},"events":["push"]}]`, testConfig.WebhookURL)
+	})
+	mux.HandleFunc("/repos/nkhine/khine.net/hooks/7", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPatch {
+			t.Errorf("unexpected %s", r.Method)
+		}
+		edited = &github.Hook{}
+		json.NewDecoder(r.Body).Decode(edited)
+		fmt.Fprint(w, `{"id":7}`)
+	})
+
+	hook, err := ensureHook(context.Background(), newFakeGithub(t, mux), testConfig)
+	if err != nil || hook.GetID() != 7 {
+		t.Fatalf("expected hook 7 to be adopted, got %v %v", hook, err)
+	}
+	if edited == nil || !reflect.DeepEqual(edited.Events, []string{"push", "pull_request", "issue_comment"}) || edited.Config["secret"] != "secret" {
+		t.Errorf("expected the hook to be brought in line, got %+v", edited)
+	}
+}
+
+func TestEnsureHookWithoutMatchingHook(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/repos/nkhine/khine.net/hooks", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			fmt.Fprint(w, `{"message":"Validation Failed"}`)
+			return
+		}
+		fmt.Fprint(w, `[]`)
+	})
+
+	if _, err := ensureHook(context.Background(), newFakeGithub(t, mux), testConfig); err == nil {
+		t.Errorf("expected an error")
+	}
+}
+
+func TestEnsureHookForbidden(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/repos/nkhine/khine.net/hooks", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `{"message":"Resource not accessible by integration"}`)
+	})
+	mux.HandleFunc("/orgs/khine.net/hooks", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `{"message":"Resource not accessible by integration"}`)
+	})
+	client := newFakeGithub(t, mux)
+
+	org := *testConfig
+	org.Scope = ScopeOrg
+	org.GithubOwner = "khine.net"
+	org.GithubRepo = ""
+	orgApp := org
+	orgApp.GithubApp = &AppTokenSource{AppID: 1234}
+
+	for _, tc := range []struct {
+		config   *Config
+		expected string
+	}{
+		{testConfig, "needs the admin:repo_hook scope"},
+		{&org, "needs the admin:org_hook scope"},
+		{&orgApp, `github app 1234 is not allowed to manage the webhooks of the khine.net organization, it needs the organization "Webhooks: read & write" permission`},
+	} {
+		_, err := ensureHook(context.Background(), client, tc.config)
+		if err == nil || !strings.Contains(err.Error(), tc.expected) {
+			t.Errorf("expected %q, got %v", tc.expected, err)
+		}
+	}
+}
+
+func TestUpdateHook(t *testing.T) {
+	sameRepo := map[string]interface{}{"GithubOwner": "nkhine", "GithubRepo": "khine.net"}
+
+	tests := []struct {
+		name       string
+		physicalID string
+		old        map[string]interface{}
+		want       int64
+		edited     bool
+		created    bool
+	}{
+		{"edits in place", "githubwebhookmanager-7", sameRepo, 7, true, false},
+		{"hook is gone", "githubwebhookmanager-3", sameRepo, 42, false, true},
+		{"repository changed", "githubwebhookmanager-7", map[string]interface{}{"GithubOwner": "nkhine", "GithubRepo": "old"}, 42, false, true},
+		{"scope changed", "githubwebhookmanager-7", map[string]interface{}{"Scope": "org", "GithubOwner": "nkhine"}, 42, false, true},
+		{"no hook id", "githubwebhookmanager", sameRepo, 42, false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var edited *github.Hook
+			created := false
+
+			mux := http.NewServeMux()
+			mux.HandleFunc("/repos/nkhine/khine.net/hooks", func(w http.ResponseWriter, r *http.Request) {
+				created = true
+				w.WriteHeader(http.StatusCreated)
+				fmt.Fprint(w, `{"id":42}`)
+			})
+			mux.HandleFunc("/repos/nkhine/khine.net/hooks/7", func(w http.ResponseWriter, r *http.Request) {
+				edited = &github.Hook{}
+				json.NewDecoder(r.Body).Decode(edited)
+				fmt.Fprint(w, `{"id":7}`)
+			})
+			mux.HandleFunc("/repos/nkhine/khine.net/hooks/3", func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, `{"message":"Not Found"}`, http.StatusNotFound)
+			})
+
+			evt := cfn.Event{PhysicalResourceID: tt.physicalID, OldResourceProperties: tt.old}
+			hook, err := updateHook(context.Background(), newFakeGithub(t, mux), testConfig, evt)
+			if err != nil || hook.GetID() != tt.want {
+				t.Fatalf("expected hook %d, got %v %v", tt.want, hook, err)
+			}
+			if (edited != nil) != tt.edited || created != tt.created {
+				t.Errorf("expected edited %v and created %v, got %v %v", tt.edited, tt.created, edited != nil, created)
+			}
+			if edited != nil && (edited.Config["url"] != testConfig.WebhookURL || !edited.GetActive()) {
+				t.Errorf("expected the desired hook, got %+v", edited)
+			}
+		})
+	}
+}
+
+func TestBuildResponsePhysicalID(t *testing.T) {
+	id := int64(7)
+
+	tests := []struct {
+		name     string
+		previous string
+		hookID   *int64
+		want     string
+	}{
+		{"create", "", &id, "githubwebhookmanager-7"},
+		{"adopted on update", "githubwebhookmanager", &id, "githubwebhookmanager-7"},
+		{"failed update", "githubwebhookmanager-3", nil, "githubwebhookmanager-3"},
+		{"failed create", "", nil, "githubwebhookmanager"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := buildResponse(cfn.Event{PhysicalResourceID: tt.previous}, cfn.StatusSuccess, tt.hookID)
+			if resp.PhysicalResourceID != tt.want {
+				t.Errorf("expected %s, got %s", tt.want, resp.PhysicalResourceID)
+			}
+		})
+	}
+}
+
+func TestReadHookProperties(t *testing.T) {
+	tests := []struct {
+		name       string
+		properties map[string]interface{}
+		want       *Config
+		field      string
+	}{
+		{"defaults", map[string]interface{}{}, &Config{Events: DefaultEvents, ContentType: "json", Active: true}, ""},
+		{
+			"cloudformation strings",
+			map[string]interface{}{"Events": []interface{}{"release", "push"}, "ContentType": "json", "Active": "false", "InsecureSsl": "true"},
+			&Config{Events: []string{"release", "push"}, ContentType: "json", InsecureSSL: true},
+			"",
+		},
+		{"unsupported event", map[string]interface{}{"Events": []interface{}{"push", "pushes"}}, nil, "Events"},
+		{"no events", map[string]interface{}{"Events": []interface{}{}}, nil, "Events"},
+		{"repeated event", map[string]interface{}{"Events": []interface{}{"push", "push"}}, nil, "Events"},
+		{"content type", map[string]interface{}{"ContentType": "form"}, nil, "ContentType"},
+		{"active", map[string]interface{}{"Active": "yes please"}, nil, "Active"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &Config{}
+			field, err := readHookProperties(cfn.Event{ResourceProperties: tt.properties}, config)
+			if field != tt.field || (err == nil) != (tt.field == "") {
+				t.Fatalf("expected field %q, got %q %v", tt.field, field, err)
+			}
+			if tt.want != nil && !reflect.DeepEqual(config, tt.want) {
+				t.Errorf("expected %+v, got %+v", tt.want, config)
+			}
+		})
+	}
+}
+
+func TestDesiredHook(t *testing.T) {
+	config := *testConfig
+	config.WebhookSecret = ""
+	config.InsecureSSL = true
+	config.Active = false
+
+	hook := desiredHook(&config)
+	if _, ok := hook.Config["secret"]; ok {
+		t.Errorf("expected no secret, got %v", hook.Config)
+	}
+	if hook.Config["insecure_ssl"] != "1" || hook.GetActive() {
+		t.Errorf("unexpected hook %+v", hook)
+	}
+}
+
+func TestOrgHooks(t *testing.T) {
+	var created *github.Hook
+	deleted := false
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/orgs/khine.net/hooks", func(w http.ResponseWriter, r *http.Request) {
+		created = &github.Hook{}
+		json.NewDecoder(r.Body).Decode(created)
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, `{"id":42}`)
+	})
+	mux.HandleFunc("/orgs/khine.net/hooks/42", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPatch:
+			fmt.Fprint(w, `{"id":42}`)
+		case http.MethodDelete:
+			deleted = true
+			w.WriteHeader(http.StatusNoContent)
+		}
+	})
+	mux.HandleFunc("/repos/", func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected repository request %s %s", r.Method, r.URL.Path)
+	})
+	client := newFakeGithub(t, mux)
+
+	config := *testConfig
+	config.Scope = ScopeOrg
+	config.GithubOwner = "khine.net"
+	config.GithubRepo = ""
+	config.Events = []string{"push", "repository"}
+
+	hook, err := ensureHook(context.Background(), client, &config)
+	if err != nil || hook.GetID() != 42 || created.GetName() != "web" {
+		t.Fatalf("expected the org hook to be created, got %v %v %+v", hook, err, created)
+	}
+
+	evt := cfn.Event{
+		PhysicalResourceID:    "githubwebhookmanager-42",
+		OldResourceProperties: map[string]interface{}{"Scope": "org", "GithubOwner": "khine.net", "GithubRepo": "ignored"},
+	}
+	hook, err = updateHook(context.Background(), client, &config, evt)
+	if err != nil || hook.GetID() != 42 {
+		t.Errorf("expected the org hook to be edited in place, got %v %v", hook, err)
+	}
+
+	if _, err := hooksOf(client, &config).Delete(context.Background(), 42); err != nil || !deleted {
+		t.Errorf("expected the org hook to be deleted, got %v", err)
+	}
+}
+
+func TestValidateEventsScope(t *testing.T) {
+	if err := validateEvents([]string{"push", "team"}, ScopeRepo); err == nil {
+		t.Errorf("expected team to be rejected for a repository webhook")
+	}
+	if err := validateEvents([]string{"push", "team"}, ScopeOrg); err != nil {
+		t.Errorf("expected team to be accepted for an organization webhook, got %v", err)
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"fmt"
+	"net/http"
 	"strconv"
 	"strings"
 
@@ -17,11 +18,28 @@ import (
 )
 
 type Config struct {
-	GithubOwner  string
+	// Scope is `repo` (the default) or `org`, see ScopeOrg
+	Scope string
+	// GithubOwner is the organization of an `org` webhook
+	GithubOwner string
+	// GithubRepo is ignored for an `org` webhook
 	GithubRepo   string
 	GithubBranch string
-	GithubToken  string
-	WebhookURL   string
+	// GithubToken is the personal access token, when the webhook is not managed by GithubApp
+	GithubToken string
+	GithubApp   *AppTokenSource
+	WebhookURL  string
+
+	// WebhookSecret is sent along with the hook config so github signs every delivery.
+	// It is optional, but trigger-fn rejects the unsigned deliveries
+	WebhookSecret string
+
+	// Events the hook is registered for, see SupportedEvents
+	Events []string
+	// ContentType can only be `json`, trigger-fn does not decode the `form` deliveries
+	ContentType string
+	Active      bool
+	InsecureSSL bool
 }
 
 func readResourceProperties(evt cfn.Event) (*Config, string, error) {
@@ -29,38 +47,165 @@ func readResourceProperties(evt cfn.Event) (*Config, string, error) {
 	if err != nil {
 		return nil, "GithubOwner", err
 	}
-	ghRepo, err := readProperty[string](evt, "GithubRepo")
-	if err != nil {
-		return nil, "GithubRepo", err
+	scope := ScopeRepo
+	if _, ok := evt.ResourceProperties["Scope"]; ok {
+		v, err := readProperty[string](evt, "Scope")
+		if err != nil {
+			return nil, "Scope", err
+		}
+		scope = *v
+	}
+	if scope != ScopeRepo && scope != ScopeOrg {
+		return nil, "Scope", fmt.Errorf("scope must be repo or org, got %q", scope)
+	}
+
+	ghRepo := ""
+	if scope == ScopeRepo {
+		v, err := readProperty[string](evt, "GithubRepo")
+		if err != nil {
+			return nil, "GithubRepo", err
+		}
+		ghRepo = *v
 	}
 	ghBranch, err := readProperty[string](evt, "GithubBranch")
 	if err != nil {
 		return nil, "GithubBranch", err
 	}
 
-	ghTokenArn, err := readProperty[string](evt, "GithubTokenArn")
+	ghToken := ""
+	var ghApp *AppTokenSource
+	if _, ok := evt.ResourceProperties["GithubAppId"]; ok {
+		app, field, err := readAppProperties(evt)
+		if err != nil {
+			return nil, field, err
+		}
+		ghApp = app
+		ghApp.Owner = *ghOwner
+		ghApp.Repo = ghRepo
+	} else {
+		ghTokenArn, err := readProperty[string](evt, "GithubTokenArn")
+		if err != nil {
+			return nil, "GithubTokenArn", err
+		}
+		token, err := readSecret(*ghTokenArn)
+		if err != nil {
+			return nil, "GithubTokenArn", fmt.Errorf("error in reading secret from secretsmanager: %v", err.Error())
+		}
+		ghToken = *token
+	}
+
+	webhookURL, err := readProperty[string](evt, "WebhookURL")
 	if err != nil {
-		return nil, "GithubTokenArn", err
+		return nil, "WebhookURL", err
+	}
+
+	webhookSecret := ""
+	if _, ok := evt.ResourceProperties["SecretArn"]; ok {
+		secretArn, err := readProperty[string](evt, "SecretArn")
+		if err != nil {
+			return nil, "SecretArn", err
+		}
+		secret, err := readSecret(*secretArn)
+		if err != nil {
+			return nil, "SecretArn", fmt.Errorf("error in reading secret from secretsmanager: %v", err.Error())
+		}
+		webhookSecret = *secret
 	}
-	ghToken, err := readGithubToken(*ghTokenArn)
+
+	config := &Config{
+		Scope:         scope,
+		GithubOwner:   *ghOwner,
+		GithubRepo:    ghRepo,
+		GithubBranch:  *ghBranch,
+		GithubToken:   ghToken,
+		GithubApp:     ghApp,
+		WebhookURL:    *webhookURL,
+		WebhookSecret: webhookSecret,
+	}
+
+	field, err := readHookProperties(evt, config)
 	if err != nil {
-		return nil, "GithubTokenArn", fmt.Errorf("error in reading secret from secretsmanager: %v", err.Error())
+		return nil, field, err
 	}
 
-	webhookURL, err := readProperty[string](evt, "WebhookURL")
+	return config, "", nil
+}
+
+// readAppProperties reads the github app the webhook is managed with.
+// The installation id is optional, it is looked up from the repository otherwise
+func readAppProperties(evt cfn.Event) (*AppTokenSource, string, error) {
+	appID, err := readIDProperty(evt, "GithubAppId")
 	if err != nil {
-		return nil, "WebhookURL", err
+		return nil, "GithubAppId", err
+	}
+
+	installationID := int64(0)
+	if _, ok := evt.ResourceProperties["GithubAppInstallationId"]; ok {
+		installationID, err = readIDProperty(evt, "GithubAppInstallationId")
+		if err != nil {
+			return nil, "GithubAppInstallationId", err
+		}
+	}
+
+	keyArn, err := readProperty[string](evt, "GithubAppPrivateKeyArn")
+	if err != nil {
+		return nil, "GithubAppPrivateKeyArn", err
+	}
+	pemKey, err := readSecret(*keyArn)
+	if err != nil {
+		return nil, "GithubAppPrivateKeyArn", fmt.Errorf("error in reading secret from secretsmanager: %v", err.Error())
+	}
+	key, err := parsePrivateKey([]byte(*pemKey))
+	if err != nil {
+		return nil, "GithubAppPrivateKeyArn", err
 	}
 
-	return &Config{
-		GithubOwner:  *ghOwner,
-		GithubRepo:   *ghRepo,
-		GithubBranch: *ghBranch,
-		GithubToken:  *ghToken,
-		WebhookURL:   *webhookURL,
+	return &AppTokenSource{
+		AppID:          appID,
+		InstallationID: installationID,
+		PrivateKey:     key,
 	}, "", nil
 }
 
+// readHookProperties reads the optional properties of the hook into the config, with their defaults
+func readHookProperties(evt cfn.Event, config *Config) (string, error) {
+	events, err := readListProperty(evt, "Events", DefaultEvents)
+	if err != nil {
+		return "Events", err
+	}
+	err = validateEvents(events, config.Scope)
+	if err != nil {
+		return "Events", err
+	}
+
+	contentType := DefaultContentType
+	if _, ok := evt.ResourceProperties["ContentType"]; ok {
+		v, err := readProperty[string](evt, "ContentType")
+		if err != nil {
+			return "ContentType", err
+		}
+		contentType = *v
+	}
+	if contentType != "json" {
+		return "ContentType", fmt.Errorf("content type must be json since trigger-fn only parses json deliveries, got %q", contentType)
+	}
+
+	active, err := readBoolProperty(evt, "Active", true)
+	if err != nil {
+		return "Active", err
+	}
+	insecureSSL, err := readBoolProperty(evt, "InsecureSsl", false)
+	if err != nil {
+		return "InsecureSsl", err
+	}
+
+	config.Events = events
+	config.ContentType = contentType
+	config.Active = active
+	config.InsecureSSL = insecureSSL
+	return "", nil
+}
+
 func main() {
 	lambda.Start(func(ctx context.Context, evt cfn.Event) (cfn.Response, error) {
 		return handler(ctx, evt)
@@ -98,12 +243,12 @@ func handler(ctx context.Context, evt cfn.Event) (cfn.Response, error) {
 func deleteHandler(ctx context.Context, config *Config, evt cfn.Event) (cfn.Response, error) {
 	log.Infoln("starting delete handler")
 
-	phyResId := strings.Split(evt.PhysicalResourceID, PhyIdSeparator)
-	if len(phyResId) < 2 {
+	hookId, err := parseHookID(evt.PhysicalResourceID)
+	if err != nil {
 		// There is no hook id, just exit
 		log.WithFields(log.Fields{
 			"physical_resource_id": evt.PhysicalResourceID,
-		}).Warnf("did not find a hook id in physical resource id, exiting")
+		}).Warnf("%v, exiting", err.Error())
 
 		// exit silently
 		resp := buildResponse(evt, cfn.StatusSuccess, nil)
@@ -113,26 +258,19 @@ func deleteHandler(ctx context.Context, config *Config, evt cfn.Event) (cfn.Resp
 		return resp, nil
 	}
 
-	ghClient := github.NewClient(oauth2.NewClient(ctx, &Token{
-		PersonalAccessToken: config.GithubToken,
-	}))
+	ghClient := newGithubClient(ctx, config)
 
-	hookIdStr := phyResId[1]
-	hookId, err := strconv.ParseInt(hookIdStr, 10, 64)
-	if err != nil {
+	resp, err := hooksOf(ghClient, config).Delete(ctx, hookId)
+	if e := forbidden(config, resp, err); e != nil {
+		err = e
+	}
+	if resp != nil && resp.StatusCode == http.StatusNotFound {
+		// Already deleted, e.g. by hand
 		log.WithFields(log.Fields{
-			"physical_resource_id": evt.PhysicalResourceID,
-		}).Warnf("could not parse hook id from the physical resource id: %v", err.Error())
-
-		// exit silently
-		resp := buildResponse(evt, cfn.StatusSuccess, nil)
-		if e := resp.Send(); e != nil {
-			log.Fatalf("error in sending response: %v", e.Error())
-		}
-		return resp, nil
+			"hook_id": hookId,
+		}).Warnln("webhook does not exist anymore")
+		err = nil
 	}
-
-	_, err = ghClient.Repositories.DeleteHook(ctx, config.GithubOwner, config.GithubRepo, hookId)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"webhook_url": config.WebhookURL,
@@ -156,168 +294,85 @@ func deleteHandler(ctx context.Context, config *Config, evt cfn.Event) (cfn.Resp
 	return r, nil
 }
 
-// updateHandler creates a webhook in the github repo and when it is successfull returns a physical id like,
-// githubwebhookmanager-${hookid}
-// The existing hookid will be different since updateHandler is also just creating another webhook
-// Soo, Cloudformation will issue a delete request with that previous hookid(or actually the physical resource id) automatically.
+// updateHandler edits the hook of the physical resource id in place, so the physical id stays the same.
+// When the repository changed, or the hook is gone, the webhook is registered again with a new hookid,
+// so Cloudformation will issue a delete request with that previous hookid(or actually the physical resource id) automatically.
 func updateHandler(ctx context.Context, config *Config, evt cfn.Event) (cfn.Response, error) {
 	log.Infoln("starting update handler")
 
-	ghClient := github.NewClient(oauth2.NewClient(ctx, &Token{
-		PersonalAccessToken: config.GithubToken,
-	}))
+	ghClient := newGithubClient(ctx, config)
 
-	hook, resp, err := ghClient.Repositories.CreateHook(ctx, config.GithubOwner, config.GithubRepo, &github.Hook{
-		Config: map[string]interface{}{
-			"url":          config.WebhookURL,
-			"content_type": "json",
-			"insecure_ssl": "0",
-			// TODO: Look into adding a secret and validating HMAC
-		},
-		// Note
-		// `push` event is not triggered if the changes were pushed to more than 3 tags/branches at once
-		// https://docs.github.com/en/developers/webhooks-and-events/webhooks/webhook-events-and-payloads#push
-		Events: []string{"push"},
-	})
+	hook, err := updateHook(ctx, ghClient, config, evt)
 	if err != nil {
 		log.WithFields(log.Fields{
-			"webhook_url": config.WebhookURL,
-			"gh_owner":    config.GithubOwner,
-			"gh_repo":     config.GithubRepo,
-			"gh_branch":   config.GithubBranch,
-		}).Errorf("error in registering webhook: %v", err.Error())
-
-		resp := buildResponse(evt, cfn.StatusFailed, nil)
-		if e := resp.Send(); e != nil {
-			log.Fatalf("error in sending response: %v", e.Error())
-		}
-
-		return resp, fmt.Errorf("error in  registering webhook: %v", err.Error())
-	}
+			"physical_resource_id": evt.PhysicalResourceID,
+			"webhook_url":          config.WebhookURL,
+			"gh_owner":             config.GithubOwner,
+			"gh_repo":              config.GithubRepo,
+			"gh_branch":            config.GithubBranch,
+		}).Errorln(err.Error())
 
-	switch resp.Response.StatusCode {
-	// https://docs.github.com/en/rest/orgs/webhooks#update-an-organization-webhook
-	case 201:
-		r := buildResponse(evt, cfn.StatusSuccess, hook.ID)
-		if e := r.Send(); e != nil {
-			log.Fatalf("error in sending response: %v", e.Error())
-		}
-		return r, nil
-	case 403:
 		r := buildResponse(evt, cfn.StatusFailed, nil)
 		if e := r.Send(); e != nil {
 			log.Fatalf("error in sending response: %v", e.Error())
 		}
-		return r, fmt.Errorf("received 403 in response to create webhook")
-	case 404:
-		r := buildResponse(evt, cfn.StatusFailed, nil)
-		if e := r.Send(); e != nil {
-			log.Fatalf("error in sending response: %v", e.Error())
-		}
-		return r, fmt.Errorf("received 404 in response to create webhook")
-	case 422:
-
-		log.WithFields(log.Fields{
-			"webhook_url": config.WebhookURL,
-			"gh_owner":    config.GithubOwner,
-			"gh_repo":     config.GithubRepo,
-			"gh_branch":   config.GithubBranch,
-		}).Infoln("got 422 response from github. webhook already exists")
-
-		r := buildResponse(evt, cfn.StatusSuccess, nil)
-		if e := r.Send(); e != nil {
-			log.Fatalf("error in sending response: %v", e.Error())
-		}
-
-		return r, nil
+		return r, err
+	}
 
-	default:
-		r := buildResponse(evt, cfn.StatusFailed, nil)
-		if e := r.Send(); e != nil {
-			log.Fatalf("error in sending response: %v", e.Error())
-		}
-		return r, fmt.Errorf("received %d in response to create webhook", resp.Response.StatusCode)
+	r := buildResponse(evt, cfn.StatusSuccess, hook.ID)
+	if e := r.Send(); e != nil {
+		log.Fatalf("error in sending response: %v", e.Error())
 	}
+
+	return r, nil
 }
 
 // createHandler creates a webhook in the github repo and when it is successfull returns a physical id like,
 // githubwebhookmanager-${hookid}
+// A hook already sending its deliveries to the webhook url is adopted instead.
 func createHandler(ctx context.Context, config *Config, evt cfn.Event) (cfn.Response, error) {
 	log.Infoln("starting create handler")
 
-	ghClient := github.NewClient(oauth2.NewClient(ctx, &Token{
-		PersonalAccessToken: config.GithubToken,
-	}))
+	ghClient := newGithubClient(ctx, config)
 
-	hook, resp, err := ghClient.Repositories.CreateHook(ctx, config.GithubOwner, config.GithubRepo, &github.Hook{
-		Config: map[string]interface{}{
-			"url":          config.WebhookURL,
-			"content_type": "json",
-			"insecure_ssl": "0",
-			// TODO: Look into adding a secret and validating HMAC
-		},
-		// Note
-		// `push` event is not triggered if the changes were pushed to more than 3 tags/branches at once
-		// https://docs.github.com/en/developers/webhooks-and-events/webhooks/webhook-events-and-payloads#push
-		Events: []string{"push"},
-	})
+	return registerHook(ctx, ghClient, config, evt)
+}
+
+// registerHook creates or adopts the webhook and answers cloudformation with its id
+func registerHook(ctx context.Context, ghClient *github.Client, config *Config, evt cfn.Event) (cfn.Response, error) {
+	hook, err := ensureHook(ctx, ghClient, config)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"webhook_url": config.WebhookURL,
 			"gh_owner":    config.GithubOwner,
 			"gh_repo":     config.GithubRepo,
 			"gh_branch":   config.GithubBranch,
-		}).Errorf("error in registering webhook: %v", err.Error())
+		}).Errorln(err.Error())
 
 		r := buildResponse(evt, cfn.StatusFailed, nil)
 		if e := r.Send(); e != nil {
 			log.Fatalf("error in sending response: %v", e.Error())
 		}
-		return r, fmt.Errorf("error in  registering webhook: %v", err.Error())
+		return r, err
 	}
 
-	switch resp.Response.StatusCode {
-	case 201:
-		r := buildResponse(evt, cfn.StatusSuccess, hook.ID)
-		if e := r.Send(); e != nil {
-			log.Fatalf("error in sending response: %v", e.Error())
-		}
-
-		return r, nil
-	case 403:
-		r := buildResponse(evt, cfn.StatusFailed, nil)
-		if e := r.Send(); e != nil {
-			log.Fatalf("error in sending response: %v", e.Error())
-		}
-		return r, fmt.Errorf("received 403 in response to create webhook")
-	case 404:
-		r := buildResponse(evt, cfn.StatusFailed, nil)
-		if e := r.Send(); e != nil {
-			log.Fatalf("error in sending response: %v", e.Error())
-		}
-		return r, fmt.Errorf("received 404 in response to create webhook")
-	case 422:
-
-		log.WithFields(log.Fields{
-			"webhook_url": config.WebhookURL,
-			"gh_owner":    config.GithubOwner,
-			"gh_repo":     config.GithubRepo,
-			"gh_branch":   config.GithubBranch,
-		}).Infoln("got 422 response from github. webhook already exists")
+	r := buildResponse(evt, cfn.StatusSuccess, hook.ID)
+	if e := r.Send(); e != nil {
+		log.Fatalf("error in sending response: %v", e.Error())
+	}
 
-		r := buildResponse(evt, cfn.StatusSuccess, nil)
-		if e := r.Send(); e != nil {
-			log.Fatalf("error in sending response: %v", e.Error())
-		}
-		return r, nil
+	return r, nil
+}
 
-	default:
-		r := buildResponse(evt, cfn.StatusFailed, nil)
-		if e := r.Send(); e != nil {
-			log.Fatalf("error in sending response: %v", e.Error())
-		}
-		return r, fmt.Errorf("received %d in response to create webhook", resp.Response.StatusCode)
+// newGithubClient authenticates with the installation token of the github app, or the personal access token
+func newGithubClient(ctx context.Context, config *Config) *github.Client {
+	if config.GithubApp != nil {
+		return github.NewClient(oauth2.NewClient(ctx, cachedAppTokenSource(config.GithubApp)))
 	}
+
+	return github.NewClient(oauth2.NewClient(ctx, &Token{
+		PersonalAccessToken: config.GithubToken,
+	}))
 }
 
 type Token struct {
@@ -359,16 +414,89 @@ func readProperty[T ResourceProperty](evt cfn.Event, propertyName string) (*T, e
 	return &v, nil
 }
 
+// readListProperty reads an optional list of strings, e.g. `Events`
+func readListProperty(evt cfn.Event, propertyName string, defaultValue []string) ([]string, error) {
+	d, ok := evt.ResourceProperties[propertyName]
+	if !ok {
+		return defaultValue, nil
+	}
+
+	items, ok := d.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("property %s is not a list", propertyName)
+	}
+	values := make([]string, 0, len(items))
+	for _, item := range items {
+		v, ok := item.(string)
+		if !ok {
+			return nil, fmt.Errorf("property %s is not a list of strings", propertyName)
+		}
+		values = append(values, v)
+	}
+
+	return values, nil
+}
+
+// readIDProperty reads a github id. Cloudformation passes the numbers as strings
+func readIDProperty(evt cfn.Event, propertyName string) (int64, error) {
+	v, err := readProperty[string](evt, propertyName)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := strconv.ParseInt(*v, 10, 64)
+	if err != nil || id <= 0 {
+		return 0, fmt.Errorf("property %s is not a github id: %q", propertyName, *v)
+	}
+	return id, nil
+}
+
+// readBoolProperty reads an optional flag. Cloudformation passes the booleans as strings
+func readBoolProperty(evt cfn.Event, propertyName string, defaultValue bool) (bool, error) {
+	d, ok := evt.ResourceProperties[propertyName]
+	if !ok {
+		return defaultValue, nil
+	}
+
+	switch v := d.(type) {
+	case bool:
+		return v, nil
+	case string:
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return false, fmt.Errorf("property %s is not a boolean: %v", propertyName, err.Error())
+		}
+		return b, nil
+	}
+	return false, fmt.Errorf("property %s is not a boolean", propertyName)
+}
+
 const PhyIdSeparator = "-"
 
+// parseHookID reads the hook id of a physical id like githubwebhookmanager-${hookid}
+func parseHookID(physicalResourceID string) (int64, error) {
+	phyResId := strings.Split(physicalResourceID, PhyIdSeparator)
+	if len(phyResId) < 2 {
+		return 0, fmt.Errorf("did not find a hook id in physical resource id")
+	}
+
+	hookId, err := strconv.ParseInt(phyResId[1], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("could not parse hook id from the physical resource id: %v", err.Error())
+	}
+
+	return hookId, nil
+}
+
 func buildResponse(evt cfn.Event, status cfn.StatusType, hookID *int64) cfn.Response {
 	resp := cfn.NewResponse(&evt)
 	resp.Status = status
 
-	if evt.PhysicalResourceID != "" {
-		resp.PhysicalResourceID = evt.PhysicalResourceID
-	} else if hookID != nil {
+	// A new hook id replaces the previous physical id, cloudformation then deletes the previous hook
+	if hookID != nil {
 		resp.PhysicalResourceID = fmt.Sprintf("githubwebhookmanager%s%d", PhyIdSeparator, *hookID)
+	} else if evt.PhysicalResourceID != "" {
+		resp.PhysicalResourceID = evt.PhysicalResourceID
 	} else {
 		resp.PhysicalResourceID = "githubwebhookmanager"
 	}
@@ -376,7 +504,7 @@ func buildResponse(evt cfn.Event, status cfn.StatusType, hookID *int64) cfn.Resp
 	return *resp
 }
 
-func readGithubToken(secretArn string) (*string, error) {
+func readSecret(secretArn string) (*string, error) {
 	sess := session.Must(session.NewSession())
 	secretssvc := secretsmanager.New(sess)
 
@@ -0,0 +1,149 @@
+// lambda-deps generates the dependency manifest trigger-fn uses to work out the lambdas
+// affected by a push. Run it from the root of the repository:
+//
+//	go run ./src/tools/lambda-deps -o dist/lambda-deps.json
+//
+// Every main package under the given patterns is a lambda, by default the ones under
+// src/lambda/api and src/lambda/workflow. The manifest maps the directory of each package
+// of the module to the directories of the lambdas importing it, directly or not.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultPatterns are the lambdas of the repository
+var DefaultPatterns = []string{"./src/lambda/api/...", "./src/lambda/workflow/..."}
+
+// GlobalFiles affect every lambda
+var GlobalFiles = []string{"go.mod", "go.sum"}
+
+// Manifest is read by trigger-fn, see DependencyManifest there
+type Manifest struct {
+	Module   string              `json:"module"`
+	Packages map[string][]string `json:"packages"`
+	Global   []string            `json:"global"`
+}
+
+// Package is a package listed by `go list`
+type Package struct {
+	Name       string
+	ImportPath string
+	Deps       []string
+}
+
+func main() {
+	output := flag.String("o", "", "file to write the manifest to, defaults to stdout")
+	flag.Parse()
+
+	patterns := flag.Args()
+	if len(patterns) == 0 {
+		patterns = DefaultPatterns
+	}
+
+	module, err := goList("-m", "-f", "{{.Path}}")
+	if err != nil {
+		log.Fatalf("error in reading module path: %v", err.Error())
+	}
+
+	out, err := goList(append([]string{"-f", "{{.Name}} {{.ImportPath}} {{join .Deps \" \"}}"}, patterns...)...)
+	if err != nil {
+		log.Fatalf("error in listing packages: %v", err.Error())
+	}
+
+	manifest := buildManifest(strings.TrimSpace(module), parsePackages(out))
+
+	b, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		log.Fatalf("error in marshalling manifest: %v", err.Error())
+	}
+	b = append(b, '\n')
+
+	if *output == "" {
+		os.Stdout.Write(b)
+		return
+	}
+	err = os.WriteFile(*output, b, 0644)
+	if err != nil {
+		log.Fatalf("error in writing manifest: %v", err.Error())
+	}
+}
+
+func goList(args ...string) (string, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command("go", append([]string{"list"}, args...)...)
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("%v: %s", err, stderr.String())
+	}
+	return string(out), nil
+}
+
+// parsePackages reads the `<name> <import path> <deps...>` lines printed by go list
+func parsePackages(out string) []Package {
+	pkgs := []Package{}
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	scanner.Buffer(make([]byte, 0, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		pkgs = append(pkgs, Package{
+			Name:       fields[0],
+			ImportPath: fields[1],
+			Deps:       fields[2:],
+		})
+	}
+
+	return pkgs
+}
+
+// buildManifest maps the packages of the module the lambdas depend on to the lambdas
+func buildManifest(module string, pkgs []Package) Manifest {
+	manifest := Manifest{
+		Module:   module,
+		Packages: map[string][]string{},
+		Global:   GlobalFiles,
+	}
+
+	// dir returns the directory of a package of the module relative to the root
+	dir := func(importPath string) (string, bool) {
+		if !strings.HasPrefix(importPath, module+"/") {
+			return "", false
+		}
+		return strings.TrimPrefix(importPath, module+"/"), true
+	}
+
+	for _, pkg := range pkgs {
+		lambda, ok := dir(pkg.ImportPath)
+		if pkg.Name != "main" || !ok {
+			continue
+		}
+
+		manifest.Packages[lambda] = append(manifest.Packages[lambda], lambda)
+		for _, dep := range pkg.Deps {
+			if d, ok := dir(dep); ok {
+				manifest.Packages[d] = append(manifest.Packages[d], lambda)
+			}
+		}
+	}
+
+	for _, lambdas := range manifest.Packages {
+		sort.Strings(lambdas)
+	}
+
+	return manifest
+}
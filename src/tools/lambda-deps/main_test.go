@@ -0,0 +1,29 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBuildManifest(t *testing.T) {
+	out := `main cloudfront/src/lambda/api/account cloudfront/src/pkg/session github.com/aws/aws-lambda-go/lambda fmt
+main cloudfront/src/lambda/api/auth cloudfront/src/pkg/session cloudfront/src/pkg/session/cookie
+session cloudfront/src/pkg/session cloudfront/src/pkg/session/cookie
+main cloudfront/src/lambda/workflow/email
+`
+
+	manifest := buildManifest("cloudfront", parsePackages(out))
+	want := map[string][]string{
+		"src/lambda/api/account":    {"src/lambda/api/account"},
+		"src/lambda/api/auth":       {"src/lambda/api/auth"},
+		"src/lambda/workflow/email": {"src/lambda/workflow/email"},
+		"src/pkg/session":           {"src/lambda/api/account", "src/lambda/api/auth"},
+		"src/pkg/session/cookie":    {"src/lambda/api/auth"},
+	}
+	if !reflect.DeepEqual(manifest.Packages, want) {
+		t.Errorf("expected %v, got %v", want, manifest.Packages)
+	}
+	if manifest.Module != "cloudfront" || !reflect.DeepEqual(manifest.Global, GlobalFiles) {
+		t.Errorf("unexpected manifest %+v", manifest)
+	}
+}
@@ -0,0 +1,267 @@
+// replay-delivery sends a delivery archived by trigger-fn again, signed with the webhook secret.
+//
+// It replays to the deployed function url:
+//
+//	replay-delivery -delivery s3://bucket/deliveries/2024/03/10/<id>.json -secret-arn <arn> -url https://<id>.lambda-url.<region>.on.aws/
+//
+// or to trigger-fn running locally in the lambda runtime interface emulator:
+//
+//	replay-delivery -delivery delivery.json -local http://localhost:9000/2015-03-31/functions/function/invocations
+//
+// With -dry-run trigger-fn explains which pipelines the delivery starts without starting them,
+// with -print the signed request is printed instead of sent.
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	log "github.com/sirupsen/logrus"
+)
+
+// ArchivedDelivery is written by trigger-fn for every delivery it authenticates
+type ArchivedDelivery struct {
+	DeliveryID string            `json:"delivery_id"`
+	Provider   string            `json:"provider"`
+	ReceivedAt time.Time         `json:"received_at"`
+	SourceIP   string            `json:"source_ip"`
+	Headers    map[string]string `json:"headers"`
+	Body       string            `json:"body"`
+}
+
+// DryRunHeader asks trigger-fn to explain its decision
+const DryRunHeader = "x-trigger-dry-run"
+
+// skipHeaders are set by the function url or the http client, not by the provider
+var skipHeaders = []string{"host", "content-length", "x-forwarded-", "x-amzn-"}
+
+func main() {
+	deliveryURI := flag.String("delivery", "", "archived delivery, an s3:// uri or a local file")
+	target := flag.String("url", "", "function url to send the delivery to")
+	local := flag.String("local", "", "invocation url of trigger-fn running in the lambda runtime interface emulator")
+	secretArn := flag.String("secret-arn", "", "arn of the webhook secret, defaults to the WEBHOOK_SECRET env var")
+	deliveryID := flag.String("delivery-id", "", "send the delivery with a new id, trigger-fn ignores the ids it already processed")
+	dryRun := flag.Bool("dry-run", false, "ask trigger-fn to explain its decision instead of starting the pipelines")
+	printOnly := flag.Bool("print", false, "print the request instead of sending it")
+	flag.Parse()
+
+	if *deliveryURI == "" || (*target == "" && *local == "" && !*printOnly) {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	b, err := readDelivery(*deliveryURI)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	delivery := ArchivedDelivery{}
+	err = json.Unmarshal(b, &delivery)
+	if err != nil {
+		log.Fatalf("error in unmarshalling delivery: %v", err.Error())
+	}
+
+	secret := os.Getenv("WEBHOOK_SECRET")
+	if *secretArn != "" {
+		secret, err = readSecret(*secretArn)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if secret == "" {
+		log.Fatalln("the webhook secret is needed to sign the delivery, set -secret-arn or WEBHOOK_SECRET")
+	}
+
+	headers := replayHeaders(delivery, []byte(secret), *deliveryID)
+	if *dryRun {
+		headers[DryRunHeader] = "true"
+	}
+
+	if *printOnly {
+		printRequest(os.Stdout, headers, delivery.Body)
+		return
+	}
+
+	var status int
+	var body string
+	if *local != "" {
+		status, body, err = invokeLocal(*local, headers, delivery)
+	} else {
+		status, body, err = post(*target, headers, delivery.Body)
+	}
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	fmt.Printf("%d %s\n", status, body)
+}
+
+// replayHeaders returns the headers of the delivery signed with the secret,
+// the way its provider signs them
+func replayHeaders(delivery ArchivedDelivery, secret []byte, deliveryID string) map[string]string {
+	headers := map[string]string{}
+	for k, v := range delivery.Headers {
+		k = strings.ToLower(k)
+		if skipHeader(k) {
+			continue
+		}
+		if deliveryID != "" && v == delivery.DeliveryID {
+			v = deliveryID
+		}
+		headers[k] = v
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(delivery.Body))
+	signature := hex.EncodeToString(mac.Sum(nil))
+
+	switch delivery.Provider {
+	case "gitlab":
+		headers["x-gitlab-token"] = string(secret)
+	case "gitea":
+		headers["x-gitea-signature"] = signature
+	case "bitbucket":
+		headers["x-hub-signature"] = "sha256=" + signature
+	default:
+		headers["x-hub-signature-256"] = "sha256=" + signature
+	}
+
+	return headers
+}
+
+func skipHeader(name string) bool {
+	for _, prefix := range skipHeaders {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// post sends the delivery to the function url
+func post(target string, headers map[string]string, body string) (int, string, error) {
+	req, err := http.NewRequest(http.MethodPost, target, strings.NewReader(body))
+	if err != nil {
+		return 0, "", err
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	client := &http.Client{Timeout: 60 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, "", fmt.Errorf("error in sending delivery: %v", err.Error())
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, "", err
+	}
+
+	return resp.StatusCode, string(b), nil
+}
+
+// invokeLocal invokes trigger-fn with the function url event the delivery would have produced
+func invokeLocal(invokeURL string, headers map[string]string, delivery ArchivedDelivery) (int, string, error) {
+	evt := events.LambdaFunctionURLRequest{
+		Version: "2.0",
+		RawPath: "/",
+		Headers: headers,
+		Body:    delivery.Body,
+	}
+	evt.RequestContext.HTTP.Method = http.MethodPost
+	evt.RequestContext.HTTP.Path = "/"
+	evt.RequestContext.HTTP.SourceIP = delivery.SourceIP
+
+	b, err := json.Marshal(evt)
+	if err != nil {
+		return 0, "", err
+	}
+
+	status, body, err := post(invokeURL, map[string]string{"content-type": "application/json"}, string(b))
+	if err != nil {
+		return 0, "", err
+	}
+	if status != http.StatusOK {
+		return 0, "", fmt.Errorf("error in invoking trigger-fn: %d %s", status, body)
+	}
+
+	resp := events.LambdaFunctionURLResponse{}
+	err = json.Unmarshal([]byte(body), &resp)
+	if err != nil {
+		return 0, "", fmt.Errorf("error in unmarshalling trigger-fn response %s: %v", body, err.Error())
+	}
+
+	return resp.StatusCode, resp.Body, nil
+}
+
+func printRequest(w io.Writer, headers map[string]string, body string) {
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintln(w, "POST /")
+	for _, k := range names {
+		fmt.Fprintf(w, "%s: %s\n", k, headers[k])
+	}
+	fmt.Fprintf(w, "\n%s\n", body)
+}
+
+func readDelivery(uri string) ([]byte, error) {
+	if !strings.HasPrefix(uri, "s3://") {
+		return os.ReadFile(uri)
+	}
+
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("invalid s3 uri %s", uri)
+	}
+
+	sess := session.Must(session.NewSessionWithOptions(session.Options{
+		SharedConfigState: session.SharedConfigEnable,
+	}))
+	obj, err := s3.New(sess).GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(u.Host),
+		Key:    aws.String(strings.TrimPrefix(u.Path, "/")),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error in downloading %s: %v", uri, err.Error())
+	}
+	defer obj.Body.Close()
+
+	return io.ReadAll(obj.Body)
+}
+
+func readSecret(secretArn string) (string, error) {
+	sess := session.Must(session.NewSessionWithOptions(session.Options{
+		SharedConfigState: session.SharedConfigEnable,
+	}))
+
+	resp, err := secretsmanager.New(sess).GetSecretValue(&secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(secretArn),
+	})
+	if err != nil {
+		return "", fmt.Errorf("error in reading secret %s: %v", secretArn, err.Error())
+	}
+
+	return aws.StringValue(resp.SecretString), nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+var testDelivery = ArchivedDelivery{
+	DeliveryID: "72d3162e",
+	Provider:   "github",
+	SourceIP:   "140.82.115.10",
+	Headers: map[string]string{
+		"X-GitHub-Event":      "push",
+		"x-github-delivery":   "72d3162e",
+		"x-hub-signature-256": "[redacted]",
+		"host":                "abc.lambda-url.eu-west-1.on.aws",
+		"x-forwarded-for":     "140.82.115.10",
+	},
+	Body: `{"ref": "refs/heads/main"}`,
+}
+
+func TestReplayHeaders(t *testing.T) {
+	delivery := testDelivery
+	delivery.Body = "Hello, World!"
+	headers := replayHeaders(delivery, []byte("It's a Secret to Everybody"), "72d3162e-replay")
+
+	// Example from the github docs
+	if got := headers["x-hub-signature-256"]; got != "sha256=757107ea0eb2509fc211221cce984b8a37570b6d7586c22c46f4379c8b043e17" {
+		t.Errorf("unexpected signature %s", got)
+	}
+	if headers["x-github-delivery"] != "72d3162e-replay" {
+		t.Errorf("expected the new delivery id, got %s", headers["x-github-delivery"])
+	}
+	if headers["x-github-event"] != "push" {
+		t.Errorf("expected the lower case event header, got %v", headers)
+	}
+	if _, ok := headers["host"]; ok {
+		t.Errorf("expected the host header to be dropped")
+	}
+	if _, ok := headers["x-forwarded-for"]; ok {
+		t.Errorf("expected the forwarded headers to be dropped")
+	}
+
+	gitlab := testDelivery
+	gitlab.Provider = "gitlab"
+	headers = replayHeaders(gitlab, []byte("token"), "")
+	if headers["x-gitlab-token"] != "token" || headers["x-github-delivery"] != "72d3162e" {
+		t.Errorf("expected the gitlab token and the original id, got %v", headers)
+	}
+}
+
+func TestInvokeLocal(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		evt := events.LambdaFunctionURLRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&evt); err != nil {
+			t.Errorf("error in decoding event: %v", err)
+		}
+		if evt.Body != testDelivery.Body || evt.RequestContext.HTTP.SourceIP != testDelivery.SourceIP {
+			t.Errorf("unexpected event %+v", evt)
+		}
+
+		json.NewEncoder(w).Encode(events.LambdaFunctionURLResponse{
+			StatusCode: http.StatusOK,
+			Body:       `{"executions": []}`,
+		})
+	}))
+	defer server.Close()
+
+	status, body, err := invokeLocal(server.URL, replayHeaders(testDelivery, []byte("secret"), ""), testDelivery)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if status != http.StatusOK || body != `{"executions": []}` {
+		t.Errorf("unexpected response %d %s", status, body)
+	}
+}